@@ -43,6 +43,7 @@ func main() {
 	mutex := http.NewServeMux()
 	mutex.HandleFunc("/status", interLinkAPIs.StatusHandler)
 	mutex.HandleFunc("/create", interLinkAPIs.CreateHandler)
+	mutex.HandleFunc("/update", interLinkAPIs.UpdateHandler)
 	mutex.HandleFunc("/delete", interLinkAPIs.DeleteHandler)
 	mutex.HandleFunc("/ping", interLinkAPIs.Ping)
 	mutex.HandleFunc("/getLogs", interLinkAPIs.GetLogsHandler)
@@ -2,9 +2,11 @@ package main
 
 import (
 	"context"
+	"expvar"
 	"net/http"
 	"strconv"
 
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sirupsen/logrus"
 	"github.com/virtual-kubelet/virtual-kubelet/log"
 	logruslogger "github.com/virtual-kubelet/virtual-kubelet/log/logrus"
@@ -42,14 +44,40 @@ func main() {
 		Ctx:    Ctx,
 	}
 
+	slurm.CreateDirectories(interLinkConfig)
+	err = interLinkConfig.Validate()
+	if err != nil {
+		log.G(Ctx).Fatal(err)
+	}
+
 	mutex := http.NewServeMux()
 	mutex.HandleFunc("/status", SidecarAPIs.StatusHandler)
+	mutex.HandleFunc("/watch", SidecarAPIs.WatchHandler)
 	mutex.HandleFunc("/create", SidecarAPIs.SubmitHandler)
+	mutex.HandleFunc("/update", SidecarAPIs.UpdateHandler)
 	mutex.HandleFunc("/delete", SidecarAPIs.StopHandler)
+	mutex.HandleFunc("/deletePods", SidecarAPIs.DeleteHandler)
 	mutex.HandleFunc("/getLogs", SidecarAPIs.GetLogsHandler)
+	mutex.HandleFunc("/export", SidecarAPIs.ExportHandler)
+	mutex.HandleFunc("/jobInfo", SidecarAPIs.JobInfoHandler)
+	mutex.HandleFunc("/jobs", SidecarAPIs.ListJobsHandler)
+	mutex.Handle("/debug/vars", expvar.Handler())
+	mutex.Handle("/metrics", promhttp.Handler())
 
-	slurm.CreateDirectories(interLinkConfig)
 	slurm.LoadJIDs(interLinkConfig, &JobIDs, Ctx)
+	err = slurm.ApplyStartupPolicy(interLinkConfig, &JobIDs, Ctx)
+	if err != nil {
+		log.G(Ctx).Fatal(err)
+	}
+	err = SidecarAPIs.PruneFinishedJobs()
+	if err != nil {
+		log.G(Ctx).Warn("Unable to prune finished jobs: " + err.Error())
+	}
+	err = SidecarAPIs.LoadStatusCache()
+	if err != nil {
+		log.G(Ctx).Warn("Unable to load status snapshot: " + err.Error())
+	}
+	SidecarAPIs.ResumePendingCancels()
 
 	err = http.ListenAndServe(":"+interLinkConfig.Sidecarport, mutex)
 	if err != nil {
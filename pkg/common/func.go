@@ -2,12 +2,17 @@ package common
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
+	"os/exec"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"time"
 
 	"k8s.io/client-go/kubernetes"
 
@@ -124,6 +129,102 @@ func NewInterLinkConfig() (InterLinkConfig, error) {
 	return InterLinkConfigInst, nil
 }
 
+// Validate checks the paths used by the Slurm sidecar: the Slurm and bash binaries must exist and
+// be executable, DataRootFolder must be writable and TsocksPath must exist when Tsocks is enabled.
+// Every misconfiguration found is listed in the returned error.
+func (config InterLinkConfig) Validate() error {
+	var problems []string
+
+	binaries := map[string]string{
+		"SbatchPath":  config.Sbatchpath,
+		"SqueuePath":  config.Squeuepath,
+		"ScancelPath": config.Scancelpath,
+		"BashPath":    config.BashPath,
+	}
+	for _, field := range []string{"SbatchPath", "SqueuePath", "ScancelPath", "BashPath"} {
+		if binaries[field] == "" {
+			problems = append(problems, field+" is not set")
+		} else if _, err := exec.LookPath(binaries[field]); err != nil {
+			problems = append(problems, field+" "+binaries[field]+" is not an executable file: "+err.Error())
+		}
+	}
+
+	if config.DataRootFolder == "" {
+		problems = append(problems, "DataRootFolder is not set")
+	} else {
+		f, err := os.CreateTemp(config.DataRootFolder, ".write-test-")
+		if err != nil {
+			problems = append(problems, "DataRootFolder "+config.DataRootFolder+" is not writable: "+err.Error())
+		} else {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}
+
+	if config.Tsocks {
+		if _, err := os.Stat(config.Tsockspath); err != nil {
+			problems = append(problems, "Tsocks is enabled but TsocksPath "+config.Tsockspath+" doesn't exist: "+err.Error())
+		}
+	}
+
+	if config.SqueueFormat != "" {
+		columns := map[string]bool{}
+		for _, column := range strings.Split(config.SqueueFormat, ",") {
+			columns[strings.ToLower(strings.TrimSpace(strings.SplitN(column, ":", 2)[0]))] = true
+		}
+		if !columns["jobid"] || !columns["state"] {
+			problems = append(problems, "SqueueFormat "+config.SqueueFormat+" must contain the JobID and State columns")
+		}
+	}
+
+	if config.StatusCacheRetention != "" {
+		if _, err := time.ParseDuration(config.StatusCacheRetention); err != nil {
+			problems = append(problems, "StatusCacheRetention "+config.StatusCacheRetention+" is not a valid duration: "+err.Error())
+		}
+	}
+
+	if config.FinishedJobRetention != "" {
+		if _, err := time.ParseDuration(config.FinishedJobRetention); err != nil {
+			problems = append(problems, "FinishedJobRetention "+config.FinishedJobRetention+" is not a valid duration: "+err.Error())
+		}
+	}
+
+	if config.SbatchRetryDelay != "" {
+		if _, err := time.ParseDuration(config.SbatchRetryDelay); err != nil {
+			problems = append(problems, "SbatchRetryDelay "+config.SbatchRetryDelay+" is not a valid duration: "+err.Error())
+		}
+	}
+
+	if config.CommandTimeout != "" {
+		if _, err := time.ParseDuration(config.CommandTimeout); err != nil {
+			problems = append(problems, "CommandTimeout "+config.CommandTimeout+" is not a valid duration: "+err.Error())
+		}
+	}
+
+	envPatterns := map[string][]string{
+		"EnvAllowlist": config.EnvAllowlist,
+		"EnvDenylist":  config.EnvDenylist,
+	}
+	for _, field := range []string{"EnvAllowlist", "EnvDenylist"} {
+		for _, pattern := range envPatterns[field] {
+			if _, err := filepath.Match(pattern, ""); err != nil {
+				problems = append(problems, field+" pattern "+strconv.Quote(pattern)+" is malformed: "+err.Error())
+			}
+		}
+	}
+
+	switch config.BindEnvPolicy {
+	case "", "inherit", "clear", "merge":
+	default:
+		problems = append(problems, "BindEnvPolicy "+config.BindEnvPolicy+" is not one of inherit, clear or merge")
+	}
+
+	if len(problems) > 0 {
+		return errors.New("invalid InterLink configuration:\n- " + strings.Join(problems, "\n- "))
+	}
+	return nil
+}
+
 func PingInterLink(ctx context.Context) (bool, int, error) {
 	log.G(ctx).Info("Pinging: " + InterLinkConfigInst.Interlinkurl + ":" + InterLinkConfigInst.Interlinkport + "/ping")
 	retVal := -1
@@ -17,19 +17,27 @@ type PodStatus struct {
 	PodName      string               `json:"name"`
 	PodUID       string               `json:"UID"`
 	PodNamespace string               `json:"namespace"`
+	NodeName     string               `json:"nodeName,omitempty"`
+	HostIP       string               `json:"hostIP,omitempty"`
+	PodIP        string               `json:"podIP,omitempty"`
+	Phase        v1.PodPhase          `json:"phase,omitempty"`
 	Containers   []v1.ContainerStatus `json:"containers"`
+	Annotations  map[string]string    `json:"annotations,omitempty"`
 }
 
 type RetrievedContainer struct {
-	Name       string         `json:"name"`
-	ConfigMaps []v1.ConfigMap `json:"configMaps"`
-	Secrets    []v1.Secret    `json:"secrets"`
-	EmptyDirs  []string       `json:"emptyDirs"`
+	Name                string         `json:"name"`
+	ConfigMaps          []v1.ConfigMap `json:"configMaps"`
+	Secrets             []v1.Secret    `json:"secrets"`
+	EmptyDirs           []string       `json:"emptyDirs"`
+	ProjectedConfigMaps []v1.ConfigMap `json:"projectedConfigMaps,omitempty"`
+	ProjectedSecrets    []v1.Secret    `json:"projectedSecrets,omitempty"`
 }
 
 type RetrievedPodData struct {
-	Pod        v1.Pod               `json:"pod"`
-	Containers []RetrievedContainer `json:"container"`
+	Pod              v1.Pod               `json:"pod"`
+	Containers       []RetrievedContainer `json:"container"`
+	ImagePullSecrets []v1.Secret          `json:"imagePullSecrets,omitempty"`
 }
 
 type ConfigMapSecret struct {
@@ -41,30 +49,87 @@ type ConfigMapSecret struct {
 }
 
 type InterLinkConfig struct {
-	VKConfigPath      string
-	VKTokenFile       string `yaml:"VKTokenFile"`
-	Interlinkurl      string `yaml:"InterlinkURL"`
-	Sidecarurl        string `yaml:"SidecarURL"`
-	Sbatchpath        string `yaml:"SbatchPath"`
-	Scancelpath       string `yaml:"ScancelPath"`
-	Squeuepath        string `yaml:"SqueuePath"`
-	Interlinkport     string `yaml:"InterlinkPort"`
-	Sidecarport       string `yaml:"SidecarPort"`
-	Commandprefix     string `yaml:"CommandPrefix"`
-	ExportPodData     bool   `yaml:"ExportPodData"`
-	DataRootFolder    string `yaml:"DataRootFolder"`
-	ServiceAccount    string `yaml:"ServiceAccount"`
-	Namespace         string `yaml:"Namespace"`
-	Tsocks            bool   `yaml:"Tsocks"`
-	Tsockspath        string `yaml:"TsocksPath"`
-	Tsocksconfig      string `yaml:"TsocksConfig"`
-	Tsockslogin       string `yaml:"TsocksLoginNode"`
-	BashPath          string `yaml:"BashPath"`
-	VerboseLogging    bool   `yaml:"VerboseLogging"`
-	ErrorsOnlyLogging bool   `yaml:"ErrorsOnlyLogging"`
-	PodIP             string `yaml:"PodIP"`
-	SingularityPrefix string `yaml:"SingularityPrefix"`
-	set               bool
+	VKConfigPath            string
+	VKTokenFile             string            `yaml:"VKTokenFile"`
+	Interlinkurl            string            `yaml:"InterlinkURL"`
+	Sidecarurl              string            `yaml:"SidecarURL"`
+	Sbatchpath              string            `yaml:"SbatchPath"`
+	Scancelpath             string            `yaml:"ScancelPath"`
+	Squeuepath              string            `yaml:"SqueuePath"`
+	Sacctpath               string            `yaml:"SacctPath"`
+	Sinfopath               string            `yaml:"SinfoPath"`
+	Srunpath                string            `yaml:"SrunPath"`
+	Scontrolpath            string            `yaml:"ScontrolPath"`
+	ContainerSteps          bool              `yaml:"ContainerSteps"`
+	Seffpath                string            `yaml:"SeffPath"`
+	Interlinkport           string            `yaml:"InterlinkPort"`
+	Sidecarport             string            `yaml:"SidecarPort"`
+	Commandprefix           string            `yaml:"CommandPrefix"`
+	ExportPodData           bool              `yaml:"ExportPodData"`
+	DataRootFolder          string            `yaml:"DataRootFolder"`
+	ServiceAccount          string            `yaml:"ServiceAccount"`
+	Namespace               string            `yaml:"Namespace"`
+	Tsocks                  bool              `yaml:"Tsocks"`
+	Tsockspath              string            `yaml:"TsocksPath"`
+	Tsocksconfig            string            `yaml:"TsocksConfig"`
+	Tsockslogin             string            `yaml:"TsocksLoginNode"`
+	BashPath                string            `yaml:"BashPath"`
+	AllowedShells           []string          `yaml:"AllowedShells"`
+	VerboseLogging          bool              `yaml:"VerboseLogging"`
+	ErrorsOnlyLogging       bool              `yaml:"ErrorsOnlyLogging"`
+	PodIP                   string            `yaml:"PodIP"`
+	SingularityPrefix       string            `yaml:"SingularityPrefix"`
+	SingularityHomeTemplate *string           `yaml:"SingularityHomeTemplate"`
+	PartitionCommandPrefix  map[string]string `yaml:"PartitionCommandPrefix"`
+	AllowedAnnotations      []string          `yaml:"AllowedAnnotations"`
+	DefaultTimeLimit        string            `yaml:"DefaultTimeLimit"`
+	TimeLimitGracePeriod    int               `yaml:"TimeLimitGracePeriod"`
+	GPUSharingProfiles      []string          `yaml:"GPUSharingProfiles"`
+	GPUResourceName         string            `yaml:"GPUResourceName"`
+	ContainerRuntime        string            `yaml:"ContainerRuntime"`
+	CacheImages             bool              `yaml:"CacheImages"`
+	BindEnvPolicy           string            `yaml:"BindEnvPolicy"`
+	QOSClassMapping         map[string]string `yaml:"QOSClassMapping"`
+	DefaultQOS              string            `yaml:"DefaultQOS"`
+	StrictVolumes           bool              `yaml:"StrictVolumes"`
+	MaxContainers           int               `yaml:"MaxContainers"`
+	MaxScriptSize           int               `yaml:"MaxScriptSize"`
+	MountConcurrency        int               `yaml:"MountConcurrency"`
+	PVCHostPathTemplate     string            `yaml:"PVCHostPathTemplate"`
+	HostPathAllowedPrefixes []string          `yaml:"HostPathAllowedPrefixes"`
+	StartupJobPolicy        string            `yaml:"StartupJobPolicy"`
+	SqueueFormat            string            `yaml:"SqueueFormat"`
+	DefaultPartition        string            `yaml:"DefaultPartition"`
+	StatusCacheRetention    string            `yaml:"StatusCacheRetention"`
+	FinishedJobRetention    string            `yaml:"FinishedJobRetention"`
+	WatchInterval           int               `yaml:"WatchInterval"`
+	DefaultEnv              map[string]string `yaml:"DefaultEnv"`
+	SkipEmptyEnv            bool              `yaml:"SkipEmptyEnv"`
+	EnvAllowlist            []string          `yaml:"EnvAllowlist"`
+	EnvDenylist             []string          `yaml:"EnvDenylist"`
+	InjectedEnv             map[string]string `yaml:"InjectedEnv"`
+	NamespaceAccounts       map[string]string `yaml:"NamespaceAccounts"`
+	DefaultAccount          string            `yaml:"DefaultAccount"`
+	RequireAccount          bool              `yaml:"RequireAccount"`
+	StatusSingleFlight      bool              `yaml:"StatusSingleFlight"`
+	SbatchMaxAttempts       int               `yaml:"SbatchMaxAttempts"`
+	SbatchRetryDelay        string            `yaml:"SbatchRetryDelay"`
+	CommandTimeout          string            `yaml:"CommandTimeout"`
+	MaxRestarts             int               `yaml:"MaxRestarts"`
+	StablePodLinks          bool              `yaml:"StablePodLinks"`
+	TopologySpread          bool              `yaml:"TopologySpread"`
+	JobEfficiency           bool              `yaml:"JobEfficiency"`
+	ScratchBaseDir          string            `yaml:"ScratchBaseDir"`
+	MemoryEmptyDirBase      string            `yaml:"MemoryEmptyDirBase"`
+	ResourcePreflight       bool              `yaml:"ResourcePreflight"`
+	ExpandPodFields         bool              `yaml:"ExpandPodFields"`
+	CombinedOutput          bool              `yaml:"CombinedOutput"`
+	RefreshMounts           bool              `yaml:"RefreshMounts"`
+	MountRefreshInterval    int               `yaml:"MountRefreshInterval"`
+	ResolveNodeIP           bool              `yaml:"ResolveNodeIP"`
+	NodeIPCommand           string            `yaml:"NodeIPCommand"`
+	NodeDomainSuffix        string            `yaml:"NodeDomainSuffix"`
+	set                     bool
 }
 
 type ServiceAccount struct {
@@ -92,4 +157,12 @@ type LogStruct struct {
 	PodName       string           `json:"PodName"`
 	ContainerName string           `json:"ContainerName"`
 	Opts          ContainerLogOpts `json:"Opts"`
+	// Stream selects the stdout or stderr output of the container, both of them when empty
+	Stream string `json:"Stream,omitempty"`
+}
+
+type ExportStruct struct {
+	Namespace      string `json:"Namespace"`
+	PodUID         string `json:"PodUID"`
+	ExcludeSecrets bool   `json:"ExcludeSecrets"`
 }
@@ -82,6 +82,13 @@ func (h *InterLinkHandler) CreateHandler(w http.ResponseWriter, r *http.Request)
 		if resp.StatusCode == http.StatusOK {
 			statusCode = http.StatusOK
 			log.G(Ctx).Debug(statusCode)
+		} else if resp.StatusCode == http.StatusServiceUnavailable {
+			// the sidecar asks to retry later, e.g. because the Slurm queue is full
+			statusCode = http.StatusServiceUnavailable
+			if retryAfter := resp.Header.Get("Retry-After"); retryAfter != "" {
+				w.Header().Set("Retry-After", retryAfter)
+			}
+			log.G(Ctx).Warning(statusCode)
 		} else {
 			statusCode = http.StatusInternalServerError
 			log.G(Ctx).Error(statusCode)
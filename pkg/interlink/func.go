@@ -32,6 +32,15 @@ func getData(pod commonIL.PodCreateRequests, config commonIL.InterLinkConfig) (c
 		retrievedData.Containers = append(retrievedData.Containers, data)
 	}
 
+	for _, pullSecret := range pod.Pod.Spec.ImagePullSecrets {
+		for _, secret := range pod.Secrets {
+			if secret.Name == pullSecret.Name {
+				log.G(Ctx).Info("- Retrieving image pull Secret " + secret.Name)
+				retrievedData.ImagePullSecrets = append(retrievedData.ImagePullSecrets, secret)
+			}
+		}
+	}
+
 	return retrievedData, nil
 }
 
@@ -64,6 +73,26 @@ func retrieveData(container v1.Container, pod commonIL.PodCreateRequests, config
 						}
 					}
 
+				} else if vol.Projected != nil {
+
+					log.G(Ctx).Info("--- Retrieving sources of projected volume " + vol.Name)
+					retrievedData.Name = container.Name
+					for _, source := range vol.Projected.Sources {
+						if source.ConfigMap != nil {
+							for _, cfgMap := range pod.ConfigMaps {
+								if cfgMap.Name == source.ConfigMap.Name {
+									retrievedData.ProjectedConfigMaps = append(retrievedData.ProjectedConfigMaps, cfgMap)
+								}
+							}
+						} else if source.Secret != nil {
+							for _, secret := range pod.Secrets {
+								if secret.Name == source.Secret.Name {
+									retrievedData.ProjectedSecrets = append(retrievedData.ProjectedSecrets, secret)
+								}
+							}
+						}
+					}
+
 				} else if vol.EmptyDir != nil {
 					edPath := filepath.Join(config.DataRootFolder, pod.Pod.Namespace+"-"+string(pod.Pod.UID)+"/"+"emptyDirs/"+vol.Name)
 
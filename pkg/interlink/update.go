@@ -1 +1,80 @@
 package interlink
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+
+	"github.com/containerd/containerd/log"
+
+	commonIL "github.com/intertwin-eu/interlink/pkg/common"
+)
+
+// UpdateHandler forwards the current ConfigMaps and Secrets of an already created Pod to the sidecar,
+// which refreshes the files mounted in its containers.
+func (h *InterLinkHandler) UpdateHandler(w http.ResponseWriter, r *http.Request) {
+	log.G(Ctx).Info("InterLink: received Update call")
+
+	bodyBytes, err := io.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.G(Ctx).Error(err)
+		return
+	}
+
+	var pod commonIL.PodCreateRequests
+	err = json.Unmarshal(bodyBytes, &pod)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.G(Ctx).Error(err)
+		return
+	}
+
+	if !h.Config.ExportPodData {
+		// the sidecar never received the Pod data, there is nothing to update
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("Nothing to update"))
+		return
+	}
+
+	data, err := getData(pod, h.Config)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.G(Ctx).Error(err)
+		return
+	}
+
+	bodyBytes, err = json.Marshal([]commonIL.RetrievedPodData{data})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.G(Ctx).Error(err)
+		return
+	}
+
+	req, err := http.NewRequest(http.MethodPost, h.Config.Sidecarurl+":"+h.Config.Sidecarport+"/update", bytes.NewReader(bodyBytes))
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.G(Ctx).Error(err)
+		return
+	}
+
+	log.G(Ctx).Info("InterLink: forwarding Update call to sidecar")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.G(Ctx).Error(err)
+		return
+	}
+	defer resp.Body.Close()
+
+	returnValue, _ := io.ReadAll(resp.Body)
+	log.G(Ctx).Debug(string(returnValue))
+	if resp.StatusCode != http.StatusOK {
+		log.G(Ctx).Error(resp.StatusCode)
+		w.WriteHeader(http.StatusInternalServerError)
+	} else {
+		w.WriteHeader(http.StatusOK)
+	}
+	w.Write(returnValue)
+}
@@ -2,12 +2,15 @@ package slurm
 
 import (
 	"encoding/json"
+	"errors"
 	"io"
 	"net/http"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/containerd/containerd/log"
+	v1 "k8s.io/api/core/v1"
 
 	commonIL "github.com/intertwin-eu/interlink/pkg/common"
 )
@@ -15,6 +18,12 @@ import (
 func (h *SidecarHandler) SubmitHandler(w http.ResponseWriter, r *http.Request) {
 	log.G(h.Ctx).Info("Slurm Sidecar: received Submit call")
 	statusCode := http.StatusOK
+	requestsTotal.WithLabelValues("submit").Inc()
+	defer func() {
+		if statusCode != http.StatusOK {
+			requestFailuresTotal.WithLabelValues("submit").Inc()
+		}
+	}()
 	bodyBytes, err := io.ReadAll(r.Body)
 	if err != nil {
 		statusCode = http.StatusInternalServerError
@@ -39,24 +48,102 @@ func (h *SidecarHandler) SubmitHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	for _, data := range req {
-		containers := data.Pod.Spec.Containers
+		containers := append([]v1.Container{}, data.Pod.Spec.InitContainers...)
+		containers = append(containers, data.Pod.Spec.Containers...)
 		metadata := data.Pod.ObjectMeta
+		metadata.Annotations = filterAnnotations(metadata.Annotations, h.Config, h.Ctx)
 		filesPath := h.Config.DataRootFolder + data.Pod.Namespace + "-" + string(data.Pod.UID)
 
+		err = checkAccount(metadata, h.Config)
+		if err != nil {
+			statusCode = http.StatusBadRequest
+			w.WriteHeader(statusCode)
+			w.Write([]byte("Error submitting Pod " + data.Pod.Name + ": " + err.Error()))
+			log.G(h.Ctx).Error(err)
+			return
+		}
+
+		err = checkResources(metadata, data.Pod.Spec, h.Config, h.Ctx)
+		if err != nil {
+			statusCode = http.StatusBadRequest
+			w.WriteHeader(statusCode)
+			w.Write([]byte("Error submitting Pod " + data.Pod.Name + ": " + err.Error()))
+			log.G(h.Ctx).Error(err)
+			return
+		}
+
+		specHash, err := podSpecHash(data.Pod)
+		if err != nil {
+			statusCode = http.StatusInternalServerError
+			w.WriteHeader(statusCode)
+			w.Write([]byte("Error computing Pod spec hash. Check Slurm Sidecar's logs"))
+			log.G(h.Ctx).Error(err)
+			return
+		}
+
+		if jid, ok := h.lookupJID(string(data.Pod.UID)); ok {
+			if jid.SpecHash == specHash {
+				log.G(h.Ctx).Info("- Pod " + data.Pod.Name + " has already been submitted and its spec didn't change, skipping")
+				continue
+			}
+			log.G(h.Ctx).Info("- Pod " + data.Pod.Name + " spec changed, cancelling Job " + jid.JID + " before resubmitting")
+			err = h.cancelForResubmit(string(data.Pod.UID), jid.JID)
+			if err != nil {
+				statusCode = http.StatusInternalServerError
+				w.WriteHeader(statusCode)
+				w.Write([]byte("Error cancelling the previous Job of an updated Pod. Check Slurm Sidecar's logs"))
+				log.G(h.Ctx).Error(err)
+				return
+			}
+			// EmptyDirs live as long as the Pod, so they are retained across resubmissions
+			cleanWorkingDir(filesPath, true, h.Ctx)
+		}
+
+		authFile, registries, err := prepareRegistryAuth(filesPath, data.ImagePullSecrets, h.Ctx)
+		if err != nil {
+			statusCode = http.StatusBadRequest
+			w.WriteHeader(statusCode)
+			w.Write([]byte("Error preparing registry credentials of Pod " + data.Pod.Name + ": " + err.Error()))
+			log.G(h.Ctx).Error(err)
+			return
+		}
+
 		var singularity_command_pod []SingularityCommand
+		prefix := ""
+		if len(registries) > 0 {
+			prefix += "\n. " + filesPath + "/" + registryCredentialsFile
+		}
 
-		for _, container := range containers {
+		for i, container := range containers {
+			isInitContainer := i < len(data.Pod.Spec.InitContainers)
 			log.G(h.Ctx).Info("- Beginning script generation for container " + container.Name)
 			singularityPrefix := commonIL.InterLinkConfigInst.SingularityPrefix
 			if singularityAnnotation, ok := metadata.Annotations["job.vk.io/singularity-commands"]; ok {
 				singularityPrefix += " " + singularityAnnotation
 			}
-			commstr1 := []string{"singularity", "exec", "--writable-tmpfs", "--nv", "-H", "${HOME}/" +
-				h.Config.DataRootFolder + string(data.Pod.UID) + ":${HOME}"}
+			commstr1 := runtimeCommand(h.Config, homeBind(h.Config, data.Pod))
 
-			envs := prepareEnvs(container, h.Ctx)
+			err = checkUnsupportedVolumes(container, data.Pod, h.Config, h.Ctx)
+			if err != nil {
+				statusCode = http.StatusBadRequest
+				w.WriteHeader(statusCode)
+				w.Write([]byte("Error prepairing mounts: " + err.Error()))
+				log.G(h.Ctx).Error(err)
+				return
+			}
+
+			envs, err := prepareEnvs(filesPath, container, h.Config, h.Ctx)
+			if err != nil {
+				statusCode = http.StatusInternalServerError
+				w.WriteHeader(statusCode)
+				w.Write([]byte("Error preparing environment variables. Check Slurm Sidecar's logs"))
+				log.G(h.Ctx).Error(err)
+				os.RemoveAll(filesPath)
+				return
+			}
 			image := ""
-			mounts, err := prepareMounts(filesPath, container, req, h.Config, h.Ctx)
+			mounts, mountsPrefix, err := prepareMounts(filesPath, container, req, h.Config, h.Ctx)
+			prefix += mountsPrefix
 			log.G(h.Ctx).Debug(mounts)
 			if err != nil {
 				statusCode = http.StatusInternalServerError
@@ -69,7 +156,10 @@ func (h *SidecarHandler) SubmitHandler(w http.ResponseWriter, r *http.Request) {
 
 			image = container.Image
 			if strings.HasPrefix(container.Image, "/") {
-				if image_uri, ok := metadata.Annotations["slurm-job.vk.io/image-root"]; ok {
+				// a per-container image root wins over the pod-level one
+				if image_uri, ok := metadata.Annotations["slurm-job.vk.io/image-root."+container.Name]; ok {
+					image = image_uri + container.Image
+				} else if image_uri, ok := metadata.Annotations["slurm-job.vk.io/image-root"]; ok {
 					image = image_uri + container.Image
 				} else {
 					log.G(h.Ctx).Info("- image-uri annotation not specified for path in remote filesystem")
@@ -78,17 +168,72 @@ func (h *SidecarHandler) SubmitHandler(w http.ResponseWriter, r *http.Request) {
 				image = container.Image
 			}
 
+			if h.Config.ContainerRuntime == "podman" {
+				mounts = podmanMounts(mounts)
+			}
+
+			err = checkRegistryCredentials(image, registries, data.Pod, data.ImagePullSecrets)
+			if err != nil {
+				statusCode = http.StatusBadRequest
+				w.WriteHeader(statusCode)
+				w.Write([]byte("Error preparing registry credentials of Pod " + data.Pod.Name + ": " + err.Error()))
+				log.G(h.Ctx).Error(err)
+				os.RemoveAll(filesPath)
+				return
+			}
+			registryEnvs := registryEnv(image, registries, h.Config)
+
+			imagePull := ""
+			if sifPath, ref, ok := cachedImagePath(image, authFile, registries, h.Config); ok {
+				log.G(h.Ctx).Info("-- Running image " + ref + " from cached SIF file " + sifPath)
+				imagePull = imagePullCommand(ref, sifPath, registryEnvs, registryAuthArgs(authFile, ref, h.Config), filesPath, container.Name, h.Config)
+				image = sifPath
+				registryEnvs = nil
+			}
+
 			log.G(h.Ctx).Debug("-- Appending all commands together...")
-			singularity_command := append(commstr1, envs...)
+			singularity_command := registryEnvs
+			if metadata.Annotations["slurm-job.vk.io/multi-prog"] != "true" {
+				// the ranks of a multi-prog job are already steps of their own
+				singularity_command = append(singularity_command, containerStepCommand(container, h.Config)...)
+			}
+			singularity_command = append(singularity_command, commstr1...)
+			singularity_command = append(singularity_command, envs...)
+			singularity_command = append(singularity_command, registryAuthArgs(authFile, image, h.Config)...)
+			singularity_command = append(singularity_command, scratchArgs(h.Config)...)
 			singularity_command = append(singularity_command, mounts...)
 			singularity_command = append(singularity_command, image)
-			singularity_command = append(singularity_command, container.Command...)
-			singularity_command = append(singularity_command, container.Args...)
+			singularity_command = append(singularity_command, expandPodFields(container.Command, data.Pod, h.Config)...)
+			singularity_command = append(singularity_command, expandPodFields(container.Args, data.Pod, h.Config)...)
 
-			singularity_command_pod = append(singularity_command_pod, SingularityCommand{command: singularity_command, containerName: container.Name})
+			singularity_command_pod = append(singularity_command_pod, SingularityCommand{command: singularity_command, containerName: container.Name, isInitContainer: isInitContainer, imagePull: imagePull})
 		}
 
-		path, err := produceSLURMScript(filesPath, data.Pod.Namespace, string(data.Pod.UID), metadata, singularity_command_pod, h.Config, h.Ctx)
+		failed := h.failedPods()
+		h.jidsMutex.RLock()
+		dependencies, err := resolveDependencies(metadata, h.JIDs, failed)
+		h.jidsMutex.RUnlock()
+		if err != nil {
+			statusCode = http.StatusBadRequest
+			if errors.Is(err, errDependencyNotSubmitted) {
+				// the kubelet retries the creation, by then the dependency may have been submitted
+				statusCode = http.StatusServiceUnavailable
+			}
+			w.WriteHeader(statusCode)
+			w.Write([]byte("Error resolving dependencies of Pod " + data.Pod.Name + ": " + err.Error()))
+			log.G(h.Ctx).Error(err)
+			return
+		}
+
+		path, err := produceSLURMScript(filesPath, data.Pod.Namespace, string(data.Pod.UID), metadata, data.Pod.Spec, singularity_command_pod, prefix, dependencies, h.Config, h.Ctx)
+		if errors.Is(err, errInvalidScript) {
+			statusCode = http.StatusBadRequest
+			w.WriteHeader(statusCode)
+			w.Write([]byte("Error producing Slurm script of Pod " + data.Pod.Name + ": " + err.Error()))
+			log.G(h.Ctx).Error(err)
+			os.RemoveAll(filesPath)
+			return
+		}
 		if err != nil {
 			statusCode = http.StatusInternalServerError
 			w.WriteHeader(statusCode)
@@ -98,6 +243,35 @@ func (h *SidecarHandler) SubmitHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		out, err := SLURMBatchSubmit(path, h.Config, h.Ctx)
+		if errors.Is(err, errQueueFull) {
+			// the submission quota is exhausted, the creation is retried once the controller backs off
+			statusCode = http.StatusServiceUnavailable
+			w.Header().Set("Retry-After", "60")
+			w.WriteHeader(statusCode)
+			w.Write([]byte(err.Error()))
+			log.G(h.Ctx).Error(err)
+			os.RemoveAll(filesPath)
+			return
+		}
+		if errors.Is(err, errCommandTimeout) {
+			// the controller may have accepted the job before sbatch timed out, in which case it is
+			// tracked as usual rather than being left running unnoticed
+			jobID, recoverErr := recoverSubmittedJob(string(data.Pod.UID), h.Config, h.Ctx)
+			if recoverErr == nil && jobID != "" {
+				log.G(h.Ctx).Warning("- " + err.Error() + ", but Job " + jobID + " of pod " + data.Pod.Name + " has been submitted")
+				out, err = "Submitted batch job "+jobID, nil
+			} else {
+				if recoverErr != nil {
+					log.G(h.Ctx).Error("Unable to look for the job of pod " + data.Pod.Name + ": " + recoverErr.Error())
+				}
+				// the working directory is kept, since the job may still show up and run from it
+				statusCode = http.StatusGatewayTimeout
+				w.WriteHeader(statusCode)
+				w.Write([]byte("Error submitting Slurm script: " + err.Error()))
+				log.G(h.Ctx).Error(err)
+				return
+			}
+		}
 		if err != nil {
 			statusCode = http.StatusInternalServerError
 			w.WriteHeader(statusCode)
@@ -107,16 +281,44 @@ func (h *SidecarHandler) SubmitHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		log.G(h.Ctx).Info(out)
-		err = handleJID(string(data.Pod.UID), out, data.Pod, filesPath, h.JIDs, h.Ctx)
+		h.jidsMutex.Lock()
+		err = h.handleJID(string(data.Pod.UID), out, data.Pod, filesPath)
+		h.jidsMutex.Unlock()
 		if err != nil {
 			statusCode = http.StatusInternalServerError
 			w.WriteHeader(statusCode)
-			w.Write([]byte("Error handling JID. Check Slurm Sidecar's logs"))
+			w.Write([]byte("Error handling JID of Pod " + data.Pod.Name + ": " + err.Error()))
 			log.G(h.Ctx).Error(err)
 			os.RemoveAll(filesPath)
-			err = deleteContainer(string(data.Pod.UID), filesPath, h.Config, h.JIDs, h.Ctx)
+			err = h.deleteContainer(data.Pod, "")
 			return
 		}
+
+		err = linkPodDir(h.Config, data.Pod, filesPath, h.Ctx)
+		if err != nil {
+			log.G(h.Ctx).Warning("Unable to link the working directory of pod " + data.Pod.Name + ": " + err.Error())
+		}
+
+		h.jidsMutex.Lock()
+		h.trackImagePulls((*h.JIDs)[string(data.Pod.UID)], containers)
+		h.recordCommands((*h.JIDs)[string(data.Pod.UID)], singularity_command_pod)
+		h.recordArrayJob((*h.JIDs)[string(data.Pod.UID)], metadata)
+
+		err = h.storeSpecHash(string(data.Pod.UID), specHash, filesPath)
+		if err != nil {
+			log.G(h.Ctx).Warning(err)
+		}
+
+		err = h.markSubmitted((*h.JIDs)[string(data.Pod.UID)], filesPath, time.Now())
+		h.jidsMutex.Unlock()
+		if err != nil {
+			log.G(h.Ctx).Warning("Unable to write the submission sentinel of pod " + data.Pod.Name + ": " + err.Error())
+		}
+	}
+
+	err = h.flushJIDs()
+	if err != nil {
+		log.G(h.Ctx).Warning(err)
 	}
 
 	w.WriteHeader(statusCode)
@@ -5,6 +5,7 @@ import (
 	"io"
 	"net/http"
 	"os"
+	"path/filepath"
 
 	"github.com/containerd/containerd/log"
 	v1 "k8s.io/api/core/v1"
@@ -13,6 +14,12 @@ import (
 func (h *SidecarHandler) StopHandler(w http.ResponseWriter, r *http.Request) {
 	log.G(h.Ctx).Info("Slurm Sidecar: received Stop call")
 	statusCode := http.StatusOK
+	requestsTotal.WithLabelValues("delete").Inc()
+	defer func() {
+		if statusCode != http.StatusOK {
+			requestFailuresTotal.WithLabelValues("delete").Inc()
+		}
+	}()
 
 	bodyBytes, err := io.ReadAll(r.Body)
 	if err != nil {
@@ -35,23 +42,128 @@ func (h *SidecarHandler) StopHandler(w http.ResponseWriter, r *http.Request) {
 
 	filesPath := h.Config.DataRootFolder + pod.Namespace + "-" + string(pod.UID)
 
-	err = deleteContainer(string(pod.UID), filesPath+"/"+pod.Namespace, h.Config, h.JIDs, h.Ctx)
+	cleanupPath := filesPath
+	if os.Getenv("SHARED_FS") == "true" {
+		// EmptyDirs share the Pod lifetime, so they must not survive its deletion
+		cleanupPath = filepath.Join(filesPath, "emptyDirs")
+	}
+	unlinkPodDir(h.Config, *pod, filesPath, h.Ctx)
+	if _, ok := h.lookupJID(string(pod.UID)); ok {
+		// the files are removed once the job is gone, which may be after its stop signal grace period
+		err = h.deleteContainer(*pod, cleanupPath)
+		if err != nil {
+			statusCode = http.StatusInternalServerError
+			w.WriteHeader(statusCode)
+			w.Write([]byte("Error deleting containers. Check Slurm Sidecar's logs"))
+			log.G(h.Ctx).Error(err)
+			return
+		}
+		err = h.flushJIDs()
+		if err != nil {
+			log.G(h.Ctx).Warning(err)
+		}
+	} else {
+		os.RemoveAll(cleanupPath)
+	}
+
+	w.WriteHeader(statusCode)
+	if statusCode != http.StatusOK {
+		w.Write([]byte("Some errors occurred deleting containers. Check Slurm Sidecar's logs"))
+	} else {
+
+		w.Write([]byte("All containers for submitted Pods have been deleted"))
+	}
+}
+
+// DeleteResult reports the outcome of the deletion of a single Pod's job.
+type DeleteResult struct {
+	PodName      string `json:"podName"`
+	PodNamespace string `json:"podNamespace"`
+	PodUID       string `json:"podUID"`
+	JID          string `json:"jid,omitempty"`
+	Deleted      bool   `json:"deleted"`
+	Error        string `json:"error,omitempty"`
+}
+
+// DeleteHandler cancels the Slurm jobs of a list of Pods and removes their working directories,
+// replying with the outcome for every Pod. Pods whose job is unknown or already gone are reported
+// as deleted, so the call can be safely retried.
+func (h *SidecarHandler) DeleteHandler(w http.ResponseWriter, r *http.Request) {
+	log.G(h.Ctx).Info("Slurm Sidecar: received Delete call")
+	statusCode := http.StatusOK
+	requestsTotal.WithLabelValues("delete").Inc()
+	failed := false
+	defer func() {
+		if failed || statusCode != http.StatusOK {
+			requestFailuresTotal.WithLabelValues("delete").Inc()
+		}
+	}()
+
+	bodyBytes, err := io.ReadAll(r.Body)
 	if err != nil {
 		statusCode = http.StatusInternalServerError
 		w.WriteHeader(statusCode)
-		w.Write([]byte("Error deleting containers. Check Slurm Sidecar's logs"))
+		w.Write([]byte("Some errors occurred while deleting jobs. Check Slurm Sidecar's logs"))
+		log.G(h.Ctx).Error(err)
+		return
+	}
+
+	var req []*v1.Pod
+	err = json.Unmarshal(bodyBytes, &req)
+	if err != nil {
+		statusCode = http.StatusBadRequest
+		w.WriteHeader(statusCode)
+		w.Write([]byte("Some errors occurred while deleting jobs. Check Slurm Sidecar's logs"))
 		log.G(h.Ctx).Error(err)
 		return
 	}
-	if os.Getenv("SHARED_FS") != "true" {
+
+	var resp []DeleteResult
+	for _, pod := range req {
+		result := DeleteResult{PodName: pod.Name, PodNamespace: pod.Namespace, PodUID: string(pod.UID), Deleted: true}
+		filesPath := h.Config.DataRootFolder + pod.Namespace + "-" + string(pod.UID)
+
+		unlinkPodDir(h.Config, *pod, filesPath, h.Ctx)
+		if jid, ok := h.lookupJID(string(pod.UID)); ok {
+			result.JID = jid.JID
+			// the working directory is removed once the job is gone, which may be after its stop
+			// signal grace period
+			err = h.deleteContainer(*pod, filesPath)
+			if err != nil {
+				log.G(h.Ctx).Error(err)
+				result.Deleted = false
+				result.Error = err.Error()
+				failed = true
+			}
+			resp = append(resp, result)
+			continue
+		}
+
+		log.G(h.Ctx).Info("- No Job tracked for pod " + string(pod.UID) + ", only cleaning up its files")
 		err = os.RemoveAll(filesPath)
+		if err != nil {
+			log.G(h.Ctx).Error(err)
+			result.Deleted = false
+			result.Error = err.Error()
+			failed = true
+		}
+		resp = append(resp, result)
 	}
 
-	w.WriteHeader(statusCode)
-	if statusCode != http.StatusOK {
-		w.Write([]byte("Some errors occurred deleting containers. Check Slurm Sidecar's logs"))
-	} else {
+	err = h.flushJIDs()
+	if err != nil {
+		log.G(h.Ctx).Warning(err)
+	}
 
-		w.Write([]byte("All containers for submitted Pods have been deleted"))
+	bodyBytes, err = json.Marshal(resp)
+	if err != nil {
+		statusCode = http.StatusInternalServerError
+		w.WriteHeader(statusCode)
+		w.Write([]byte("Some errors occurred while deleting jobs. Check Slurm Sidecar's logs"))
+		log.G(h.Ctx).Error(err)
+		return
 	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	w.Write(bodyBytes)
 }
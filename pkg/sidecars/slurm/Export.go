@@ -0,0 +1,143 @@
+package slurm
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/containerd/containerd/log"
+	"k8s.io/apimachinery/pkg/util/validation"
+
+	commonIL "github.com/intertwin-eu/interlink/pkg/common"
+)
+
+// ExportHandler streams a tar.gz archive of a pod's working directory (job script, mounted files,
+// logs and status files), so that a run can be archived or reproduced later.
+func (h *SidecarHandler) ExportHandler(w http.ResponseWriter, r *http.Request) {
+	log.G(h.Ctx).Info("Slurm Sidecar: received Export call")
+	var req commonIL.ExportStruct
+	statusCode := http.StatusOK
+
+	bodyBytes, err := io.ReadAll(r.Body)
+	if err != nil {
+		statusCode = http.StatusInternalServerError
+		w.WriteHeader(statusCode)
+		w.Write([]byte("Some errors occurred while checking export request raw message. Check Slurm Sidecar's logs"))
+		log.G(h.Ctx).Error(err)
+		return
+	}
+
+	err = json.Unmarshal(bodyBytes, &req)
+	if err != nil {
+		statusCode = http.StatusInternalServerError
+		w.WriteHeader(statusCode)
+		w.Write([]byte("Some errors occurred while unmarshalling export request. Check Slurm Sidecar's logs"))
+		log.G(h.Ctx).Error(err)
+		return
+	}
+
+	if errs := validation.IsDNS1123Label(req.Namespace); len(errs) > 0 || !podUIDRegex.MatchString(req.PodUID) {
+		statusCode = http.StatusBadRequest
+		w.WriteHeader(statusCode)
+		w.Write([]byte("Invalid namespace or UID in export request"))
+		log.G(h.Ctx).Error("invalid export request for namespace " + strconv.Quote(req.Namespace) + " and UID " + strconv.Quote(req.PodUID))
+		return
+	}
+
+	path := h.Config.DataRootFolder + req.Namespace + "-" + req.PodUID
+	if !withinDir(h.Config.DataRootFolder, path) {
+		statusCode = http.StatusBadRequest
+		w.WriteHeader(statusCode)
+		w.Write([]byte("Invalid namespace or UID in export request"))
+		log.G(h.Ctx).Error("export path " + path + " is outside of " + h.Config.DataRootFolder)
+		return
+	}
+	if _, err := os.Stat(path); err != nil {
+		statusCode = http.StatusNotFound
+		w.WriteHeader(statusCode)
+		w.Write([]byte("No working directory found for pod " + req.PodUID))
+		log.G(h.Ctx).Error(err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", "attachment; filename=\""+req.Namespace+"-"+req.PodUID+".tar.gz\"")
+	w.WriteHeader(statusCode)
+
+	err = writeTarGz(w, path, req.ExcludeSecrets)
+	if err != nil {
+		log.G(h.Ctx).Error(err)
+		return
+	}
+	log.G(h.Ctx).Info("- Exported working directory " + path)
+}
+
+// podUIDRegex matches the UIDs Kubernetes assigns to Pods.
+var podUIDRegex = regexp.MustCompile(`^[0-9a-fA-F]{8}(-[0-9a-fA-F]{4}){3}-[0-9a-fA-F]{12}$`)
+
+// withinDir reports whether path, once cleaned, is inside dir.
+func withinDir(dir string, path string) bool {
+	relPath, err := filepath.Rel(filepath.Clean(dir), filepath.Clean(path))
+	return err == nil && relPath != "." && relPath != ".." && !strings.HasPrefix(relPath, ".."+string(filepath.Separator))
+}
+
+// writeTarGz writes the content of root as a gzipped tarball to out. When excludeSecrets is set,
+// the secrets directory, the container environment files and the registry credentials are left out
+// of the archive.
+func writeTarGz(out io.Writer, root string, excludeSecrets bool) error {
+	gzipWriter := gzip.NewWriter(out)
+	defer gzipWriter.Close()
+	tarWriter := tar.NewWriter(gzipWriter)
+	defer tarWriter.Close()
+
+	return filepath.Walk(root, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		relPath, err := filepath.Rel(root, file)
+		if err != nil {
+			return err
+		}
+		if relPath == "." {
+			return nil
+		}
+		if excludeSecrets && (relPath == "secrets" || strings.HasPrefix(relPath, "secrets"+string(filepath.Separator)) || (!info.IsDir() && (strings.HasSuffix(relPath, ".env") || relPath == registryAuthFile))) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.IsDir() && !info.Mode().IsRegular() {
+			return nil
+		}
+
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(relPath)
+		err = tarWriter.WriteHeader(header)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tarWriter, f)
+		return err
+	})
+}
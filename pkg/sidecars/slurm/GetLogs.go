@@ -40,24 +40,65 @@ func (h *SidecarHandler) GetLogsHandler(w http.ResponseWriter, r *http.Request)
 
 	path := h.Config.DataRootFolder + req.Namespace + "-" + req.PodUID
 	var output []byte
+	var logPath string
 	if req.Opts.Timestamps {
 		log.G(h.Ctx).Error(errors.New("Not Implemented"))
 		statusCode = http.StatusInternalServerError
 		w.WriteHeader(statusCode)
 		return
+	} else if jid, ok := h.lookupJID(req.PodUID); ok && jid.ArrayJob {
+		// the tasks of a job array share the container files, only their own output is reliable
+		log.G(h.Ctx).Info("Reading the output of the tasks of job array " + jid.JID)
+		output, err = arrayJobLogs(path, jid)
+		if errors.Is(err, os.ErrNotExist) {
+			statusCode = http.StatusNotFound
+			w.WriteHeader(statusCode)
+			w.Write([]byte("Logs for container " + req.ContainerName + " are not available yet, the job may still be pending"))
+			log.G(h.Ctx).Info("No logs found for job array " + jid.JID)
+			return
+		} else if err != nil {
+			statusCode = http.StatusInternalServerError
+			w.WriteHeader(statusCode)
+			log.G(h.Ctx).Error(err)
+			return
+		}
+	} else if (req.Stream != "" && req.Stream != "stdout" && req.Stream != "stderr") || (req.Stream == "stderr" && h.Config.CombinedOutput) {
+		statusCode = http.StatusBadRequest
+		w.WriteHeader(statusCode)
+		w.Write([]byte("Stream " + req.Stream + " is not available, expected stdout or stderr with separate outputs"))
+		log.G(h.Ctx).Error("Unavailable log stream " + req.Stream + " requested for container " + req.ContainerName)
+		return
 	} else {
-		log.G(h.Ctx).Info("Reading  " + path + "/" + req.ContainerName + ".out")
-		output, err = os.ReadFile(path + "/" + req.ContainerName + ".out")
+		logPath = path + "/" + req.ContainerName + ".out"
+		if req.Stream == "stderr" {
+			logPath = path + "/" + req.ContainerName + ".err"
+		}
+		log.G(h.Ctx).Info("Reading  " + logPath)
+		output, err = os.ReadFile(logPath)
 		if err != nil {
 			log.G(h.Ctx).Info("Failed to read container logs, falling back to job log.")
-			output, err = os.ReadFile(path + "/" + "job.out")
-			if err != nil {
+			logPath = path + "/" + "job.out"
+			output, err = os.ReadFile(logPath)
+			if errors.Is(err, os.ErrNotExist) {
+				statusCode = http.StatusNotFound
+				w.WriteHeader(statusCode)
+				w.Write([]byte("Logs for container " + req.ContainerName + " are not available yet, the job may still be pending"))
+				log.G(h.Ctx).Info("No logs found for container " + req.ContainerName)
+				return
+			} else if err != nil {
 				statusCode = http.StatusInternalServerError
 				w.WriteHeader(statusCode)
 				return
 			}
 		}
 	}
+	// following goes on from the end of the file read, while the stderr appended below is not followed
+	followOffset := int64(len(output))
+	if req.Stream == "" && !h.Config.CombinedOutput && strings.HasSuffix(logPath, "/"+req.ContainerName+".out") {
+		if stderr, err := os.ReadFile(path + "/" + req.ContainerName + ".err"); err == nil {
+			output = append(output, stderr...)
+		}
+	}
 
 	var returnedLogs string
 
@@ -118,5 +159,87 @@ func (h *SidecarHandler) GetLogsHandler(w http.ResponseWriter, r *http.Request)
 	} else {
 		w.WriteHeader(statusCode)
 		w.Write([]byte(returnedLogs))
+		// the output of job arrays is spread over several files, which can't be followed
+		if req.Opts.Follow && logPath != "" {
+			h.followLogs(w, r, req.PodUID, logPath, path+"/"+req.ContainerName+".status", followOffset)
+		}
+	}
+}
+
+// followJobCheckInterval is how often the job of a container whose logs are followed is checked,
+// in case it ended without the container writing its .status file, e.g. because it got cancelled.
+const followJobCheckInterval = 10 * time.Second
+
+// followLogs keeps the connection open and streams whatever SLURM appends to the log file,
+// starting from offset, until the container writes its .status file, the job of the Pod ended or
+// stopped being tracked, the client disconnects or the sidecar shuts down.
+func (h *SidecarHandler) followLogs(w http.ResponseWriter, r *http.Request, podUID string, logPath string, statusPath string, offset int64) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		log.G(h.Ctx).Error("Streaming is not supported by the response writer, unable to follow logs")
+		return
+	}
+	flusher.Flush()
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	lastJobCheck := time.Now()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			log.G(h.Ctx).Debug("Client closed the connection, stop following " + logPath)
+			return
+		case <-h.Ctx.Done():
+			log.G(h.Ctx).Debug("Sidecar shutting down, stop following " + logPath)
+			return
+		case <-ticker.C:
+			_, statErr := os.Stat(statusPath)
+			finished := statErr == nil
+			if !finished && time.Since(lastJobCheck) >= followJobCheckInterval {
+				lastJobCheck = time.Now()
+				finished = h.jobEnded(podUID)
+			}
+
+			f, err := os.Open(logPath)
+			if err != nil {
+				log.G(h.Ctx).Error(err)
+				return
+			}
+			_, err = f.Seek(offset, io.SeekStart)
+			if err == nil {
+				var n int64
+				n, err = io.Copy(w, f)
+				offset += n
+				if n > 0 {
+					flusher.Flush()
+				}
+			}
+			f.Close()
+			if err != nil {
+				log.G(h.Ctx).Error(err)
+				return
+			}
+
+			if finished {
+				log.G(h.Ctx).Debug("Container finished, stop following " + logPath)
+				return
+			}
+		}
+	}
+}
+
+// jobEnded reports whether the job of the Pod stopped being tracked or squeue doesn't list it as
+// active anymore. A job squeue fails to query is considered still running.
+func (h *SidecarHandler) jobEnded(podUID string) bool {
+	jid, ok := h.lookupJID(podUID)
+	if !ok {
+		return true
+	}
+	active, err := isJobActive(jid.JID, h.Config, h.Ctx)
+	if err != nil {
+		log.G(h.Ctx).Warning("Unable to check whether Job " + jid.JID + " is still active: " + err.Error())
+		return false
 	}
+	return !active
 }
@@ -0,0 +1,127 @@
+package slurm
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"sort"
+
+	"github.com/containerd/containerd/log"
+	v1 "k8s.io/api/core/v1"
+)
+
+type JobInfo struct {
+	JobID        string `json:"JobID"`
+	JobState     string `json:"JobState"`
+	Priority     string `json:"Priority"`
+	Partition    string `json:"Partition"`
+	Reason       string `json:"Reason"`
+	SubmitTime   string `json:"SubmitTime"`
+	EligibleTime string `json:"EligibleTime"`
+	StartTime    string `json:"StartTime"`
+	// Commands holds the command each container has been launched with, by container name
+	Commands map[string]string `json:"Commands,omitempty"`
+}
+
+// JobSummary describes a Slurm job tracked by the sidecar.
+type JobSummary struct {
+	PodUID    string            `json:"PodUID"`
+	Namespace string            `json:"Namespace,omitempty"`
+	JobID     string            `json:"JobID"`
+	NodeName  string            `json:"NodeName,omitempty"`
+	Commands  map[string]string `json:"Commands,omitempty"`
+}
+
+// JobInfoHandler returns the scheduling information of the Slurm job backing a Pod, as reported by
+// scontrol, so users can see why a Pod is pending and its estimated start time.
+func (h *SidecarHandler) JobInfoHandler(w http.ResponseWriter, r *http.Request) {
+	log.G(h.Ctx).Info("Slurm Sidecar: received JobInfo call")
+	statusCode := http.StatusOK
+
+	bodyBytes, err := io.ReadAll(r.Body)
+	if err != nil {
+		statusCode = http.StatusInternalServerError
+		w.WriteHeader(statusCode)
+		w.Write([]byte("Some errors occurred while retrieving job info. Check Slurm Sidecar's logs"))
+		log.G(h.Ctx).Error(err)
+		return
+	}
+
+	var pod *v1.Pod
+	err = json.Unmarshal(bodyBytes, &pod)
+	if err != nil {
+		statusCode = http.StatusInternalServerError
+		w.WriteHeader(statusCode)
+		w.Write([]byte("Some errors occurred while retrieving job info. Check Slurm Sidecar's logs"))
+		log.G(h.Ctx).Error(err)
+		return
+	}
+
+	jid, ok := h.lookupJID(string(pod.UID))
+	if !ok {
+		statusCode = http.StatusNotFound
+		w.WriteHeader(statusCode)
+		w.Write([]byte("No Slurm job found for pod " + string(pod.UID)))
+		return
+	}
+
+	fields, err := getScontrolJob(jid.JID, h.Config, h.Ctx)
+	if err != nil {
+		statusCode = http.StatusInternalServerError
+		w.WriteHeader(statusCode)
+		w.Write([]byte("Error executing scontrol. Check Slurm Sidecar's logs"))
+		log.G(h.Ctx).Error(err)
+		return
+	}
+
+	jobInfo := JobInfo{
+		JobID:        jid.JID,
+		JobState:     fields["JobState"],
+		Priority:     fields["Priority"],
+		Partition:    fields["Partition"],
+		Reason:       fields["Reason"],
+		SubmitTime:   fields["SubmitTime"],
+		EligibleTime: fields["EligibleTime"],
+		StartTime:    fields["StartTime"],
+		Commands:     jid.Commands,
+	}
+
+	bodyBytes, err = json.Marshal(jobInfo)
+	if err != nil {
+		statusCode = http.StatusInternalServerError
+		w.WriteHeader(statusCode)
+		w.Write([]byte("Some errors occurred while retrieving job info. Check Slurm Sidecar's logs"))
+		log.G(h.Ctx).Error(err)
+		return
+	}
+	w.WriteHeader(statusCode)
+	w.Write(bodyBytes)
+}
+
+// ListJobsHandler returns all the Slurm jobs tracked by the sidecar, sorted by job ID, along with the
+// command of each of their containers.
+func (h *SidecarHandler) ListJobsHandler(w http.ResponseWriter, r *http.Request) {
+	log.G(h.Ctx).Info("Slurm Sidecar: received ListJobs call")
+	statusCode := http.StatusOK
+
+	jobs := []JobSummary{}
+	h.jidsMutex.RLock()
+	for _, jid := range *h.JIDs {
+		jobs = append(jobs, JobSummary{PodUID: jid.PodUID, Namespace: jid.Namespace, JobID: jid.JID, NodeName: jid.NodeName, Commands: cloneStringMap(jid.Commands)})
+	}
+	h.jidsMutex.RUnlock()
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].JobID < jobs[j].JobID
+	})
+
+	bodyBytes, err := json.Marshal(jobs)
+	if err != nil {
+		statusCode = http.StatusInternalServerError
+		w.WriteHeader(statusCode)
+		w.Write([]byte("Some errors occurred while listing jobs. Check Slurm Sidecar's logs"))
+		log.G(h.Ctx).Error(err)
+		return
+	}
+	w.WriteHeader(statusCode)
+	w.Write(bodyBytes)
+}
@@ -1,12 +1,14 @@
 package slurm
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
-	"regexp"
 	"strconv"
 	"strings"
 	"time"
@@ -20,13 +22,82 @@ import (
 )
 
 func (h *SidecarHandler) StatusHandler(w http.ResponseWriter, r *http.Request) {
+	log.G(h.Ctx).Info("Slurm Sidecar: received GetStatus call")
+	requestsTotal.WithLabelValues("status").Inc()
+
+	bodyBytes, err := io.ReadAll(r.Body)
+	if err != nil {
+		requestFailuresTotal.WithLabelValues("status").Inc()
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Some errors occurred while retrieving container status. Check Slurm Sidecar's logs"))
+		log.G(h.Ctx).Error(err)
+		return
+	}
+
+	if !h.Config.StatusSingleFlight {
+		h.getStatus(w, bodyBytes)
+		return
+	}
+
+	// concurrent requests for the same pods share a single execution and its response
+	key := sha256.Sum256(bodyBytes)
+	result, _, shared := h.statusGroup.Do(hex.EncodeToString(key[:]), func() (interface{}, error) {
+		recorded := &recordedResponse{header: http.Header{}}
+		h.getStatus(recorded, bodyBytes)
+		return recorded, nil
+	})
+	if shared {
+		log.G(h.Ctx).Debug("Sharing status result with a concurrent request")
+	}
+
+	recorded := result.(*recordedResponse)
+	for name, values := range recorded.header {
+		w.Header()[name] = values
+	}
+	w.WriteHeader(recorded.statusCode)
+	w.Write(recorded.body.Bytes())
+}
+
+// recordedResponse is an http.ResponseWriter keeping the response in memory, so that it can be
+// replayed to every request sharing the same status execution.
+type recordedResponse struct {
+	header     http.Header
+	statusCode int
+	body       bytes.Buffer
+}
+
+func (r *recordedResponse) Header() http.Header {
+	return r.header
+}
+
+func (r *recordedResponse) WriteHeader(statusCode int) {
+	if r.statusCode == 0 {
+		r.statusCode = statusCode
+	}
+}
+
+func (r *recordedResponse) Write(data []byte) (int, error) {
+	if r.statusCode == 0 {
+		r.statusCode = http.StatusOK
+	}
+	return r.body.Write(data)
+}
+
+// getStatus computes the status of the pods in the request body. The status of every pod is cached
+// on its own and served from the cache if it was refreshed less than statusCacheTTL ago.
+func (h *SidecarHandler) getStatus(w http.ResponseWriter, bodyBytes []byte) {
 	var req []*v1.Pod
 	var resp []commonIL.PodStatus
 	statusCode := http.StatusOK
-	log.G(h.Ctx).Info("Slurm Sidecar: received GetStatus call")
 	timeNow := time.Now()
+	var err error
+	defer func() {
+		if statusCode != http.StatusOK {
+			requestFailuresTotal.WithLabelValues("status").Inc()
+		}
+	}()
 
-	bodyBytes, err := io.ReadAll(r.Body)
+	err = json.Unmarshal(bodyBytes, &req)
 	if err != nil {
 		statusCode = http.StatusInternalServerError
 		w.WriteHeader(statusCode)
@@ -35,23 +106,67 @@ func (h *SidecarHandler) StatusHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if timeNow.Sub(timer) >= time.Second*10 {
+	h.statusMutex.Lock()
+	defer h.statusMutex.Unlock()
+	// the jobs are updated while refreshing their status, the index is written once jidsMutex is released
+	defer func() {
+		if err := h.flushJIDs(); err != nil {
+			log.G(h.Ctx).Warning(err)
+		}
+	}()
+	h.jidsMutex.Lock()
+	defer h.jidsMutex.Unlock()
 
-		err = json.Unmarshal(bodyBytes, &req)
-		if err != nil {
-			statusCode = http.StatusInternalServerError
-			w.WriteHeader(statusCode)
-			w.Write([]byte("Some errors occurred while retrieving container status. Check Slurm Sidecar's logs"))
-			log.G(h.Ctx).Error(err)
-			return
+	if h.statusCache == nil {
+		h.statusCache = make(map[string]*cachedPodStatus)
+	}
+	if h.restarting == nil {
+		h.restarting = make(map[string]bool)
+	}
+	// entries of pods whose job is not tracked anymore are dropped
+	for uid := range h.statusCache {
+		if _, ok := (*h.JIDs)[uid]; !ok {
+			delete(h.statusCache, uid)
+		}
+	}
+
+	// only the pods missing from the cache, or whose entry expired, are refreshed, so a newly
+	// submitted pod is queried right away while the others keep being rate limited
+	var stale []*v1.Pod
+	// pods without a tracked job, e.g. never submitted or lost across a restart, are reported as
+	// waiting rather than being left out of the response
+	untracked := make(map[string]commonIL.PodStatus)
+	for _, pod := range req {
+		jid, ok := (*h.JIDs)[string(pod.UID)]
+		if !ok {
+			log.G(h.Ctx).Warning("No Job tracked for pod " + pod.Name + ", reporting it as waiting")
+			untracked[string(pod.UID)] = untrackedPodStatus(pod, h.Config.DataRootFolder+pod.Namespace+"-"+string(pod.UID))
+			continue
 		}
+		h.touchJID(jid, timeNow)
+		if entry, ok := h.statusCache[string(pod.UID)]; ok && timeNow.Sub(entry.refreshed) < statusCacheTTL {
+			continue
+		}
+		stale = append(stale, pod)
+	}
+
+	if len(stale) > 0 {
 		cmd := []string{"--me"}
 		shell := exec.ExecTask{
 			Command: "squeue",
 			Args:    cmd,
 			Shell:   true,
 		}
-		execReturn, _ := shell.Execute()
+		squeueStart := time.Now()
+		execReturn, err := executeWithTimeout(h.Ctx, shell, h.Config)
+		observeCommand("squeue", squeueStart)
+		if err != nil {
+			statusCode = http.StatusGatewayTimeout
+			w.WriteHeader(statusCode)
+			w.Write([]byte("Error executing Squeue: " + err.Error()))
+			log.G(h.Ctx).Error("Unable to retrieve job status: " + err.Error())
+			return
+		}
 		execReturn.Stdout = strings.ReplaceAll(execReturn.Stdout, "\n", "")
 
 		if execReturn.Stderr != "" {
@@ -62,27 +177,112 @@ func (h *SidecarHandler) StatusHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		for _, pod := range req {
+		// a single squeue call covers the jobs of all the requested pods
+		var jids []string
+		for _, pod := range stale {
+			if jid, ok := (*h.JIDs)[string(pod.UID)]; ok {
+				jids = append(jids, jid.JID)
+			}
+		}
+		jobs, err := queryJobs(jids, h.Config, h.Ctx)
+		if err != nil {
+			// the jobs can't be told apart from the ones gone, so the last known statuses are served
+			// until squeue answers again, if every pod has one
+			log.G(h.Ctx).Error("Unable to retrieve job states from squeue: " + err.Error())
+			for _, pod := range stale {
+				if _, ok := h.statusCache[string(pod.UID)]; !ok {
+					statusCode = http.StatusGatewayTimeout
+					w.WriteHeader(statusCode)
+					w.Write([]byte("Error executing Squeue: " + err.Error()))
+					return
+				}
+			}
+			stale = nil
+		}
+		timeNow = time.Now()
+
+		for _, pod := range stale {
 			uid := string(pod.UID)
 			path := h.Config.DataRootFolder + pod.Namespace + "-" + string(pod.UID)
-
-			cmd := []string{"--noheader", "-a", "-j " + (*h.JIDs)[uid].JID}
-			shell := exec.ExecTask{
-				Command: h.Config.Squeuepath,
-				Args:    cmd,
-				Shell:   true,
+			jid, ok := (*h.JIDs)[uid]
+			if !ok {
+				// the pod has been deleted in the meantime
+				untracked[uid] = untrackedPodStatus(pod, path)
+				continue
 			}
-			execReturn, _ := shell.Execute()
-			timeNow = time.Now()
 
 			//log.G(h.Ctx).Info("Pod: " + jid.PodUID + " | JID: " + jid.JID)
 
-			if execReturn.Stderr != "" {
-				log.G(h.Ctx).Error("ERR: ", execReturn.Stderr)
+			job, listed := jobs[jid.JID]
+			match := job.State
+			h.setJobNodeName(jid, job.NodeList)
+			if _, err := os.Stat(path); os.IsNotExist(err) {
+				log.G(h.Ctx).Warning("Working directory " + path + " of Job " + jid.JID + " is missing")
+				containerStatuses := lostContainerStatuses(pod, path, jid, listed, h.Config, h.Ctx)
+				h.statusCache[uid] = &cachedPodStatus{status: newPodStatus(pod, jid, containerStatuses), refreshed: timeNow}
+				continue
+			}
+			if !listed && jid.ArrayJob {
+				// the outcome of a job array is aggregated from its tasks by sacct, rather than read from
+				// the .status files they share
+				log.G(h.Ctx).Info("Job array " + jid.JID + " is not listed by squeue anymore, reading its tasks from sacct")
+				listed = true
+			}
+			if !listed {
+				log.G(h.Ctx).Info("Job " + jid.JID + " is not listed by squeue anymore, reading its status files")
 				containerStatuses := []v1.ContainerStatus{}
+
+				// the .status files aren't read before the job actually finished, the job is checked
+				// again on the next refresh rather than waiting for it while holding the locks
+				if state, _ := getSacctState(jid.JID, h.Config, h.Ctx); state == "COMPLETING" {
+					log.G(h.Ctx).Info("Job " + jid.JID + " is still completing, not reading status files yet")
+					for _, ct := range pod.Spec.Containers {
+						if !jid.submitted(ct.Name) {
+							containerStatuses = append(containerStatuses, unsubmittedContainerStatus(ct, jid))
+							continue
+						}
+						containerStart, _ := h.updateContainerTimes(path, ct.Name, jid)
+						containerStatuses = append(containerStatuses, v1.ContainerStatus{Name: ct.Name, State: v1.ContainerState{Running: &v1.ContainerStateRunning{StartedAt: metav1.Time{Time: containerStart}}}, Ready: false})
+					}
+					h.statusCache[uid] = &cachedPodStatus{status: newPodStatus(pod, jid, containerStatuses), refreshed: timeNow}
+					continue
+				}
+
 				for _, ct := range pod.Spec.Containers {
+					if !jid.submitted(ct.Name) {
+						containerStatuses = append(containerStatuses, unsubmittedContainerStatus(ct, jid))
+						continue
+					}
 					log.G(h.Ctx).Info("Getting exit status from  " + path + "/" + ct.Name + ".status")
 					file, err := os.Open(path + "/" + ct.Name + ".status")
+					if os.IsNotExist(err) {
+						sacctInfo, sacctErr := getSacctInfo(jid.JID, h.Config, h.Ctx)
+						if sacctErr == nil && !finishedJobStates[sacctInfo.State] {
+							// sacct reports 0:0 for the jobs which didn't end, e.g. squeue lost track of them
+							// for a moment, so the container is reported by the state of the job instead
+							log.G(h.Ctx).Info("Status file of container " + ct.Name + " is missing while sacct reports Job " + jid.JID + " as " + sacctInfo.State)
+							containerStart, _ := h.updateContainerTimes(path, ct.Name, jid)
+							state := v1.ContainerState{Running: &v1.ContainerStateRunning{StartedAt: metav1.Time{Time: containerStart}}}
+							if sacctInfo.State == "PENDING" || sacctInfo.State == "REQUEUED" {
+								state = v1.ContainerState{Waiting: &v1.ContainerStateWaiting{Reason: "ContainerCreating", Message: "Slurm job " + jid.JID + " is " + sacctInfo.State}}
+							}
+							containerStatuses = append(containerStatuses, v1.ContainerStatus{Name: ct.Name, State: state, Ready: false})
+							continue
+						}
+						if sacctErr == nil {
+							log.G(h.Ctx).Info("Status file of container " + ct.Name + " is missing, using sacct exit code")
+							containerStart, containerEnd := h.updateContainerTimes(path, ct.Name, jid)
+							if containerEnd.IsZero() {
+								containerEnd = sacctInfo.End
+							}
+							reason, message := exitCodeReason(sacctInfo.ExitCode)
+							if sacctInfo.OOM {
+								reason, message = "OOMKilled", "Slurm job "+jid.JID+" exceeded its memory limit"
+							}
+							containerStatuses = append(containerStatuses, v1.ContainerStatus{Name: ct.Name, State: v1.ContainerState{Terminated: &v1.ContainerStateTerminated{ExitCode: sacctInfo.ExitCode, Reason: reason, Message: message, StartedAt: metav1.Time{Time: containerStart}, FinishedAt: metav1.Time{Time: containerEnd}}}, Ready: false})
+							continue
+						}
+					}
 					if err != nil {
 						statusCode = http.StatusInternalServerError
 						w.WriteHeader(statusCode)
@@ -100,13 +300,23 @@ func (h *SidecarHandler) StatusHandler(w http.ResponseWriter, r *http.Request) {
 						return
 					}
 
-					status, err := strconv.Atoi(strings.Replace(string(statusb), "\n", "", -1))
-					if err != nil {
-						statusCode = http.StatusInternalServerError
-						w.WriteHeader(statusCode)
-						w.Write([]byte("Error converting container status.. Check Slurm Sidecar's logs"))
-						log.G(h.Ctx).Error(fmt.Errorf("unable to convert container status: %s", err))
-						status = 500
+					status, reason, message, finished := parseExitStatus(string(statusb))
+					containerStart, containerEnd := h.updateContainerTimes(path, ct.Name, jid)
+					if !finished {
+						log.G(h.Ctx).Info("Status file of container " + ct.Name + " is still empty, assuming it is running")
+						containerStatuses = append(
+							containerStatuses,
+							v1.ContainerStatus{
+								Name: ct.Name,
+								State: v1.ContainerState{
+									Running: &v1.ContainerStateRunning{
+										StartedAt: metav1.Time{Time: containerStart},
+									},
+								},
+								Ready: true,
+							},
+						)
+						continue
 					}
 
 					containerStatuses = append(
@@ -115,7 +325,11 @@ func (h *SidecarHandler) StatusHandler(w http.ResponseWriter, r *http.Request) {
 							Name: ct.Name,
 							State: v1.ContainerState{
 								Terminated: &v1.ContainerStateTerminated{
-									ExitCode: int32(status),
+									ExitCode:   status,
+									Reason:     reason,
+									Message:    message,
+									StartedAt:  metav1.Time{Time: containerStart},
+									FinishedAt: metav1.Time{Time: containerEnd},
 								},
 							},
 							Ready: false,
@@ -124,134 +338,68 @@ func (h *SidecarHandler) StatusHandler(w http.ResponseWriter, r *http.Request) {
 
 				}
 
-				resp = append(resp, commonIL.PodStatus{PodName: pod.Name, PodUID: string(pod.UID), PodNamespace: pod.Namespace, Containers: containerStatuses})
+				h.statusCache[uid] = &cachedPodStatus{status: newPodStatus(pod, jid, containerStatuses), refreshed: timeNow}
 			} else {
-				pattern := `(CD|CG|F|PD|PR|R|S|ST)`
-				re := regexp.MustCompile(pattern)
-				match := re.FindString(execReturn.Stdout)
-
-				log.G(h.Ctx).Info("JID: " + (*h.JIDs)[uid].JID + " | Status: " + match + " | Pod: " + pod.Name + " | UID: " + string(pod.UID))
-
-				switch match {
-				case "CD":
-					if (*h.JIDs)[uid].EndTime.IsZero() {
-						(*h.JIDs)[uid].EndTime = timeNow
-						f, err := os.Create(path + "/FinishedAt.time")
-						if err != nil {
-							statusCode = http.StatusInternalServerError
-							w.WriteHeader(statusCode)
-							w.Write([]byte("Error writing end timestamp... Check Slurm Sidecar's logs"))
-							log.G(h.Ctx).Error(err)
-							return
-						}
-						f.WriteString((*h.JIDs)[uid].EndTime.Format("2006-01-02 15:04:05.999999999 -0700 MST"))
-					}
-					containerStatus := v1.ContainerStatus{Name: pod.Spec.Containers[0].Name, State: v1.ContainerState{Terminated: &v1.ContainerStateTerminated{StartedAt: metav1.Time{Time: (*h.JIDs)[uid].StartTime}, FinishedAt: metav1.Time{Time: (*h.JIDs)[uid].EndTime}}}, Ready: false}
-					resp = append(resp, commonIL.PodStatus{PodName: pod.Name, PodUID: string(pod.UID), PodNamespace: pod.Namespace, Containers: []v1.ContainerStatus{containerStatus}})
-				case "CG":
-					if (*h.JIDs)[uid].StartTime.IsZero() {
-						(*h.JIDs)[uid].StartTime = timeNow
-						f, err := os.Create(path + "/StartedAt.time")
-						if err != nil {
-							statusCode = http.StatusInternalServerError
-							w.WriteHeader(statusCode)
-							w.Write([]byte("Error writing start timestamp... Check Slurm Sidecar's logs"))
-							log.G(h.Ctx).Error(err)
-							return
-						}
-						f.WriteString((*h.JIDs)[uid].StartTime.Format("2006-01-02 15:04:05.999999999 -0700 MST"))
-					}
-					containerStatus := v1.ContainerStatus{Name: pod.Spec.Containers[0].Name, State: v1.ContainerState{Running: &v1.ContainerStateRunning{StartedAt: metav1.Time{Time: (*h.JIDs)[uid].StartTime}}}, Ready: true}
-					resp = append(resp, commonIL.PodStatus{PodName: pod.Name, PodUID: string(pod.UID), PodNamespace: pod.Namespace, Containers: []v1.ContainerStatus{containerStatus}})
-				case "F":
-					if (*h.JIDs)[uid].EndTime.IsZero() {
-						(*h.JIDs)[uid].EndTime = timeNow
-						f, err := os.Create(path + "/FinishedAt.time")
-						if err != nil {
-							statusCode = http.StatusInternalServerError
-							w.WriteHeader(statusCode)
-							w.Write([]byte("Error writing end timestamp... Check Slurm Sidecar's logs"))
-							log.G(h.Ctx).Error(err)
-							return
-						}
-						f.WriteString((*h.JIDs)[uid].EndTime.Format("2006-01-02 15:04:05.999999999 -0700 MST"))
-					}
-					containerStatus := v1.ContainerStatus{Name: pod.Spec.Containers[0].Name, State: v1.ContainerState{Terminated: &v1.ContainerStateTerminated{StartedAt: metav1.Time{Time: (*h.JIDs)[uid].StartTime}, FinishedAt: metav1.Time{Time: (*h.JIDs)[uid].EndTime}}}, Ready: false}
-					resp = append(resp, commonIL.PodStatus{PodName: pod.Name, PodUID: string(pod.UID), PodNamespace: pod.Namespace, Containers: []v1.ContainerStatus{containerStatus}})
-				case "PD":
-					containerStatus := v1.ContainerStatus{Name: pod.Spec.Containers[0].Name, State: v1.ContainerState{Waiting: &v1.ContainerStateWaiting{}}, Ready: false}
-					resp = append(resp, commonIL.PodStatus{PodName: pod.Name, PodUID: string(pod.UID), PodNamespace: pod.Namespace, Containers: []v1.ContainerStatus{containerStatus}})
-				case "PR":
-					if (*h.JIDs)[uid].EndTime.IsZero() {
-						(*h.JIDs)[uid].EndTime = timeNow
-						f, err := os.Create(path + "/FinishedAt.time")
-						if err != nil {
-							statusCode = http.StatusInternalServerError
-							w.WriteHeader(statusCode)
-							w.Write([]byte("Error writing end timestamp... Check Slurm Sidecar's logs"))
-							log.G(h.Ctx).Error(err)
-							return
-						}
-						f.WriteString((*h.JIDs)[uid].EndTime.Format("2006-01-02 15:04:05.999999999 -0700 MST"))
-					}
-					containerStatus := v1.ContainerStatus{Name: pod.Spec.Containers[0].Name, State: v1.ContainerState{Terminated: &v1.ContainerStateTerminated{StartedAt: metav1.Time{Time: (*h.JIDs)[uid].StartTime}, FinishedAt: metav1.Time{Time: (*h.JIDs)[uid].EndTime}}}, Ready: false}
-					resp = append(resp, commonIL.PodStatus{PodName: pod.Name, PodUID: string(pod.UID), PodNamespace: pod.Namespace, Containers: []v1.ContainerStatus{containerStatus}})
-				case "R":
-					if (*h.JIDs)[uid].StartTime.IsZero() {
-						(*h.JIDs)[uid].StartTime = timeNow
-						f, err := os.Create(path + "/StartedAt.time")
-						if err != nil {
-							statusCode = http.StatusInternalServerError
-							w.WriteHeader(statusCode)
-							w.Write([]byte("Error writing start timestamp... Check Slurm Sidecar's logs"))
-							log.G(h.Ctx).Error(err)
-							return
-						}
-						f.WriteString((*h.JIDs)[uid].StartTime.Format("2006-01-02 15:04:05.999999999 -0700 MST"))
-					}
-					containerStatus := v1.ContainerStatus{Name: pod.Spec.Containers[0].Name, State: v1.ContainerState{Running: &v1.ContainerStateRunning{StartedAt: metav1.Time{Time: (*h.JIDs)[uid].StartTime}}}, Ready: true}
-					resp = append(resp, commonIL.PodStatus{PodName: pod.Name, PodUID: string(pod.UID), PodNamespace: pod.Namespace, Containers: []v1.ContainerStatus{containerStatus}})
-				case "S":
-					containerStatus := v1.ContainerStatus{Name: pod.Spec.Containers[0].Name, State: v1.ContainerState{Waiting: &v1.ContainerStateWaiting{}}, Ready: false}
-					resp = append(resp, commonIL.PodStatus{PodName: pod.Name, PodUID: string(pod.UID), PodNamespace: pod.Namespace, Containers: []v1.ContainerStatus{containerStatus}})
-				case "ST":
-					if (*h.JIDs)[uid].EndTime.IsZero() {
-						(*h.JIDs)[uid].EndTime = timeNow
-						f, err := os.Create(path + "/FinishedAt.time")
-						if err != nil {
-							statusCode = http.StatusInternalServerError
-							w.WriteHeader(statusCode)
-							w.Write([]byte("Error writing end timestamp... Check Slurm Sidecar's logs"))
-							log.G(h.Ctx).Error(err)
-							return
-						}
-						f.WriteString((*h.JIDs)[uid].EndTime.Format("2006-01-02 15:04:05.999999999 -0700 MST"))
-					}
-					containerStatus := v1.ContainerStatus{Name: pod.Spec.Containers[0].Name, State: v1.ContainerState{Terminated: &v1.ContainerStateTerminated{StartedAt: metav1.Time{Time: (*h.JIDs)[uid].StartTime}, FinishedAt: metav1.Time{Time: (*h.JIDs)[uid].EndTime}}}, Ready: false}
-					resp = append(resp, commonIL.PodStatus{PodName: pod.Name, PodUID: string(pod.UID), PodNamespace: pod.Namespace, Containers: []v1.ContainerStatus{containerStatus}})
-				default:
-					if (*h.JIDs)[uid].EndTime.IsZero() {
-						(*h.JIDs)[uid].EndTime = timeNow
-						f, err := os.Create(path + "/FinishedAt.time")
-						if err != nil {
-							statusCode = http.StatusInternalServerError
-							w.WriteHeader(statusCode)
-							w.Write([]byte("Error writing end timestamp... Check Slurm Sidecar's logs"))
-							log.G(h.Ctx).Error(err)
-							return
-						}
-						f.WriteString((*h.JIDs)[uid].EndTime.Format("2006-01-02 15:04:05.999999999 -0700 MST"))
+				log.G(h.Ctx).Info("JID: " + jid.JID + " | Status: " + match + " | Pod: " + pod.Name + " | UID: " + string(pod.UID))
+
+				podStatus, err := h.jobPodStatus(pod, path, job, timeNow)
+				if err != nil {
+					statusCode = http.StatusInternalServerError
+					w.WriteHeader(statusCode)
+					w.Write([]byte("Error writing job timestamps... Check Slurm Sidecar's logs"))
+					log.G(h.Ctx).Error(err)
+					return
+				}
+				h.statusCache[uid] = &cachedPodStatus{status: podStatus, refreshed: timeNow}
+			}
+		}
+		for _, pod := range stale {
+			uid := string(pod.UID)
+			entry, cached := h.statusCache[uid]
+			jid, tracked := (*h.JIDs)[uid]
+			if !cached || !tracked {
+				continue
+			}
+			if !h.restarting[uid] {
+				if !restartable(pod, jid, entry.status, h.Config) {
+					continue
+				}
+				// sbatch is called in the background, the Pod is reported as restarting meanwhile
+				h.restarting[uid] = true
+				go h.restartJob(pod, jid.JID)
+			}
+			containerStatuses := waitingContainerStatuses(pod, jid, "Restarting", "Slurm job "+jid.JID+" failed and is being resubmitted")
+			for i := range containerStatuses {
+				for _, previous := range entry.status.Containers {
+					if previous.Name == containerStatuses[i].Name {
+						containerStatuses[i].LastTerminationState = previous.State
 					}
-					containerStatus := v1.ContainerStatus{Name: pod.Spec.Containers[0].Name, State: v1.ContainerState{Terminated: &v1.ContainerStateTerminated{StartedAt: metav1.Time{Time: (*h.JIDs)[uid].StartTime}, FinishedAt: metav1.Time{Time: (*h.JIDs)[uid].EndTime}}}, Ready: false}
-					resp = append(resp, commonIL.PodStatus{PodName: pod.Name, PodUID: string(pod.UID), PodNamespace: pod.Namespace, Containers: []v1.ContainerStatus{containerStatus}})
 				}
 			}
+			h.statusCache[uid] = &cachedPodStatus{status: newPodStatus(pod, jid, containerStatuses), refreshed: timeNow}
+		}
+		for _, pod := range stale {
+			entry, cached := h.statusCache[string(pod.UID)]
+			jid, tracked := (*h.JIDs)[string(pod.UID)]
+			if cached && tracked {
+				h.attachEfficiency(&entry.status, jid)
+			}
+		}
+
+		err = h.saveStatusCache()
+		if err != nil {
+			log.G(h.Ctx).Warning("Unable to persist status cache: " + err.Error())
 		}
-		cachedStatus = resp
-		timer = time.Now()
 	} else {
 		log.G(h.Ctx).Debug("Cached status")
-		resp = cachedStatus
+	}
+
+	for _, pod := range req {
+		if entry, ok := h.statusCache[string(pod.UID)]; ok {
+			resp = append(resp, entry.status)
+		} else if status, ok := untracked[string(pod.UID)]; ok {
+			resp = append(resp, status)
+		}
 	}
 
 	log.G(h.Ctx).Debug(resp)
@@ -270,3 +418,98 @@ func (h *SidecarHandler) StatusHandler(w http.ResponseWriter, r *http.Request) {
 		w.Write(bodyBytes)
 	}
 }
+
+// jobPodStatus builds the status of a Pod from the compact squeue state of its job, along with the
+// reason it is pending, if any. An empty state means squeue doesn't know the job anymore, in which
+// case sacct is queried for its exit code. It must be called with jidsMutex held.
+func (h *SidecarHandler) jobPodStatus(pod *v1.Pod, path string, job squeueJob, timeNow time.Time) (commonIL.PodStatus, error) {
+	jid, ok := (*h.JIDs)[string(pod.UID)]
+	if !ok {
+		return untrackedPodStatus(pod, path), nil
+	}
+	var containerStatuses []v1.ContainerStatus
+	state := job.State
+
+	switch state {
+	case "CG", "R":
+		err := h.setJobStartTime(jid, path, timeNow)
+		if err != nil {
+			return commonIL.PodStatus{}, err
+		}
+		containerStatuses = h.runningContainerStatuses(pod, filterAnnotations(pod.Annotations, h.Config, h.Ctx), path, jid)
+	case "PD":
+		reason, message := pendingReason(job.Reason)
+		containerStatuses = waitingContainerStatuses(pod, jid, reason, message)
+	case "S":
+		containerStatuses = waitingContainerStatuses(pod, jid, "", "")
+	case "RD", "RH":
+		containerStatuses = waitingContainerStatuses(pod, jid, "JobHeld", getHoldReason(jid.JID, h.Config, h.Ctx))
+	case "CA":
+		// the job was cancelled outside of the sidecar, e.g. by an admin through scancel
+		log.G(h.Ctx).Info("Job " + jid.JID + " has been cancelled")
+		err := h.setJobEndTime(jid, path, timeNow)
+		if err != nil {
+			return commonIL.PodStatus{}, err
+		}
+		containerStatuses = h.terminatedContainerStatuses(pod, path, jid, cancelledExitCode, "Cancelled")
+	case "OOM":
+		log.G(h.Ctx).Info("Job " + jid.JID + " has been killed for exceeding its memory")
+		err := h.setJobEndTime(jid, path, timeNow)
+		if err != nil {
+			return commonIL.PodStatus{}, err
+		}
+		containerStatuses = h.terminatedContainerStatuses(pod, path, jid, oomKilledExitCode, "OOMKilled")
+	case "":
+		var fallbackExitCode int32
+		fallbackReason := ""
+		sacctInfo, err := getSacctInfo(jid.JID, h.Config, h.Ctx)
+		if err != nil {
+			log.G(h.Ctx).Warning("Job " + jid.JID + " not found neither in squeue nor in sacct")
+		} else {
+			log.G(h.Ctx).Info("JID: " + jid.JID + " | sacct State: " + sacctInfo.State + " | ExitCode: " + strconv.Itoa(int(sacctInfo.ExitCode)))
+			fallbackExitCode = sacctInfo.ExitCode
+			h.setJobNodeName(jid, sacctInfo.NodeList)
+			if sacctInfo.OOM {
+				fallbackReason = "OOMKilled"
+			} else if strings.HasPrefix(sacctInfo.State, "TIMEOUT") {
+				fallbackReason = "DeadlineExceeded"
+				if fallbackExitCode == 0 {
+					fallbackExitCode = cancelledExitCode
+				}
+			} else if strings.HasPrefix(sacctInfo.State, "CANCELLED") {
+				fallbackReason = "Cancelled"
+				if fallbackExitCode == 0 {
+					fallbackExitCode = cancelledExitCode
+				}
+			}
+			if jid.StartTime.IsZero() && !sacctInfo.Start.IsZero() {
+				jid.StartTime = sacctInfo.Start
+				h.markJIDsDirty()
+			}
+			if !sacctInfo.End.IsZero() {
+				timeNow = sacctInfo.End
+			}
+		}
+		err = h.setJobEndTime(jid, path, timeNow)
+		if err != nil {
+			return commonIL.PodStatus{}, err
+		}
+		containerStatuses = h.terminatedContainerStatuses(pod, path, jid, fallbackExitCode, fallbackReason)
+	case "CD":
+		err := h.setJobEndTime(jid, path, timeNow)
+		if err != nil {
+			return commonIL.PodStatus{}, err
+		}
+		containerStatuses = h.terminatedContainerStatuses(pod, path, jid, 0, "")
+	default:
+		// the job failed, containers which didn't report their exit code can't be considered successful
+		log.G(h.Ctx).Info("Job " + jid.JID + " ended in state " + state)
+		err := h.setJobEndTime(jid, path, timeNow)
+		if err != nil {
+			return commonIL.PodStatus{}, err
+		}
+		containerStatuses = h.terminatedContainerStatuses(pod, path, jid, unknownExitCode, jobFailureReason(state))
+	}
+
+	return newPodStatus(pod, jid, containerStatuses), nil
+}
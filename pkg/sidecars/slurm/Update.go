@@ -0,0 +1,66 @@
+package slurm
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+
+	"github.com/containerd/containerd/log"
+
+	commonIL "github.com/intertwin-eu/interlink/pkg/common"
+)
+
+// UpdateHandler rewrites the ConfigMap and Secret files of already submitted Pods with the values
+// received, so that long-running jobs on a shared filesystem eventually see the updates, as Pods do.
+func (h *SidecarHandler) UpdateHandler(w http.ResponseWriter, r *http.Request) {
+	log.G(h.Ctx).Info("Slurm Sidecar: received Update call")
+	statusCode := http.StatusOK
+
+	bodyBytes, err := io.ReadAll(r.Body)
+	if err != nil {
+		statusCode = http.StatusInternalServerError
+		w.WriteHeader(statusCode)
+		w.Write([]byte("Some errors occurred while updating containers. Check Slurm Sidecar's logs"))
+		log.G(h.Ctx).Error(err)
+		return
+	}
+
+	var req []commonIL.RetrievedPodData
+	err = json.Unmarshal(bodyBytes, &req)
+	if err != nil {
+		statusCode = http.StatusInternalServerError
+		w.WriteHeader(statusCode)
+		w.Write([]byte("Some errors occurred while updating containers. Check Slurm Sidecar's logs"))
+		log.G(h.Ctx).Error(err)
+		return
+	}
+
+	if os.Getenv("SHARED_FS") != "true" {
+		// without a shared filesystem the files are written by the job script itself
+		log.G(h.Ctx).Warning("Shared FS disabled, ConfigMaps and Secrets can't be updated after the submission")
+		w.WriteHeader(statusCode)
+		w.Write([]byte("Nothing to update"))
+		return
+	}
+
+	for _, data := range req {
+		if _, ok := h.lookupJID(string(data.Pod.UID)); !ok {
+			log.G(h.Ctx).Warning("No Job tracked for pod " + data.Pod.Name + ", skipping the update of its ConfigMaps and Secrets")
+			continue
+		}
+		filesPath := h.Config.DataRootFolder + data.Pod.Namespace + "-" + string(data.Pod.UID)
+		err = refreshMountedData(filesPath, data, h.Ctx)
+		if err != nil {
+			statusCode = http.StatusInternalServerError
+			log.G(h.Ctx).Error("Unable to update the ConfigMaps and Secrets of pod " + data.Pod.Name + ": " + err.Error())
+		}
+	}
+
+	w.WriteHeader(statusCode)
+	if statusCode != http.StatusOK {
+		w.Write([]byte("Some errors occurred while updating containers. Check Slurm Sidecar's logs"))
+	} else {
+		w.Write([]byte("Containers updated"))
+	}
+}
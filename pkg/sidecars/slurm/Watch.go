@@ -0,0 +1,152 @@
+package slurm
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/containerd/containerd/log"
+	v1 "k8s.io/api/core/v1"
+
+	commonIL "github.com/intertwin-eu/interlink/pkg/common"
+)
+
+// WatchHandler keeps the connection open and streams a newline-delimited JSON PodStatus every time
+// the squeue state of the job of one of the requested Pods changes. The first status of every Pod is
+// always sent. squeue is polled every config.WatchInterval seconds (2 by default), until the client
+// goes away, and the refreshes it fails on are skipped.
+func (h *SidecarHandler) WatchHandler(w http.ResponseWriter, r *http.Request) {
+	log.G(h.Ctx).Info("Slurm Sidecar: received Watch call")
+	statusCode := http.StatusOK
+
+	bodyBytes, err := io.ReadAll(r.Body)
+	if err != nil {
+		statusCode = http.StatusInternalServerError
+		w.WriteHeader(statusCode)
+		w.Write([]byte("Some errors occurred while watching container status. Check Slurm Sidecar's logs"))
+		log.G(h.Ctx).Error(err)
+		return
+	}
+
+	var req []*v1.Pod
+	err = json.Unmarshal(bodyBytes, &req)
+	if err != nil {
+		statusCode = http.StatusBadRequest
+		w.WriteHeader(statusCode)
+		w.Write([]byte("Some errors occurred while watching container status. Check Slurm Sidecar's logs"))
+		log.G(h.Ctx).Error(err)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		statusCode = http.StatusInternalServerError
+		w.WriteHeader(statusCode)
+		w.Write([]byte("Streaming is not supported. Check Slurm Sidecar's logs"))
+		log.G(h.Ctx).Error("the response writer doesn't support flushing")
+		return
+	}
+
+	interval := time.Duration(h.Config.WatchInterval) * time.Second
+	if interval <= 0 {
+		interval = 2 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(statusCode)
+	flusher.Flush()
+
+	encoder := json.NewEncoder(w)
+	lastStates := make(map[string]string)
+	for {
+		// the statuses are written once the locks are released, so a slow client doesn't block
+		// the other requests
+		changes, err := h.stateChanges(req, lastStates)
+		if err != nil {
+			log.G(h.Ctx).Warning("Unable to retrieve job states from squeue, skipping this refresh: " + err.Error())
+		}
+		for _, change := range changes {
+			err = encoder.Encode(change.status)
+			if err != nil {
+				log.G(h.Ctx).Info("Stopping watch: " + err.Error())
+				return
+			}
+			lastStates[change.jid] = change.state
+		}
+		flusher.Flush()
+
+		select {
+		case <-r.Context().Done():
+			log.G(h.Ctx).Info("Watch client disconnected")
+			return
+		case <-h.Ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// stateChange is the status of a Pod whose job changed state, to be sent to the watch client.
+type stateChange struct {
+	jid    string
+	state  string
+	status commonIL.PodStatus
+}
+
+// stateChanges returns the status of the Pods whose job state differs from the one stored in
+// lastStates, keyed by job ID. squeue is queried once for all the jobs, and an error is returned
+// if it fails, rather than reporting the jobs as gone.
+func (h *SidecarHandler) stateChanges(pods []*v1.Pod, lastStates map[string]string) ([]stateChange, error) {
+	var jids []string
+	h.jidsMutex.RLock()
+	for _, pod := range pods {
+		if jid, ok := (*h.JIDs)[string(pod.UID)]; ok {
+			jids = append(jids, jid.JID)
+		}
+	}
+	h.jidsMutex.RUnlock()
+	jobs, err := queryJobs(jids, h.Config, h.Ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	h.statusMutex.Lock()
+	defer h.statusMutex.Unlock()
+	defer func() {
+		if err := h.flushJIDs(); err != nil {
+			log.G(h.Ctx).Warning(err)
+		}
+	}()
+	h.jidsMutex.Lock()
+	defer h.jidsMutex.Unlock()
+
+	var changes []stateChange
+	timeNow := time.Now()
+	for _, pod := range pods {
+		jid, ok := (*h.JIDs)[string(pod.UID)]
+		if !ok {
+			continue
+		}
+		h.touchJID(jid, timeNow)
+
+		job := jobs[jid.JID]
+		state := job.State
+		h.setJobNodeName(jid, job.NodeList)
+		if lastState, seen := lastStates[jid.JID]; seen && lastState == state {
+			continue
+		}
+
+		path := h.Config.DataRootFolder + pod.Namespace + "-" + string(pod.UID)
+		podStatus, err := h.jobPodStatus(pod, path, job, timeNow)
+		if err != nil {
+			log.G(h.Ctx).Error(err)
+			continue
+		}
+		log.G(h.Ctx).Debug("JID: " + jid.JID + " | Status changed to: " + state + " | Pod: " + pod.Name)
+		changes = append(changes, stateChange{jid: jid.JID, state: state, status: podStatus})
+	}
+	return changes, nil
+}
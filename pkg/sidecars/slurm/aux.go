@@ -2,18 +2,33 @@ package slurm
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
+	"expvar"
+	"fmt"
+	"net"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"reflect"
 	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
+	"unicode"
 
 	exec2 "github.com/alexellis/go-execute/pkg/v1"
 	"github.com/containerd/containerd/log"
+	"golang.org/x/sync/singleflight"
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 
 	commonIL "github.com/intertwin-eu/interlink/pkg/common"
 )
@@ -22,27 +37,174 @@ type SidecarHandler struct {
 	Config commonIL.InterLinkConfig
 	JIDs   *map[string]*JidStruct
 	Ctx    context.Context
+
+	// jidsMutex guards JIDs and the jobs it holds, which are shared by all the handlers
+	jidsMutex sync.RWMutex
+	// jidsDirty tracks whether JIDs changed since the jids.json index was last written, guarded by
+	// jidsDirtyMutex
+	jidsDirty      bool
+	jidsDirtyMutex sync.Mutex
+	// saveMutex serializes the writes of the JIDs index, so an older copy never overwrites a newer one
+	saveMutex   sync.Mutex
+	statusMutex sync.Mutex
+	statusCache map[string]*cachedPodStatus
+	// restarting holds the UIDs of the pods whose job is being resubmitted, guarded by statusMutex
+	restarting  map[string]bool
+	statusGroup singleflight.Group
+}
+
+// statusCacheTTL is how long the status of a pod is served from the cache before querying squeue again.
+const statusCacheTTL = 10 * time.Second
+
+// cachedPodStatus is the last status computed for a pod, keyed by UID in the status cache.
+type cachedPodStatus struct {
+	status    commonIL.PodStatus
+	refreshed time.Time
 }
 
-var prefix string
-var timer time.Time
-var cachedStatus []commonIL.PodStatus
+const jidsIndexFile = "jids.json"
 
 type JidStruct struct {
-	PodUID    string    `json:"PodUID"`
-	JID       string    `json:"JID"`
+	PodUID         string                     `json:"PodUID"`
+	JID            string                     `json:"JID"`
+	StartTime      time.Time                  `json:"StartTime"`
+	EndTime        time.Time                  `json:"EndTime"`
+	Containers     map[string]*ContainerTimes `json:"Containers"`
+	SpecHash       string                     `json:"SpecHash"`
+	NodeName       string                     `json:"NodeName,omitempty"`
+	Namespace      string                     `json:"Namespace,omitempty"`
+	Labels         map[string]string          `json:"Labels,omitempty"`
+	ContainerNames []string                   `json:"ContainerNames,omitempty"`
+	Efficiency     map[string]string          `json:"Efficiency,omitempty"`
+	Commands       map[string]string          `json:"Commands,omitempty"`
+	SubmittedAt    time.Time                  `json:"SubmittedAt,omitempty"`
+	HostIP         string                     `json:"HostIP,omitempty"`
+	ArrayJob       bool                       `json:"ArrayJob,omitempty"`
+	ArrayTask      string                     `json:"ArrayTask,omitempty"`
+	Restarts       int                        `json:"Restarts,omitempty"`
+	// LastSeen is the last time the status of the Pod has been requested, within lastSeenResolution
+	LastSeen time.Time `json:"LastSeen,omitempty"`
+	// CancelAt is when the job of a Pod deleted with a stop signal is cancelled, once its grace
+	// period expired, and CleanupPath the path removed right after
+	CancelAt    time.Time `json:"CancelAt,omitempty"`
+	CleanupPath string    `json:"CleanupPath,omitempty"`
+}
+
+// submitted reports whether the container is part of the job, i.e. it was declared in the Pod
+// spec at submission time. Jobs tracked before ContainerNames was recorded run all of them.
+func (jid *JidStruct) submitted(containerName string) bool {
+	if len(jid.ContainerNames) == 0 {
+		return true
+	}
+	for _, name := range jid.ContainerNames {
+		if name == containerName {
+			return true
+		}
+	}
+	return false
+}
+
+// clone returns a deep copy of the job, which can be serialized while the original keeps being updated.
+func (jid *JidStruct) clone() *JidStruct {
+	jidCopy := *jid
+	if jid.Containers != nil {
+		jidCopy.Containers = make(map[string]*ContainerTimes, len(jid.Containers))
+		for name, times := range jid.Containers {
+			timesCopy := *times
+			jidCopy.Containers[name] = &timesCopy
+		}
+	}
+	jidCopy.Labels = cloneStringMap(jid.Labels)
+	jidCopy.Efficiency = cloneStringMap(jid.Efficiency)
+	jidCopy.Commands = cloneStringMap(jid.Commands)
+	jidCopy.ContainerNames = append([]string(nil), jid.ContainerNames...)
+	return &jidCopy
+}
+
+// lookupJID returns a copy of the job tracked for the pod, which can be read without holding jidsMutex.
+func (h *SidecarHandler) lookupJID(podUID string) (*JidStruct, bool) {
+	h.jidsMutex.RLock()
+	defer h.jidsMutex.RUnlock()
+	jid, ok := (*h.JIDs)[podUID]
+	if !ok {
+		return nil, false
+	}
+	return jid.clone(), true
+}
+
+func cloneStringMap(m map[string]string) map[string]string {
+	if m == nil {
+		return nil
+	}
+	mapCopy := make(map[string]string, len(m))
+	for k, v := range m {
+		mapCopy[k] = v
+	}
+	return mapCopy
+}
+
+// unsubmittedContainerStatus is reported for the containers which were added to the Pod spec after
+// the job was submitted, so that there is always a status per declared container.
+func unsubmittedContainerStatus(ct v1.Container, jid *JidStruct) v1.ContainerStatus {
+	return v1.ContainerStatus{
+		Name:  ct.Name,
+		State: v1.ContainerState{Waiting: &v1.ContainerStateWaiting{Reason: "ContainerStatusUnknown", Message: "container " + ct.Name + " is not part of Slurm job " + jid.JID}},
+		Ready: false,
+	}
+}
+
+type ContainerTimes struct {
 	StartTime time.Time `json:"StartTime"`
 	EndTime   time.Time `json:"EndTime"`
+	ImagePull string    `json:"ImagePull,omitempty"`
 }
 
+// Image pull states recorded for the containers whose image has to be fetched from a registry.
+const (
+	imagePullPending    = "pending"
+	imagePullPulling    = "pulling"
+	imagePullExtracting = "extracting"
+	imagePullDone       = "done"
+)
+
 type SingularityCommand struct {
-	containerName string
-	command       []string
+	containerName   string
+	isInitContainer bool
+	command         []string
+	imagePull       string
+}
+
+// describeCommand renders the command a container has been launched with. The values of the
+// environment variables passed on the command line are redacted, since they may come from Secrets.
+func describeCommand(command []string) string {
+	var args []string
+	for i := 0; i < len(command); i++ {
+		if command[i] == "" {
+			continue
+		}
+		args = append(args, command[i])
+		if (command[i] == "--env" || command[i] == "-e") && i+1 < len(command) {
+			i++
+			// the podman flags are quoted as a whole, e.g. 'NAME=value'
+			name := strings.TrimPrefix(strings.SplitN(command[i], "=", 2)[0], "'")
+			args = append(args, name+"=<redacted>")
+		}
+	}
+	return strings.Join(args, " ")
+}
+
+// recordCommands stores the command of every container in the JID store, so that it can be looked
+// up without reading the job script.
+func (h *SidecarHandler) recordCommands(jid *JidStruct, commands []SingularityCommand) {
+	jid.Commands = make(map[string]string)
+	for _, command := range commands {
+		jid.Commands[command.containerName] = describeCommand(command.command)
+	}
+	h.markJIDsDirty()
 }
 
 func parsingTimeFromString(stringTime string, Ctx context.Context) (time.Time, error) {
 	parsedTime := time.Time{}
-	timestampFormat := "2006-01-02 15:04:05.999999999 -0700 MST"
 	parts := strings.Fields(stringTime)
 	if len(parts) != 4 {
 		err := errors.New("invalid timestamp format")
@@ -72,7 +234,394 @@ func CreateDirectories(config commonIL.InterLinkConfig) error {
 	return nil
 }
 
+// markJIDsDirty flags the JIDs map as changed, so that the next flushJIDs call persists it.
+func (h *SidecarHandler) markJIDsDirty() {
+	h.jidsDirtyMutex.Lock()
+	defer h.jidsDirtyMutex.Unlock()
+	h.jidsDirty = true
+}
+
+// SaveJIDs serializes the whole JIDs map to the jids.json index under DataRootFolder. The index
+// is first written to a temporary file and then renamed, so a crash never leaves it truncated.
+func SaveJIDs(config commonIL.InterLinkConfig, JIDs *map[string]*JidStruct, Ctx context.Context) error {
+	trackedJobs.Set(float64(len(*JIDs)))
+	jidsBytes, err := json.Marshal(JIDs)
+	if err != nil {
+		log.G(Ctx).Error(err)
+		return err
+	}
+
+	indexPath := filepath.Join(config.DataRootFolder, jidsIndexFile)
+	err = os.WriteFile(indexPath+".tmp", jidsBytes, 0644)
+	if err != nil {
+		log.G(Ctx).Error(err)
+		return err
+	}
+	err = os.Rename(indexPath+".tmp", indexPath)
+	if err != nil {
+		log.G(Ctx).Error(err)
+		return err
+	}
+	log.G(Ctx).Debug("Saved JIDs index to " + indexPath)
+	return nil
+}
+
+// flushJIDs writes the JIDs index to disk if the map changed since the last save. The index is
+// serialized from a copy taken under jidsMutex, so it must not be held by the caller.
+func (h *SidecarHandler) flushJIDs() error {
+	h.saveMutex.Lock()
+	defer h.saveMutex.Unlock()
+
+	h.jidsMutex.RLock()
+	h.jidsDirtyMutex.Lock()
+	dirty := h.jidsDirty
+	h.jidsDirty = false
+	h.jidsDirtyMutex.Unlock()
+	var snapshot map[string]*JidStruct
+	if dirty {
+		snapshot = make(map[string]*JidStruct, len(*h.JIDs))
+		for uid, jid := range *h.JIDs {
+			snapshot[uid] = jid.clone()
+		}
+	}
+	h.jidsMutex.RUnlock()
+	if !dirty {
+		return nil
+	}
+
+	err := SaveJIDs(h.Config, &snapshot, h.Ctx)
+	if err != nil {
+		h.markJIDsDirty()
+		return err
+	}
+	return nil
+}
+
+// LoadJIDs restores the JIDs map from the jids.json index. If the index doesn't exist yet, the
+// legacy per-pod files are scanned instead and the index is created from them.
 func LoadJIDs(config commonIL.InterLinkConfig, JIDs *map[string]*JidStruct, Ctx context.Context) error {
+	jidsBytes, err := os.ReadFile(filepath.Join(config.DataRootFolder, jidsIndexFile))
+	if err == nil {
+		err = json.Unmarshal(jidsBytes, JIDs)
+		if err == nil {
+			log.G(Ctx).Info("Loaded " + strconv.Itoa(len(*JIDs)) + " JIDs from index")
+			trackedJobs.Set(float64(len(*JIDs)))
+			return nil
+		}
+		log.G(Ctx).Warning("Unable to parse JIDs index, falling back to the per-pod files: " + err.Error())
+	} else if !os.IsNotExist(err) {
+		log.G(Ctx).Warning("Unable to read JIDs index, falling back to the per-pod files: " + err.Error())
+	}
+
+	err = loadLegacyJIDs(config, JIDs, Ctx)
+	if err != nil {
+		return err
+	}
+	return SaveJIDs(config, JIDs, Ctx)
+}
+
+// statusCacheFile is the file, relative to DataRootFolder, where the last status snapshot is persisted.
+const statusCacheFile = "status.json"
+
+type statusSnapshot struct {
+	SavedAt time.Time            `json:"savedAt"`
+	Pods    []commonIL.PodStatus `json:"pods"`
+}
+
+// saveStatusCache persists the cached status to disk, so that it can be served right after a restart.
+// It does nothing unless config.StatusCacheRetention is set.
+func (h *SidecarHandler) saveStatusCache() error {
+	if h.Config.StatusCacheRetention == "" {
+		return nil
+	}
+	snapshot := statusSnapshot{SavedAt: time.Now()}
+	for _, entry := range h.statusCache {
+		snapshot.Pods = append(snapshot.Pods, entry.status)
+	}
+	snapshotBytes, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	snapshotPath := filepath.Join(h.Config.DataRootFolder, statusCacheFile)
+	err = os.WriteFile(snapshotPath+".tmp", snapshotBytes, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(snapshotPath+".tmp", snapshotPath)
+}
+
+// LoadStatusCache restores the status snapshot saved before a restart, if it is younger than
+// config.StatusCacheRetention. The snapshot is served for the usual cache window, sparing the Slurm
+// controller from a squeue call per pod as soon as the sidecar comes back. Pods whose job is no longer
+// tracked are dropped from it, so it must be called after LoadJIDs and ApplyStartupPolicy.
+func (h *SidecarHandler) LoadStatusCache() error {
+	if h.Config.StatusCacheRetention == "" {
+		return nil
+	}
+	retention, err := time.ParseDuration(h.Config.StatusCacheRetention)
+	if err != nil {
+		return err
+	}
+
+	snapshotBytes, err := os.ReadFile(filepath.Join(h.Config.DataRootFolder, statusCacheFile))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var snapshot statusSnapshot
+	err = json.Unmarshal(snapshotBytes, &snapshot)
+	if err != nil {
+		return err
+	}
+	if time.Since(snapshot.SavedAt) > retention {
+		log.G(h.Ctx).Info("Status snapshot saved at " + snapshot.SavedAt.String() + " is older than " + retention.String() + ", ignoring it")
+		return nil
+	}
+
+	h.statusMutex.Lock()
+	defer h.statusMutex.Unlock()
+	h.statusCache = make(map[string]*cachedPodStatus)
+	h.jidsMutex.RLock()
+	for _, podStatus := range snapshot.Pods {
+		if _, ok := (*h.JIDs)[podStatus.PodUID]; ok {
+			h.statusCache[podStatus.PodUID] = &cachedPodStatus{status: podStatus, refreshed: time.Now()}
+		}
+	}
+	h.jidsMutex.RUnlock()
+	log.G(h.Ctx).Info("Loaded status of " + strconv.Itoa(len(h.statusCache)) + " pods from snapshot saved at " + snapshot.SavedAt.String())
+	return nil
+}
+
+// isJobActive reports whether squeue still lists the job in a state other than the finished ones.
+// A job squeue doesn't know anymore, e.g. because the controller purged it, is not active, while any
+// other squeue failure is returned.
+func isJobActive(jid string, config commonIL.InterLinkConfig, Ctx context.Context) (bool, error) {
+	output, err := commandOutput(Ctx, config, config.Squeuepath, "--noheader", "-j", jid, "-o", "%T")
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && strings.Contains(strings.ToLower(string(exitErr.Stderr)), "invalid job id") {
+			return false, nil
+		}
+		if errors.As(err, &exitErr) && len(exitErr.Stderr) > 0 {
+			err = errors.New(strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return false, err
+	}
+	state := strings.TrimSpace(string(output))
+	return state != "" && !finishedJobStates[state], nil
+}
+
+// ApplyStartupPolicy decides what to do with the jobs found still active after a sidecar restart,
+// according to config.StartupJobPolicy: "reattach" (default) keeps tracking them, "requeue" puts
+// them back in the queue through scontrol and "fail" cancels them.
+func ApplyStartupPolicy(config commonIL.InterLinkConfig, JIDs *map[string]*JidStruct, Ctx context.Context) error {
+	policy := config.StartupJobPolicy
+	if policy == "" {
+		policy = "reattach"
+	}
+
+	switch policy {
+	case "reattach":
+		log.G(Ctx).Info("Reattaching to " + strconv.Itoa(len(*JIDs)) + " loaded jobs")
+		return nil
+	case "requeue", "fail":
+	default:
+		return errors.New("unknown StartupJobPolicy " + policy + ", expected reattach, requeue or fail")
+	}
+
+	for podUID, jid := range *JIDs {
+		active, err := isJobActive(jid.JID, config, Ctx)
+		if err != nil {
+			return errors.New("unable to query job " + jid.JID + " of pod " + podUID + ": " + err.Error())
+		}
+		if !active {
+			continue
+		}
+		if policy == "requeue" {
+			log.G(Ctx).Info("Requeueing job " + jid.JID + " of pod " + podUID)
+			execReturn, err := executeWithTimeout(Ctx, exec2.ExecTask{Command: scontrolPath(config), Args: []string{"requeue", jid.JID}}, config)
+			if err == nil && execReturn.ExitCode != 0 {
+				err = errors.New(strings.TrimSpace(execReturn.Stderr))
+			}
+			if err != nil {
+				log.G(Ctx).Error("Unable to requeue job " + jid.JID + ": " + err.Error())
+			}
+		} else {
+			log.G(Ctx).Info("Cancelling job " + jid.JID + " of pod " + podUID)
+			err := cancelJob(jid.JID, config, Ctx)
+			if err != nil {
+				log.G(Ctx).Error("Unable to cancel job " + jid.JID + ": " + err.Error())
+			}
+		}
+	}
+	return nil
+}
+
+// finishedJobStates are the sacct states of the jobs which won't run anymore.
+var finishedJobStates = map[string]bool{
+	"BOOT_FAIL":     true,
+	"CANCELLED":     true,
+	"COMPLETED":     true,
+	"DEADLINE":      true,
+	"FAILED":        true,
+	"NODE_FAIL":     true,
+	"OUT_OF_MEMORY": true,
+	"PREEMPTED":     true,
+	"TIMEOUT":       true,
+}
+
+// pruneInterval is how often the jobs tracked by the sidecar are checked for pruning.
+const pruneInterval = time.Hour
+
+// lastSeenResolution is how often the time a Pod status has been last requested is updated, so that
+// the JIDs index isn't written at every status request.
+const lastSeenResolution = 10 * time.Minute
+
+// touchJID records that the status of the Pod of a job has been requested. It must be called with
+// jidsMutex held.
+func (h *SidecarHandler) touchJID(jid *JidStruct, now time.Time) {
+	if now.Sub(jid.LastSeen) >= lastSeenResolution {
+		jid.LastSeen = now
+		h.markJIDsDirty()
+	}
+}
+
+// PruneFinishedJobs starts pruning, every pruneInterval until h.Ctx is done, the jobs which ended
+// longer than config.FinishedJobRetention ago and whose Pod status hasn't been requested for as long,
+// along with their working directory. They are left behind by Pods deleted while the sidecar was down,
+// since the status of the existing ones, completed included, keeps being requested by the virtual
+// kubelet. Jobs sacct has forgotten about are pruned according to their recorded end time, if any.
+// It does nothing unless config.FinishedJobRetention is set.
+func (h *SidecarHandler) PruneFinishedJobs() error {
+	if h.Config.FinishedJobRetention == "" {
+		return nil
+	}
+	retention, err := time.ParseDuration(h.Config.FinishedJobRetention)
+	if err != nil {
+		return err
+	}
+
+	// the jobs loaded from an index written before the status requests were recorded count as seen
+	// at startup
+	startedAt := time.Now()
+	go func() {
+		for {
+			h.pruneFinishedJobs(retention, startedAt)
+			select {
+			case <-h.Ctx.Done():
+				return
+			case <-time.After(pruneInterval):
+			}
+		}
+	}()
+	return nil
+}
+
+// pruneFinishedJobs runs a single pruning pass. sacct is run without holding jidsMutex.
+func (h *SidecarHandler) pruneFinishedJobs(retention time.Duration, startedAt time.Time) {
+	unseen := func(jid *JidStruct) bool {
+		lastSeen := jid.LastSeen
+		if lastSeen.IsZero() {
+			lastSeen = startedAt
+		}
+		return jid.CancelAt.IsZero() && time.Since(lastSeen) >= retention
+	}
+
+	candidates := make(map[string]*JidStruct)
+	h.jidsMutex.RLock()
+	for podUID, jid := range *h.JIDs {
+		if unseen(jid) {
+			candidates[podUID] = jid.clone()
+		}
+	}
+	h.jidsMutex.RUnlock()
+
+	pruned := 0
+	for podUID, jid := range candidates {
+		endTime := jid.EndTime
+		sacctInfo, err := getSacctInfo(jid.JID, h.Config, h.Ctx)
+		if err == nil {
+			if !finishedJobStates[sacctInfo.State] {
+				continue
+			}
+			if !sacctInfo.End.IsZero() {
+				endTime = sacctInfo.End
+			}
+		}
+		if endTime.IsZero() || time.Since(endTime) < retention {
+			continue
+		}
+
+		h.jidsMutex.Lock()
+		tracked, ok := (*h.JIDs)[podUID]
+		if !ok || tracked.JID != jid.JID || !unseen(tracked) {
+			// the Pod has been deleted, resubmitted or requested in the meantime
+			h.jidsMutex.Unlock()
+			continue
+		}
+		h.removeJID(podUID)
+		h.jidsMutex.Unlock()
+		pruned++
+
+		path := jobWorkingDir(h.Config, podUID, jid)
+		if path == "" {
+			log.G(h.Ctx).Info("Job " + jid.JID + " of pod " + podUID + " ended at " + endTime.String() + ", its working directory is already gone")
+			continue
+		}
+		log.G(h.Ctx).Info("Job " + jid.JID + " of pod " + podUID + " ended at " + endTime.String() + ", removing " + path)
+		err = os.RemoveAll(path)
+		if err != nil {
+			log.G(h.Ctx).Error("Unable to remove the working directory of pod " + podUID + ": " + err.Error())
+			continue
+		}
+		removePodLinks(h.Config, path)
+	}
+	log.G(h.Ctx).Info("Pruned " + strconv.Itoa(pruned) + " finished jobs")
+	if err := h.flushJIDs(); err != nil {
+		log.G(h.Ctx).Warning(err)
+	}
+}
+
+// jobWorkingDir returns the existing working directory of a tracked job, or an empty string if it is
+// gone. The jobs loaded from the legacy per-pod files have no namespace, their directory is the one
+// they are keyed by or, failing that, the only one ending with their UID.
+func jobWorkingDir(config commonIL.InterLinkConfig, podUID string, jid *JidStruct) string {
+	var candidates []string
+	if jid.Namespace != "" {
+		candidates = append(candidates, filepath.Join(config.DataRootFolder, jid.Namespace+"-"+podUID))
+	} else {
+		candidates = append(candidates, filepath.Join(config.DataRootFolder, podUID))
+		if matches, err := filepath.Glob(filepath.Join(config.DataRootFolder, "*-"+podUID)); err == nil && len(matches) == 1 {
+			candidates = append(candidates, matches[0])
+		}
+	}
+	for _, candidate := range candidates {
+		if info, err := os.Stat(candidate); err == nil && info.IsDir() {
+			return candidate
+		}
+	}
+	return ""
+}
+
+// removePodLinks removes the stable by-name links pointing to the given working directory.
+func removePodLinks(config commonIL.InterLinkConfig, path string) {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return
+	}
+	filepath.WalkDir(filepath.Join(config.DataRootFolder, podLinksDir), func(link string, entry os.DirEntry, err error) error {
+		if err != nil || entry.Type()&os.ModeSymlink == 0 {
+			return nil
+		}
+		if target, err := os.Readlink(link); err == nil && target == absPath {
+			os.Remove(link)
+		}
+		return nil
+	})
+}
+
+func loadLegacyJIDs(config commonIL.InterLinkConfig, JIDs *map[string]*JidStruct, Ctx context.Context) error {
 	path := config.DataRootFolder
 
 	dir, err := os.Open(path)
@@ -89,7 +638,7 @@ func LoadJIDs(config commonIL.InterLinkConfig, JIDs *map[string]*JidStruct, Ctx
 	}
 
 	for _, entry := range entries {
-		if entry.IsDir() {
+		if entry.IsDir() && entry.Name() != podLinksDir && entry.Name() != imageCacheDir {
 			podUID := entry.Name()
 			StartedAt := time.Time{}
 			FinishedAt := time.Time{}
@@ -118,7 +667,11 @@ func LoadJIDs(config commonIL.InterLinkConfig, JIDs *map[string]*JidStruct, Ctx
 					log.G(Ctx).Debug(err)
 				}
 			}
-			JIDEntry := JidStruct{PodUID: podUID, JID: string(JID), StartTime: StartedAt, EndTime: FinishedAt}
+			SpecHash, err := os.ReadFile(path + entry.Name() + "/" + "SpecHash.sha")
+			if err != nil {
+				log.G(Ctx).Debug(err)
+			}
+			JIDEntry := JidStruct{PodUID: podUID, JID: string(JID), StartTime: StartedAt, EndTime: FinishedAt, SpecHash: string(SpecHash)}
 			(*JIDs)[podUID] = &JIDEntry
 		}
 	}
@@ -126,128 +679,617 @@ func LoadJIDs(config commonIL.InterLinkConfig, JIDs *map[string]*JidStruct, Ctx
 	return nil
 }
 
-func prepareEnvs(container v1.Container, Ctx context.Context) []string {
-	if len(container.Env) > 0 {
-		log.G(Ctx).Info("-- Appending envs")
-		env := make([]string, 1)
-		env = append(env, "--env")
-		env_data := ""
-		for _, env_var := range container.Env {
-			tmp := (env_var.Name + "=" + env_var.Value + ",")
-			env_data += tmp
+// filterAnnotations drops every vk.io annotation which is not listed in config.AllowedAnnotations,
+// so tenants can't influence the job script through annotations the operators didn't allow.
+// An empty allowlist keeps every annotation, preserving the previous permissive behaviour. Allowing an
+// annotation also allows its per-container variants, e.g. slurm-job.vk.io/image-root.<containerName>.
+func filterAnnotations(annotations map[string]string, config commonIL.InterLinkConfig, Ctx context.Context) map[string]string {
+	if len(config.AllowedAnnotations) == 0 {
+		return annotations
+	}
+
+	filtered := make(map[string]string)
+	for key, value := range annotations {
+		if !strings.Contains(strings.SplitN(key, "/", 2)[0], "vk.io") {
+			filtered[key] = value
+			continue
 		}
-		if last := len(env_data) - 1; last >= 0 && env_data[last] == ',' {
-			env_data = env_data[:last]
+		allowed := false
+		for _, allowedAnnotation := range config.AllowedAnnotations {
+			if key == allowedAnnotation || strings.HasPrefix(key, allowedAnnotation+".") {
+				allowed = true
+				break
+			}
 		}
-		if env_data == "" {
-			env = []string{}
+		if allowed {
+			filtered[key] = value
+		} else {
+			log.G(Ctx).Warning("- Annotation " + key + " is not allowed by the sidecar configuration, ignoring it")
 		}
-		env = append(env, env_data)
+	}
+	return filtered
+}
 
-		return env
-	} else {
-		return []string{}
+// runtimeCommand returns the base command used to run a container with the configured runtime.
+// Singularity is the default; apptainer accepts the very same flags, while podman needs the GPU
+// and home directory options to be translated to their equivalents.
+// An empty homeBind leaves the home directory to the runtime defaults.
+func runtimeCommand(config commonIL.InterLinkConfig, homeBind string) []string {
+	var command []string
+	homeFlag := "-H"
+	switch config.ContainerRuntime {
+	case "apptainer":
+		command = []string{"apptainer", "exec", "--writable-tmpfs", "--nv"}
+	case "podman":
+		command = []string{"podman", "run", "--rm", "--device", "nvidia.com/gpu=all"}
+		homeFlag = "-v"
+	default:
+		command = []string{"singularity", "exec", "--writable-tmpfs", "--nv"}
+	}
+	if homeBind != "" {
+		command = append(command, homeFlag, homeBind)
 	}
+	return command
 }
 
-func prepareMounts(
-	workingPath string,
-	container v1.Container,
-	data []commonIL.RetrievedPodData,
-	config commonIL.InterLinkConfig,
-	Ctx context.Context,
-) ([]string, error) {
-	log.G(Ctx).Info("-- Preparing mountpoints for " + container.Name)
-	mount := make([]string, 1)
-	mount = append(mount, "--bind")
-	mountedData := ""
+// scratchArgs returns the runtime flags binding the per-job scratch directory in the container and
+// exporting it as SCRATCH and TMPDIR, if config.ScratchBaseDir is set. The variable is expanded when
+// the job runs.
+func scratchArgs(config commonIL.InterLinkConfig) []string {
+	if config.ScratchBaseDir == "" {
+		return nil
+	}
+	if config.ContainerRuntime == "podman" {
+		return []string{"-v", "\"$SCRATCH:$SCRATCH\"", "-e", "SCRATCH=\"$SCRATCH\"", "-e", "TMPDIR=\"$SCRATCH\""}
+	}
+	return []string{"--bind", "\"$SCRATCH\"", "--env", "SCRATCH=\"$SCRATCH\"", "--env", "TMPDIR=\"$SCRATCH\""}
+}
 
-	for _, podData := range data {
-		err := os.MkdirAll(workingPath, os.ModePerm)
-		if err != nil {
-			log.G(Ctx).Error(err)
-			return nil, err
-		} else {
-			log.G(Ctx).Info("-- Created directory " + workingPath)
-		}
+// defaultHomeTemplate binds a directory named after the Pod UID, below DataRootFolder in the user
+// home, as the container home directory.
+const defaultHomeTemplate = "${HOME}/{DataRoot}{UID}:${HOME}"
 
-		for _, cont := range podData.Containers {
-			for _, cfgMap := range cont.ConfigMaps {
-				if container.Name == cont.Name {
-					configMapsPaths, envs, err := mountData(workingPath, container, podData.Pod, cfgMap, config, Ctx)
-					if err != nil {
-						log.G(Ctx).Error(err)
-						return nil, err
-					}
+// homeBind renders config.SingularityHomeTemplate, or defaultHomeTemplate if not set, replacing the
+// {DataRoot}, {UID}, {Namespace} and {PodName} placeholders. An empty template disables the bind.
+func homeBind(config commonIL.InterLinkConfig, pod v1.Pod) string {
+	template := defaultHomeTemplate
+	if config.SingularityHomeTemplate != nil {
+		template = *config.SingularityHomeTemplate
+	}
+	return strings.NewReplacer(
+		"{DataRoot}", config.DataRootFolder,
+		"{UID}", string(pod.UID),
+		"{Namespace}", pod.Namespace,
+		"{PodName}", pod.Name,
+	).Replace(template)
+}
 
-					for i, path := range configMapsPaths {
-						if os.Getenv("SHARED_FS") != "true" {
-							dirs := strings.Split(path, ":")
-							splitDirs := strings.Split(dirs[0], "/")
-							dir := filepath.Join(splitDirs[:len(splitDirs)-1]...)
-							prefix += "\nmkdir -p " + dir + " && touch " + dirs[0] + " && echo $" + envs[i] + " > " + dirs[0]
-						}
-						mountedData += path
-					}
+// podmanMounts converts the singularity style --bind argument, which accepts a comma separated
+// list, to the podman -v flags which take a single value each.
+func podmanMounts(mounts []string) []string {
+	var converted []string
+	for i := 0; i < len(mounts); i++ {
+		if mounts[i] == "--bind" && i+1 < len(mounts) {
+			for _, value := range strings.Split(mounts[i+1], ",") {
+				if value != "" {
+					converted = append(converted, "-v", value)
 				}
 			}
+			i++
+		} else if mounts[i] != "" {
+			converted = append(converted, mounts[i])
+		}
+	}
+	return converted
+}
 
-			for _, secret := range cont.Secrets {
-				if container.Name == cont.Name {
-					secretsPaths, envs, err := mountData(workingPath, container, podData.Pod, secret, config, Ctx)
-					if err != nil {
-						log.G(Ctx).Error(err)
-						return nil, err
-					}
-					for i, path := range secretsPaths {
-						if os.Getenv("SHARED_FS") != "true" {
-							dirs := strings.Split(path, ":")
-							splitDirs := strings.Split(dirs[0], "/")
-							dir := filepath.Join(splitDirs[:len(splitDirs)-1]...)
-							prefix += "\nmkdir -p " + dir + " && touch " + dirs[0] + " && echo $" + envs[i] + " > " + dirs[0]
-						}
-						mountedData += path
-					}
-				}
-			}
+// shellQuote wraps a value in single quotes, so that the shell takes it literally, newlines included.
+func shellQuote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+}
 
-			for _, emptyDir := range cont.EmptyDirs {
-				if container.Name == cont.Name {
-					paths, _, err := mountData(workingPath, container, podData.Pod, emptyDir, config, Ctx)
-					if err != nil {
-						log.G(Ctx).Error(err)
-						return nil, err
-					}
-					for _, path := range paths {
-						mountedData += path
-					}
-				}
+// envNameMatches reports whether an environment variable name matches one of the patterns, which may
+// use the shell wildcards, e.g. AWS_*.
+func envNameMatches(name string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := filepath.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// prepareEnvs builds the environment flags from the container environment, merged with config.DefaultEnv.
+// Variables declared by the container win over the defaults with the same name, and variables with an
+// empty value are left out when config.SkipEmptyEnv is set. The container variables must match
+// config.EnvAllowlist, if set, and must not match config.EnvDenylist, while config.InjectedEnv is always
+// set, overriding the container. Values are never joined in a comma
+// separated --env list, which would break on commas and newlines: singularity and apptainer read them
+// from a <container>.env file written in workingPath, while podman gets a quoted --env flag per variable.
+func prepareEnvs(workingPath string, container v1.Container, config commonIL.InterLinkConfig, Ctx context.Context) ([]string, error) {
+	var defaultNames []string
+	for name := range config.DefaultEnv {
+		defaultNames = append(defaultNames, name)
+	}
+	sort.Strings(defaultNames)
+
+	envVars := []v1.EnvVar{}
+	for _, name := range defaultNames {
+		overridden := false
+		for _, env_var := range container.Env {
+			if env_var.Name == name {
+				overridden = true
+				break
 			}
 		}
+		if _, injected := config.InjectedEnv[name]; injected {
+			overridden = true
+		}
+		if !overridden && (config.DefaultEnv[name] != "" || !config.SkipEmptyEnv) {
+			envVars = append(envVars, v1.EnvVar{Name: name, Value: config.DefaultEnv[name]})
+		}
+	}
+	for _, env_var := range container.Env {
+		// by default empty values are passed as NAME=, which is not the same as leaving NAME unset
+		if env_var.Value == "" && config.SkipEmptyEnv {
+			log.G(Ctx).Debug("-- Skipping env " + env_var.Name + " with an empty value")
+			continue
+		}
+		if len(config.EnvAllowlist) > 0 && !envNameMatches(env_var.Name, config.EnvAllowlist) {
+			log.G(Ctx).Debug("-- Dropping env " + env_var.Name + " missing from the allowlist")
+			continue
+		}
+		if envNameMatches(env_var.Name, config.EnvDenylist) {
+			log.G(Ctx).Debug("-- Dropping denylisted env " + env_var.Name)
+			continue
+		}
+		if _, injected := config.InjectedEnv[env_var.Name]; injected {
+			continue
+		}
+		envVars = append(envVars, env_var)
 	}
 
-	//path_hardcoded := ("/cvmfs/grid.cern.ch/etc/grid-security:/etc/grid-security" + "," +
-	//	"/cvmfs:/cvmfs" + ",")
-	//mount_data += path_hardcoded
-	if last := len(mountedData) - 1; last >= 0 && mountedData[last] == ',' {
-		mountedData = mountedData[:last]
+	var injectedNames []string
+	for name := range config.InjectedEnv {
+		injectedNames = append(injectedNames, name)
 	}
-	if len(mountedData) == 0 {
+	sort.Strings(injectedNames)
+	for _, name := range injectedNames {
+		envVars = append(envVars, v1.EnvVar{Name: name, Value: config.InjectedEnv[name]})
+	}
+
+	if len(envVars) == 0 {
 		return []string{}, nil
 	}
-	return append(mount, mountedData), nil
-}
+	log.G(Ctx).Info("-- Appending envs")
 
-func produceSLURMScript(
-	path string,
-	podNamespace string,
+	if config.ContainerRuntime == "podman" {
+		var env []string
+		for _, env_var := range envVars {
+			env = append(env, "--env", shellQuote(env_var.Name+"="+env_var.Value))
+		}
+		return env, nil
+	}
+
+	env_data := ""
+	for _, env_var := range envVars {
+		env_data += env_var.Name + "=" + shellQuote(env_var.Value) + "\n"
+	}
+	err := os.MkdirAll(workingPath, os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+	envFile := workingPath + "/" + container.Name + ".env"
+	err = os.WriteFile(envFile, []byte(env_data), 0600)
+	if err != nil {
+		return nil, err
+	}
+	return []string{"--env-file", envFile}, nil
+}
+
+// registryAuthFile is the docker-style auth file, in the working directory, built from the
+// image pull Secrets of a Pod.
+const registryAuthFile = "registry-auth.json"
+
+// registryCredentialsFile holds the registry usernames and passwords as exported shell variables,
+// sourced by the job script, so that they never show up in it while still reaching the wrappers
+// run by srun for multi-prog steps.
+const registryCredentialsFile = "registry-credentials.env"
+
+// prepareRegistryAuth merges the registry credentials of the kubernetes.io/dockerconfigjson and
+// kubernetes.io/dockercfg Secrets into a single auth file, which is passed to the container runtime
+// through --authfile. They are also written to registryCredentialsFile, as the REGISTRY_USERNAME_<n>
+// and REGISTRY_PASSWORD_<n> variables, for the runtimes reading them from the environment, and the
+// index n of every registry host is returned. An empty path is returned if none of the Secrets holds
+// registry credentials.
+func prepareRegistryAuth(workingPath string, secrets []v1.Secret, Ctx context.Context) (string, map[string]int, error) {
+	auths := make(map[string]json.RawMessage)
+	for _, secret := range secrets {
+		var secretAuths map[string]json.RawMessage
+		switch secret.Type {
+		case v1.SecretTypeDockerConfigJson:
+			var dockerConfig struct {
+				Auths map[string]json.RawMessage `json:"auths"`
+			}
+			err := json.Unmarshal(secret.Data[v1.DockerConfigJsonKey], &dockerConfig)
+			if err != nil {
+				return "", nil, errors.New("invalid " + v1.DockerConfigJsonKey + " in Secret " + secret.Name + ": " + err.Error())
+			}
+			secretAuths = dockerConfig.Auths
+		case v1.SecretTypeDockercfg:
+			// the legacy format is the content of the auths field alone
+			err := json.Unmarshal(secret.Data[v1.DockerConfigKey], &secretAuths)
+			if err != nil {
+				return "", nil, errors.New("invalid " + v1.DockerConfigKey + " in Secret " + secret.Name + ": " + err.Error())
+			}
+		default:
+			log.G(Ctx).Warning("-- Image pull Secret " + secret.Name + " of type " + string(secret.Type) + " holds no registry credentials, ignoring it")
+			continue
+		}
+		for registry, auth := range secretAuths {
+			// as for the kubelet, the first Secret listed wins
+			if _, ok := auths[registry]; !ok {
+				auths[registry] = auth
+			}
+		}
+	}
+	if len(auths) == 0 {
+		return "", nil, nil
+	}
+
+	authData, err := json.Marshal(map[string]interface{}{"auths": auths})
+	if err != nil {
+		return "", nil, err
+	}
+	err = os.MkdirAll(workingPath, os.ModePerm)
+	if err != nil {
+		return "", nil, err
+	}
+	authFile := workingPath + "/" + registryAuthFile
+	err = os.WriteFile(authFile, authData, 0600)
+	if err != nil {
+		return "", nil, err
+	}
+	log.G(Ctx).Info("-- Written registry credentials of " + strconv.Itoa(len(auths)) + " registries to " + authFile)
+
+	var registries []string
+	for registry := range auths {
+		registries = append(registries, registry)
+	}
+	sort.Strings(registries)
+	hosts := make(map[string]int)
+	credentials := ""
+	for _, registry := range registries {
+		host := normalizeRegistry(registry)
+		if _, ok := hosts[host]; ok {
+			continue
+		}
+		username, password, err := parseRegistryAuth(auths[registry])
+		if err != nil {
+			return "", nil, errors.New("invalid credentials of registry " + registry + ": " + err.Error())
+		}
+		n := strconv.Itoa(len(hosts))
+		hosts[host] = len(hosts)
+		credentials += "export REGISTRY_USERNAME_" + n + "=" + shellQuote(username) + "\n" +
+			"export REGISTRY_PASSWORD_" + n + "=" + shellQuote(password) + "\n"
+	}
+	err = os.WriteFile(workingPath+"/"+registryCredentialsFile, []byte(credentials), 0600)
+	if err != nil {
+		return "", nil, err
+	}
+	return authFile, hosts, nil
+}
+
+// parseRegistryAuth extracts the username and password of a registry entry of a docker config, either
+// from its base64 encoded auth field or from its username and password fields.
+func parseRegistryAuth(entry json.RawMessage) (string, string, error) {
+	var auth struct {
+		Auth     string `json:"auth"`
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+	err := json.Unmarshal(entry, &auth)
+	if err != nil {
+		return "", "", err
+	}
+	if auth.Auth == "" {
+		return auth.Username, auth.Password, nil
+	}
+	decoded, err := base64.StdEncoding.DecodeString(auth.Auth)
+	if err != nil {
+		return "", "", err
+	}
+	username, password, ok := strings.Cut(string(decoded), ":")
+	if !ok {
+		return "", "", errors.New("the auth field is not in the username:password form")
+	}
+	return username, password, nil
+}
+
+// normalizeRegistry reduces a registry key of a docker config, which may be a URL, to the registry host,
+// the Docker Hub being always docker.io.
+func normalizeRegistry(registry string) string {
+	if _, host, ok := strings.Cut(registry, "://"); ok {
+		registry = host
+	}
+	registry, _, _ = strings.Cut(registry, "/")
+	switch registry {
+	case "index.docker.io", "registry-1.docker.io", "registry.hub.docker.com":
+		return "docker.io"
+	}
+	return registry
+}
+
+// registryHost returns the host of the registry an image is pulled from, or an empty string for the
+// images which don't come from a docker registry, like local paths and SIF files.
+func registryHost(image string) string {
+	ref := image
+	if scheme, rest, ok := strings.Cut(image, "://"); ok {
+		if scheme != "docker" && scheme != "oras" {
+			return ""
+		}
+		ref = rest
+	} else if strings.HasPrefix(image, "/") || strings.HasSuffix(image, ".sif") {
+		return ""
+	}
+	host, _, ok := strings.Cut(ref, "/")
+	if !ok || (!strings.ContainsAny(host, ".:") && host != "localhost") {
+		// as for docker, the first component is a registry only if it looks like a host name
+		return "docker.io"
+	}
+	return normalizeRegistry(host)
+}
+
+// registryEnv returns the variable assignments, prefixed to the runtime command, passing the
+// credentials of the registry an image is pulled from through the environment. The values refer
+// to the variables of registryCredentialsFile. Podman reads the auth file only.
+func registryEnv(image string, registries map[string]int, config commonIL.InterLinkConfig) []string {
+	n, ok := registries[registryHost(image)]
+	if !ok || config.ContainerRuntime == "podman" {
+		return nil
+	}
+	envPrefix := "SINGULARITY"
+	if config.ContainerRuntime == "apptainer" {
+		envPrefix = "APPTAINER"
+	}
+	return []string{
+		envPrefix + "_DOCKER_USERNAME=\"$REGISTRY_USERNAME_" + strconv.Itoa(n) + "\"",
+		envPrefix + "_DOCKER_PASSWORD=\"$REGISTRY_PASSWORD_" + strconv.Itoa(n) + "\"",
+	}
+}
+
+// checkRegistryCredentials fails when an image is pulled from a registry none of the image pull
+// Secrets holds credentials for, while some of the Secrets listed by the Pod could not be retrieved,
+// rather than leaving the runtime fail later with an obscure authentication error.
+func checkRegistryCredentials(image string, registries map[string]int, pod v1.Pod, secrets []v1.Secret) error {
+	host := registryHost(image)
+	if _, ok := registries[host]; ok || host == "" {
+		return nil
+	}
+	var missing []string
+	for _, pullSecret := range pod.Spec.ImagePullSecrets {
+		found := false
+		for _, secret := range secrets {
+			found = found || secret.Name == pullSecret.Name
+		}
+		if !found {
+			missing = append(missing, pullSecret.Name)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	return fmt.Errorf("image %s is pulled from %s, which no image pull Secret holds credentials for, and Secret %s could not be retrieved", image, host, strings.Join(missing, ", "))
+}
+
+// registryAuthArgs returns the --authfile flag for images pulled from a registry, if any auth file
+// has been prepared.
+func registryAuthArgs(authFile string, image string, config commonIL.InterLinkConfig) []string {
+	if authFile == "" {
+		return nil
+	}
+	if config.ContainerRuntime == "podman" {
+		if strings.HasPrefix(image, "/") {
+			return nil
+		}
+	} else if !strings.HasPrefix(image, "docker://") && !strings.HasPrefix(image, "oras://") {
+		return nil
+	}
+	return []string{"--authfile", authFile}
+}
+
+// imageCacheDir is the directory, below DataRootFolder, holding the SIF files of the images pulled
+// from registries, shared by all the Pods. It is only accessible to the sidecar user.
+const imageCacheDir = "images"
+
+// imageDigestRegex matches the hex encoded sha256 digest of an image pinned by digest.
+var imageDigestRegex = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// cachedImagePath returns the SIF file caching a registry image, together with the reference the
+// runtime pulls it from, if config.CacheImages is set. Only the images pinned by digest are cached,
+// since a tag may be moved to another image, and they are keyed by it. The images of a registry the
+// Pod has credentials for are also keyed by the digest of its auth file, so that they are only shared
+// by the Pods with the same image pull Secrets and never run by Pods which couldn't pull them.
+// Local paths and .sif files are not cached, as well as all the images run by podman, which has its
+// own store.
+func cachedImagePath(image string, authFile string, registries map[string]int, config commonIL.InterLinkConfig) (string, string, bool) {
+	if !config.CacheImages || config.ContainerRuntime == "podman" || strings.HasPrefix(image, "/") || strings.HasSuffix(image, ".sif") {
+		return "", "", false
+	}
+	ref := image
+	if !strings.Contains(ref, "://") {
+		ref = "docker://" + ref
+	} else if !strings.HasPrefix(ref, "docker://") && !strings.HasPrefix(ref, "oras://") {
+		return "", "", false
+	}
+	_, key, ok := strings.Cut(ref, "@sha256:")
+	if !ok || !imageDigestRegex.MatchString(key) {
+		return "", "", false
+	}
+	if _, private := registries[registryHost(image)]; private {
+		authData, err := os.ReadFile(authFile)
+		if err != nil {
+			return "", "", false
+		}
+		authHash := sha256.Sum256(authData)
+		key += "-" + hex.EncodeToString(authHash[:8])
+	}
+	return config.DataRootFolder + imageCacheDir + "/" + key + ".sif", ref, true
+}
+
+// imagePullCommand returns the job script line pulling an image into its cached SIF file, unless
+// already there. Concurrent jobs pulling the same image are serialized through a lock file, and the
+// pull output is written to the <container>.pull file, where the image pull progress is read from.
+func imagePullCommand(ref string, sifPath string, env []string, authArgs []string, path string, containerName string, config commonIL.InterLinkConfig) string {
+	pullLog := path + "/" + containerName + ".pull"
+	pull := append(append(env, runtimeCommand(config, "")[0], "pull"), authArgs...)
+	pull = append(pull, sifPath+".tmp.$$", shellQuote(ref))
+	return "mkdir -p -m 0700 " + filepath.Dir(sifPath) +
+		" && ( flock 9; [ -f " + sifPath + " ] || { " + strings.Join(pull, " ") + " && mv " + sifPath + ".tmp.$$ " + sifPath + "; } ) 9> " + sifPath + ".lock > " + pullLog + " 2>&1" +
+		" && echo \"INFO:    Using cached SIF image " + sifPath + "\" >> " + pullLog
+}
+
+func prepareMounts(
+	workingPath string,
+	container v1.Container,
+	data []commonIL.RetrievedPodData,
+	config commonIL.InterLinkConfig,
+	Ctx context.Context,
+) ([]string, string, error) {
+	log.G(Ctx).Info("-- Preparing mountpoints for " + container.Name)
+	prefix := ""
+	mount := make([]string, 1)
+	mount = append(mount, "--bind")
+	mountedData := ""
+
+	type mountJob struct {
+		pod      v1.Pod
+		data     interface{}
+		withEnvs bool
+	}
+	type mountResult struct {
+		paths []string
+		envs  []string
+		err   error
+	}
+
+	var jobs []mountJob
+	for _, podData := range data {
+		err := os.MkdirAll(workingPath, os.ModePerm)
+		if err != nil {
+			log.G(Ctx).Error(err)
+			return nil, "", err
+		} else {
+			log.G(Ctx).Info("-- Created directory " + workingPath)
+		}
+
+		for _, cont := range podData.Containers {
+			if container.Name != cont.Name {
+				continue
+			}
+			for _, cfgMap := range cont.ConfigMaps {
+				jobs = append(jobs, mountJob{pod: podData.Pod, data: cfgMap, withEnvs: true})
+			}
+			for _, secret := range cont.Secrets {
+				jobs = append(jobs, mountJob{pod: podData.Pod, data: secret, withEnvs: true})
+			}
+			for _, emptyDir := range cont.EmptyDirs {
+				jobs = append(jobs, mountJob{pod: podData.Pod, data: emptyDir})
+			}
+			for _, vol := range podData.Pod.Spec.Volumes {
+				if vol.PersistentVolumeClaim != nil && isMountedBy(vol.Name, container) {
+					jobs = append(jobs, mountJob{pod: podData.Pod, data: *vol.PersistentVolumeClaim})
+				}
+				if vol.HostPath != nil && isMountedBy(vol.Name, container) {
+					jobs = append(jobs, mountJob{pod: podData.Pod, data: *vol.HostPath})
+				}
+				if vol.DownwardAPI != nil && isMountedBy(vol.Name, container) {
+					jobs = append(jobs, mountJob{pod: podData.Pod, data: vol, withEnvs: true})
+				}
+				if vol.Projected != nil && isMountedBy(vol.Name, container) {
+					jobs = append(jobs, mountJob{pod: podData.Pod, data: projectedVolume{volume: vol, configMaps: cont.ProjectedConfigMaps, secrets: cont.ProjectedSecrets}, withEnvs: true})
+				}
+			}
+		}
+	}
+
+	// mountData calls are spread across a bounded pool of workers, while the results are
+	// collected by index so that the generated --bind string keeps a stable order
+	concurrency := config.MountConcurrency
+	if concurrency <= 0 {
+		concurrency = runtime.GOMAXPROCS(0)
+	}
+	results := make([]mountResult, len(jobs))
+	jobIndexes := make(chan int)
+	var wg sync.WaitGroup
+	for worker := 0; worker < concurrency && worker < len(jobs); worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobIndexes {
+				paths, envs, err := mountData(workingPath, container, jobs[i].pod, jobs[i].data, config, Ctx)
+				results[i] = mountResult{paths: paths, envs: envs, err: err}
+			}
+		}()
+	}
+	for i := range jobs {
+		jobIndexes <- i
+	}
+	close(jobIndexes)
+	wg.Wait()
+
+	for i, result := range results {
+		if result.err != nil {
+			log.G(Ctx).Error(result.err)
+			return nil, "", result.err
+		}
+		for j, path := range result.paths {
+			if jobs[i].withEnvs && os.Getenv("SHARED_FS") != "true" {
+				dirs := strings.Split(path, ":")
+				prefix += "\nmkdir -p " + filepath.Dir(dirs[0]) + " && touch " + dirs[0] + " && echo \"$" + result.envs[j] + "\" > " + dirs[0]
+			}
+			mountedData += path
+		}
+	}
+
+	//path_hardcoded := ("/cvmfs/grid.cern.ch/etc/grid-security:/etc/grid-security" + "," +
+	//	"/cvmfs:/cvmfs" + ",")
+	//mount_data += path_hardcoded
+	if last := len(mountedData) - 1; last >= 0 && mountedData[last] == ',' {
+		mountedData = mountedData[:last]
+	}
+	if len(mountedData) == 0 {
+		return []string{}, prefix, nil
+	}
+	return append(mount, mountedData), prefix, nil
+}
+
+func produceSLURMScript(
+	path string,
+	podNamespace string,
 	podUID string,
 	metadata metav1.ObjectMeta,
+	podSpec v1.PodSpec,
 	commands []SingularityCommand,
+	prefix string,
+	dependencies []string,
 	config commonIL.InterLinkConfig,
 	Ctx context.Context,
 ) (string, error) {
 	log.G(Ctx).Info("-- Creating file for the Slurm script")
+	if config.MaxContainers > 0 && len(commands) > config.MaxContainers {
+		return "", fmt.Errorf("the pod has %d containers, more than the %d allowed by the sidecar configuration", len(commands), config.MaxContainers)
+	}
+
+	var initCommands, containerCommands []SingularityCommand
+	for _, singularityCommand := range commands {
+		if singularityCommand.isInitContainer {
+			initCommands = append(initCommands, singularityCommand)
+		} else {
+			containerCommands = append(containerCommands, singularityCommand)
+		}
+	}
+
 	err := os.MkdirAll(path, os.ModePerm)
 	if err != nil {
 		log.G(Ctx).Error(err)
@@ -279,13 +1321,14 @@ func produceSLURMScript(
 	var sbatch_flags_from_argo []string
 	var sbatch_flags_as_string = ""
 	if slurm_flags, ok := metadata.Annotations["slurm-job.vk.io/flags"]; ok {
-		sbatch_flags_from_argo = strings.Split(slurm_flags, " ")
+		sbatch_flags_from_argo = splitFlags(slurm_flags)
 	}
 	if mpi_flags, ok := metadata.Annotations["slurm-job.vk.io/mpi-flags"]; ok {
 		if mpi_flags != "true" {
-			mpi := append([]string{"mpiexec", "-np", "$SLURM_NTASKS"}, strings.Split(mpi_flags, " ")...)
-			for _, singularityCommand := range commands {
-				singularityCommand.command = append(mpi, singularityCommand.command...)
+			mpi := append([]string{"mpiexec", "-np", "$SLURM_NTASKS"}, splitFlags(mpi_flags)...)
+			// the commands are updated in place, each of them getting its own copy of the mpiexec prefix
+			for i := range commands {
+				commands[i].command = append(append([]string{}, mpi...), commands[i].command...)
 			}
 		}
 	}
@@ -294,6 +1337,106 @@ func produceSLURMScript(
 		sbatch_flags_as_string += "\n#SBATCH " + slurm_flag
 	}
 
+	for _, resourceFlag := range resourceFlags(sbatch_flags_from_argo, podSpec, metadata.Annotations["slurm-job.vk.io/multi-prog"] == "true") {
+		log.G(Ctx).Debug("--- Adding resource flag " + resourceFlag + " derived from the Pod spec")
+		sbatch_flags_as_string += "\n#SBATCH " + resourceFlag
+	}
+
+	gres, err := resolveGres(sbatch_flags_from_argo, metadata, podSpec, config)
+	if err != nil {
+		log.G(Ctx).Error(err)
+		return "", err
+	}
+	if gres != "" {
+		log.G(Ctx).Debug("--- Requesting generic resources " + gres)
+		sbatch_flags_as_string += "\n#SBATCH --gres=" + gres
+	}
+
+	qos, err := resolveQOS(sbatch_flags_from_argo, metadata, podSpec, config)
+	if err != nil {
+		log.G(Ctx).Error(err)
+		return "", err
+	}
+	if qos != "" {
+		log.G(Ctx).Debug("--- Setting QOS to " + qos)
+		sbatch_flags_as_string += "\n#SBATCH --qos=" + qos
+	}
+
+	account, err := resolveAccount(sbatch_flags_from_argo, metadata, config, Ctx)
+	if err != nil {
+		log.G(Ctx).Error(err)
+		return "", err
+	}
+	if account != "" {
+		log.G(Ctx).Debug("--- Charging job to account " + account)
+		sbatch_flags_as_string += "\n#SBATCH --account=" + account
+	}
+
+	nodeFlags, err := nodeConstraintFlags(sbatch_flags_from_argo, podSpec)
+	if err != nil {
+		log.G(Ctx).Error(err)
+		return "", err
+	}
+	for _, nodeFlag := range nodeFlags {
+		log.G(Ctx).Debug("--- Adding node constraint " + nodeFlag)
+		sbatch_flags_as_string += "\n#SBATCH " + nodeFlag
+	}
+
+	arraySpec, err := resolveArray(sbatch_flags_from_argo, metadata)
+	if err != nil {
+		log.G(Ctx).Error(err)
+		return "", err
+	}
+	if arraySpec != "" {
+		log.G(Ctx).Debug("--- Submitting as job array " + arraySpec)
+		sbatch_flags_as_string += "\n#SBATCH --array=" + arraySpec
+	}
+
+	if len(dependencies) > 0 && !hasSbatchFlag(sbatch_flags_from_argo, "--dependency", "-d") {
+		log.G(Ctx).Debug("--- Depending on jobs " + strings.Join(dependencies, ", "))
+		sbatch_flags_as_string += "\n#SBATCH --dependency=afterok:" + strings.Join(dependencies, ":")
+	}
+
+	if timeLimit := resolveTimeLimit(sbatch_flags_from_argo, podSpec, config); timeLimit != "" {
+		log.G(Ctx).Debug("--- Setting job time limit to " + timeLimit)
+		sbatch_flags_as_string += "\n#SBATCH --time=" + timeLimit
+
+		if !hasSbatchFlag(sbatch_flags_from_argo, "--signal") {
+			// the batch shell is warned before the time limit and forwards the signal to the containers,
+			// waiting for them to exit, so that they get a chance to checkpoint before being killed
+			gracePeriod := config.TimeLimitGracePeriod
+			if gracePeriod <= 0 {
+				gracePeriod = 60
+			}
+			sbatch_flags_as_string += "\n#SBATCH --signal=B:TERM@" + strconv.Itoa(gracePeriod)
+			prefix += "\ntrap 'for pidFile in " + path + "/*.pid; do kill -TERM $(cat \"$pidFile\") 2> /dev/null; done' TERM"
+			postfix += "\nuntil wait; do :; done"
+		}
+	}
+
+	for _, spreadFlag := range topologySpreadFlags(sbatch_flags_from_argo, podSpec, config, Ctx) {
+		log.G(Ctx).Debug("--- Adding spread flag " + spreadFlag + " derived from the topology spread constraints")
+		sbatch_flags_as_string += "\n#SBATCH " + spreadFlag
+	}
+
+	if multiProg, ok := metadata.Annotations["slurm-job.vk.io/multi-prog"]; ok && multiProg == "true" {
+		if !hasSbatchFlag(sbatch_flags_from_argo, "--ntasks", "-n") {
+			sbatch_flags_as_string += "\n#SBATCH --ntasks=" + strconv.Itoa(len(containerCommands))
+		}
+	}
+
+	if gpuSharing, ok := metadata.Annotations["slurm-job.vk.io/gpu-sharing"]; ok {
+		gpuFlags, gpuPrefix, gpuPostfix, err := gpuSharingDirectives(gpuSharing, path, config)
+		if err != nil {
+			log.G(Ctx).Error(err)
+			return "", err
+		}
+		log.G(Ctx).Debug("--- Enabling GPU sharing mode " + gpuSharing)
+		sbatch_flags_as_string += gpuFlags
+		prefix += gpuPrefix
+		postfix += gpuPostfix
+	}
+
 	if config.Tsocks {
 		log.G(Ctx).Debug("--- Adding SSH connection and setting ENVs to use TSOCKS")
 		postfix += "\n\nkill -15 $SSH_PID &> log2.txt"
@@ -309,117 +1452,3028 @@ func produceSLURMScript(
 		prefix += "\n  fi"
 		prefix += "\ndone"
 
-		prefix += "\nssh -4 -N -D $port " + config.Tsockslogin + " &"
-		prefix += "\nSSH_PID=$!"
-		prefix += "\necho \"local = 10.0.0.0/255.0.0.0 \nserver = 127.0.0.1 \nserver_port = $port\" >> .tmp/" + podUID + "_tsocks.conf"
-		prefix += "\nexport TSOCKS_CONF_FILE=.tmp/" + podUID + "_tsocks.conf && export LD_PRELOAD=" + config.Tsockspath
+		prefix += "\nssh -4 -N -D $port " + config.Tsockslogin + " &"
+		prefix += "\nSSH_PID=$!"
+
+		prefix += "\nfor ((attempt=1; attempt<=30; attempt++))"
+		prefix += "\ndo"
+		prefix += "\n  if ss -tln | grep -q \":$port \"; then"
+		prefix += "\n    break"
+		prefix += "\n  fi"
+		prefix += "\n  sleep 1"
+		prefix += "\ndone"
+		prefix += "\nif ! ss -tln | grep -q \":$port \"; then"
+		prefix += "\n  echo \"SOCKS proxy on port $port through " + config.Tsockslogin + " could not be established, aborting job\" >&2"
+		prefix += "\n  kill -15 $SSH_PID &> /dev/null"
+		prefix += "\n  exit 1"
+		prefix += "\nfi"
+		prefix += "\necho \"local = 10.0.0.0/255.0.0.0 \nserver = 127.0.0.1 \nserver_port = $port\" >> .tmp/" + podUID + "_tsocks.conf"
+		prefix += "\nexport TSOCKS_CONF_FILE=.tmp/" + podUID + "_tsocks.conf && export LD_PRELOAD=" + config.Tsockspath
+	}
+
+	prefix += bindEnvDirectives(config)
+
+	if config.Commandprefix != "" {
+		prefix += "\n" + config.Commandprefix
+	}
+
+	partition := resolvePartition(sbatch_flags_from_argo)
+	if partition == "" {
+		partition, err = requestedPartition(metadata, podSpec, config)
+		if err != nil {
+			log.G(Ctx).Error(err)
+			return "", err
+		}
+		if partition != "" {
+			log.G(Ctx).Debug("--- Submitting to partition " + partition)
+			sbatch_flags_as_string += "\n#SBATCH --partition=" + partition
+		}
+	}
+	if partitionPrefix, ok := config.PartitionCommandPrefix[partition]; ok && partition != "" {
+		log.G(Ctx).Debug("--- Adding command prefix for partition " + partition)
+		prefix += "\n" + partitionPrefix
+	}
+
+	if config.ScratchBaseDir != "" {
+		log.G(Ctx).Debug("--- Creating a per-job scratch directory below " + config.ScratchBaseDir)
+		// the base is left unquoted on purpose, so that it can refer to node variables like $LOCAL_DISK
+		prefix += "\nexport SCRATCH=\"" + strings.TrimSuffix(config.ScratchBaseDir, "/") + "/slurm-$SLURM_JOB_ID\"" +
+			"\nexport TMPDIR=$SCRATCH" +
+			"\nmkdir -p \"$SCRATCH\""
+		// the containers run in the background, the directory is removed once all of them ended
+		postfix += "\nwait\nrm -rf \"$SCRATCH\""
+	}
+
+	if memoryPrefix, memoryPostfix := memoryEmptyDirDirectives(podSpec, path, podUID, config); memoryPrefix != "" {
+		log.G(Ctx).Debug("--- Creating the memory EmptyDirs on the node")
+		prefix += memoryPrefix
+		postfix += memoryPostfix
+	}
+
+	if limitPrefix := emptyDirLimitDirectives(podSpec, path, len(initCommands)+len(containerCommands)); limitPrefix != "" {
+		log.G(Ctx).Debug("--- Watching the size of the EmptyDirs with a sizeLimit")
+		prefix += limitPrefix
+	}
+
+	if preExecAnnotations, ok := metadata.Annotations["job.vk.io/pre-exec"]; ok {
+		prefix += "\n" + preExecAnnotations
+	}
+
+	output := "\n#SBATCH --output=" + path + "/job.out"
+	if isArrayJob(sbatch_flags_from_argo, metadata) {
+		// every array task gets its own file, rather than interleaving its output with the others
+		output = "\n#SBATCH --output=" + path + "/job_%A_%a.out" +
+			"\n#SBATCH --error=" + path + "/job_%A_%a.out"
+	}
+
+	shell, err := jobShell(metadata, config)
+	if err != nil {
+		log.G(Ctx).Error(err)
+		return "", err
+	}
+
+	sbatch_macros := "#!" + shell +
+		"\n#SBATCH --job-name=" + podUID +
+		output +
+		sbatch_flags_as_string +
+		"\n" +
+		prefix +
+		"\n"
+
+	log.G(Ctx).Debug("--- Writing file")
+
+	var stringToBeWritten string
+
+	stringToBeWritten += sbatch_macros
+
+	for _, singularityCommand := range commands {
+		if singularityCommand.imagePull != "" {
+			// a failed pull is reported by the runtime, which can't find the image afterwards
+			stringToBeWritten += "\n" + singularityCommand.imagePull
+		}
+	}
+
+	for _, singularityCommand := range initCommands {
+		stringToBeWritten += "\n" + strings.Join(singularityCommand.command[:], " ") +
+			outputRedirect(path, singularityCommand.containerName, config) +
+			"\nexitCode=$?" +
+			"\necho $exitCode > " + path + "/" + singularityCommand.containerName + ".status" +
+			"\nif [ $exitCode -ne 0 ]; then" +
+			"\n  echo \"Init container " + singularityCommand.containerName + " failed with exit code $exitCode\"" +
+			"\n  exit $exitCode" +
+			"\nfi"
+	}
+
+	if multiProg, ok := metadata.Annotations["slurm-job.vk.io/multi-prog"]; ok && multiProg == "true" {
+		log.G(Ctx).Info("-- Multi-prog annotation found, containers will be run as ranks of a single srun")
+		multiProgPath, err := produceMultiProgConfig(path, containerCommands, config, Ctx)
+		if err != nil {
+			log.G(Ctx).Error(err)
+			return "", err
+		}
+		stringToBeWritten += "\nsrun --ntasks=" + strconv.Itoa(len(containerCommands)) + " --multi-prog " + multiProgPath
+	} else {
+		for _, singularityCommand := range containerCommands {
+			// the container runs in the background of its own group, so that its PID can be recorded
+			// for signal forwarding while the group still waits for its exit code
+			stringToBeWritten += "\n{ " + strings.Join(singularityCommand.command[:], " ") +
+				outputRedirect(path, singularityCommand.containerName, config) + " & " +
+				"pid=$!; echo $pid > " + path + "/" + singularityCommand.containerName + ".pid; " +
+				"wait $pid; echo $? > " + path + "/" + singularityCommand.containerName + ".status; } &"
+		}
+	}
+
+	stringToBeWritten += "\n" + postfix
+
+	if config.MaxScriptSize > 0 && len(stringToBeWritten) > config.MaxScriptSize {
+		f.Close()
+		os.Remove(path + "/job.sh")
+		return "", fmt.Errorf("the generated job script is %d bytes, more than the %d allowed by the sidecar configuration", len(stringToBeWritten), config.MaxScriptSize)
+	}
+
+	_, err = f.WriteString(stringToBeWritten)
+	f.Close()
+
+	if err != nil {
+		log.G(Ctx).Error(err)
+		return "", err
+	} else {
+		log.G(Ctx).Debug("---- Written file")
+	}
+
+	err = checkScriptSyntax(f.Name(), shell, config, Ctx)
+	if err != nil {
+		log.G(Ctx).Error(err)
+		return "", err
+	}
+
+	return f.Name(), nil
+}
+
+// errInvalidScript is returned when the generated job script doesn't parse, e.g. because of a
+// malformed command injected through an annotation.
+var errInvalidScript = errors.New("invalid job script")
+
+// checkScriptSyntax parses the job script with its interpreter, without running it, so that a script
+// which can't run is refused before it takes a scheduler slot. The check is skipped if the interpreter
+// is not available on the sidecar host.
+func checkScriptSyntax(scriptPath string, shell string, config commonIL.InterLinkConfig, Ctx context.Context) error {
+	if _, err := exec.LookPath(shell); err != nil {
+		log.G(Ctx).Warning("--- Shell " + shell + " is not available, not checking the syntax of " + scriptPath)
+		return nil
+	}
+	ctx, cancel := commandContext(Ctx, config)
+	defer cancel()
+	output, err := exec.CommandContext(ctx, shell, "-n", scriptPath).CombinedOutput()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && ctx.Err() == nil {
+		return fmt.Errorf("%w: %s", errInvalidScript, strings.TrimSpace(string(output)))
+	}
+	return timeoutError(ctx, shell, config, err)
+}
+
+// topologySpreadFlags translates the topologySpreadConstraints of the Pod into sbatch flags, if
+// config.TopologySpread is set. Only the spread over kubernetes.io/hostname has a Slurm counterpart:
+// the job is spread over as many nodes as possible and, with a maxSkew of 1, its tasks are distributed
+// cyclically over them. The other constraints are logged and ignored, as well as all of them if
+// the flags annotation already sets --spread-job or --distribution.
+func topologySpreadFlags(sbatchFlags []string, podSpec v1.PodSpec, config commonIL.InterLinkConfig, Ctx context.Context) []string {
+	if !config.TopologySpread || len(podSpec.TopologySpreadConstraints) == 0 {
+		return nil
+	}
+	if hasSbatchFlag(sbatchFlags, "--spread-job", "--distribution", "-m") {
+		log.G(Ctx).Info("--- Spread flags set through the flags annotation, ignoring topology spread constraints")
+		return nil
+	}
+
+	var flags []string
+	for _, constraint := range podSpec.TopologySpreadConstraints {
+		if constraint.TopologyKey != v1.LabelHostname {
+			log.G(Ctx).Info("--- Topology spread constraint over " + constraint.TopologyKey + " has no Slurm counterpart, ignoring it")
+			continue
+		}
+		if len(flags) == 0 {
+			flags = append(flags, "--spread-job")
+		}
+		if constraint.MaxSkew == 1 && len(flags) == 1 {
+			flags = append(flags, "--distribution=cyclic")
+		}
+	}
+	return flags
+}
+
+// splitFlags splits the flags annotation on the whitespace outside of quotes, so that values like
+// --comment="my job" survive as a single flag. Quotes and backslashes are kept as they are, since
+// sbatch parses them again in the #SBATCH lines, and empty tokens are dropped.
+func splitFlags(flags string) []string {
+	var tokens []string
+	var token strings.Builder
+	var quote rune
+	escaped := false
+	for _, char := range flags {
+		switch {
+		case escaped:
+			escaped = false
+		case char == '\\' && quote != '\'':
+			escaped = true
+		case quote != 0:
+			if char == quote {
+				quote = 0
+			}
+		case char == '"' || char == '\'':
+			quote = char
+		case unicode.IsSpace(char):
+			if token.Len() > 0 {
+				tokens = append(tokens, token.String())
+				token.Reset()
+			}
+			continue
+		}
+		token.WriteRune(char)
+	}
+	if token.Len() > 0 {
+		tokens = append(tokens, token.String())
+	}
+	return tokens
+}
+
+// resolvePartition returns the partition requested through the sbatch flags, or an empty string
+// if the job is going to be submitted to the cluster's default partition.
+func resolvePartition(sbatchFlags []string) string {
+	for i, flag := range sbatchFlags {
+		switch {
+		case strings.HasPrefix(flag, "--partition="):
+			return strings.TrimPrefix(flag, "--partition=")
+		case strings.HasPrefix(flag, "-p") && len(flag) > 2:
+			return strings.TrimPrefix(flag, "-p")
+		case (flag == "--partition" || flag == "-p") && i+1 < len(sbatchFlags):
+			return sbatchFlags[i+1]
+		}
+	}
+	return ""
+}
+
+// partitionNameRegex matches the partition names (or comma separated lists of them) that can be safely written to the job script.
+var partitionNameRegex = regexp.MustCompile(`^[A-Za-z0-9_.-]+(,[A-Za-z0-9_.-]+)*$`)
+
+// requestedPartition returns the partition set through the slurm-job.vk.io/partition annotation, the
+// slurm.vk.io/partition nodeSelector or config.DefaultPartition, in this order of precedence.
+func requestedPartition(metadata metav1.ObjectMeta, podSpec v1.PodSpec, config commonIL.InterLinkConfig) (string, error) {
+	partition := config.DefaultPartition
+	if selected, ok := podSpec.NodeSelector["slurm.vk.io/partition"]; ok {
+		partition = selected
+	}
+	if annotated, ok := metadata.Annotations["slurm-job.vk.io/partition"]; ok {
+		partition = annotated
+	}
+	if partition != "" && !partitionNameRegex.MatchString(partition) {
+		return "", errors.New("invalid partition name " + strconv.Quote(partition))
+	}
+	return partition, nil
+}
+
+// nodeNameRegex matches the node names, or hostlist expressions like node[01-04], that can be safely written to the job script.
+var nodeNameRegex = regexp.MustCompile(`^[A-Za-z0-9_.-]+(\[[0-9,-]+\])?$`)
+
+// nodeConstraintFlags translates the slurm.vk.io/nodelist and slurm.vk.io/exclude keys of the Pod
+// nodeSelector, as well as the In expressions over them in the first required node affinity term,
+// into --nodelist and --exclude. Flags explicitly set through the flags annotation win, while any
+// other nodeSelector key is left alone.
+func nodeConstraintFlags(sbatchFlags []string, podSpec v1.PodSpec) ([]string, error) {
+	nodes := map[string][]string{}
+	for _, key := range []string{"slurm.vk.io/nodelist", "slurm.vk.io/exclude"} {
+		if value, ok := podSpec.NodeSelector[key]; ok {
+			nodes[key] = append(nodes[key], value)
+		}
+	}
+	if podSpec.Affinity != nil && podSpec.Affinity.NodeAffinity != nil && podSpec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution != nil {
+		// the terms are ORed, which Slurm can't express, so only the first one is considered
+		if terms := podSpec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms; len(terms) > 0 {
+			for _, expression := range terms[0].MatchExpressions {
+				if (expression.Key == "slurm.vk.io/nodelist" || expression.Key == "slurm.vk.io/exclude") && expression.Operator == v1.NodeSelectorOpIn {
+					nodes[expression.Key] = append(nodes[expression.Key], expression.Values...)
+				}
+			}
+		}
+	}
+
+	var flags []string
+	for _, constraint := range []struct {
+		key     string
+		flag    string
+		options []string
+	}{
+		{"slurm.vk.io/nodelist", "--nodelist", []string{"--nodelist", "-w"}},
+		{"slurm.vk.io/exclude", "--exclude", []string{"--exclude", "-x"}},
+	} {
+		if len(nodes[constraint.key]) == 0 || hasSbatchFlag(sbatchFlags, constraint.options...) {
+			continue
+		}
+		for _, node := range nodes[constraint.key] {
+			if !nodeNameRegex.MatchString(node) {
+				return nil, errors.New("invalid node name " + strconv.Quote(node) + " in " + constraint.key)
+			}
+		}
+		flags = append(flags, constraint.flag+"="+strings.Join(nodes[constraint.key], ","))
+	}
+	return flags, nil
+}
+
+// bindEnvDirectives returns the script lines enforcing config.BindEnvPolicy on the SINGULARITY_BIND and
+// APPTAINER_BIND variables, which the runtime merges with the --bind flags. With "inherit" (the default)
+// the job keeps whatever the submission environment holds, "clear" unsets them, while "merge" pins them
+// to the sorted and deduplicated bind paths found in the sidecar environment at submission time.
+func bindEnvDirectives(config commonIL.InterLinkConfig) string {
+	switch config.BindEnvPolicy {
+	case "clear":
+		return "\nunset SINGULARITY_BIND APPTAINER_BIND"
+	case "merge":
+		seen := map[string]bool{}
+		var binds []string
+		for _, variable := range []string{"SINGULARITY_BIND", "APPTAINER_BIND"} {
+			for _, bind := range strings.Split(os.Getenv(variable), ",") {
+				bind = strings.TrimSpace(bind)
+				if bind != "" && !seen[bind] {
+					seen[bind] = true
+					binds = append(binds, bind)
+				}
+			}
+		}
+		sort.Strings(binds)
+		directives := "\nunset SINGULARITY_BIND APPTAINER_BIND"
+		if len(binds) > 0 {
+			directives += "\nexport SINGULARITY_BIND=" + shellQuote(strings.Join(binds, ",")) +
+				"\nexport APPTAINER_BIND=\"$SINGULARITY_BIND\""
+		}
+		return directives
+	}
+	return ""
+}
+
+// hasSbatchFlag reports whether one of the given long or short options is already present in the sbatch flags.
+func hasSbatchFlag(sbatchFlags []string, options ...string) bool {
+	for _, flag := range sbatchFlags {
+		for _, option := range options {
+			if flag == option || strings.HasPrefix(flag, option+"=") || (!strings.HasPrefix(option, "--") && strings.HasPrefix(flag, option)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// expandPodFields replaces the $(POD_NAME), $(POD_NAMESPACE) and $(POD_UID) references in the command
+// or args of a container, as Kubernetes does for the variables they are usually exposed through, while
+// $$(POD_NAME) and the like escape them. Any other $ is left alone, so shell syntax keeps working. It
+// returns the arguments as they are unless config.ExpandPodFields is set.
+func expandPodFields(args []string, pod v1.Pod, config commonIL.InterLinkConfig) []string {
+	if !config.ExpandPodFields {
+		return args
+	}
+	fields := map[string]string{
+		"POD_NAME":      pod.Name,
+		"POD_NAMESPACE": pod.Namespace,
+		"POD_UID":       string(pod.UID),
+	}
+	var expanded []string
+	for _, arg := range args {
+		var builder strings.Builder
+		for i := 0; i < len(arg); i++ {
+			escaped := strings.HasPrefix(arg[i:], "$$(")
+			start := i
+			if escaped {
+				start++
+			}
+			if strings.HasPrefix(arg[start:], "$(") {
+				if end := strings.IndexByte(arg[start:], ')'); end > 0 {
+					if value, ok := fields[arg[start+2:start+end]]; ok {
+						if escaped {
+							builder.WriteString(arg[start : start+end+1])
+						} else {
+							builder.WriteString(value)
+						}
+						i = start + end
+						continue
+					}
+				}
+			}
+			builder.WriteByte(arg[i])
+		}
+		expanded = append(expanded, builder.String())
+	}
+	return expanded
+}
+
+// isArrayJob reports whether the Pod is submitted as a job array, through the slurm-job.vk.io/array
+// annotation or the flags annotation.
+func isArrayJob(sbatchFlags []string, metadata metav1.ObjectMeta) bool {
+	return metadata.Annotations["slurm-job.vk.io/array"] != "" || hasSbatchFlag(sbatchFlags, "--array", "-a")
+}
+
+// arraySpecRegex matches the task indexes of a job array as taken by sbatch --array, e.g. 0-9%4 or 1,3,5-7:2.
+var arraySpecRegex = regexp.MustCompile(`^[0-9]+(-[0-9]+(:[0-9]+)?)?(,[0-9]+(-[0-9]+(:[0-9]+)?)?)*(%[0-9]+)?$`)
+
+// resolveArray returns the value for the #SBATCH --array directive, set through the
+// slurm-job.vk.io/array annotation, unless the flags annotation already sets --array.
+func resolveArray(sbatchFlags []string, metadata metav1.ObjectMeta) (string, error) {
+	arraySpec := metadata.Annotations["slurm-job.vk.io/array"]
+	if arraySpec == "" || hasSbatchFlag(sbatchFlags, "--array", "-a") {
+		return "", nil
+	}
+	if !arraySpecRegex.MatchString(arraySpec) {
+		return "", errors.New("job array " + arraySpec + " set through the slurm-job.vk.io/array annotation is not valid")
+	}
+	return arraySpec, nil
+}
+
+// recordArrayJob marks the job of a Pod submitted as a job array, along with the task whose output
+// is returned as the Pod logs, set through the slurm-job.vk.io/array-task annotation.
+func (h *SidecarHandler) recordArrayJob(jid *JidStruct, metadata metav1.ObjectMeta) {
+	if !isArrayJob(splitFlags(metadata.Annotations["slurm-job.vk.io/flags"]), metadata) {
+		return
+	}
+	jid.ArrayJob = true
+	// the task ID ends up in a file path, anything else than a number is ignored
+	if task := metadata.Annotations["slurm-job.vk.io/array-task"]; task != "" {
+		if _, err := strconv.Atoi(task); err == nil {
+			jid.ArrayTask = task
+		}
+	}
+	h.markJIDsDirty()
+}
+
+// arrayJobLogs returns the output of the task of a job array selected through ArrayTask or, if none
+// is, the output of all the tasks in order, each one preceded by a header.
+func arrayJobLogs(path string, jid *JidStruct) ([]byte, error) {
+	if jid.ArrayTask != "" {
+		return os.ReadFile(path + "/job_" + jid.JID + "_" + jid.ArrayTask + ".out")
+	}
+
+	files, err := filepath.Glob(path + "/job_" + jid.JID + "_*.out")
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, os.ErrNotExist
+	}
+	taskID := func(file string) int {
+		id, _ := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(filepath.Base(file), "job_"+jid.JID+"_"), ".out"))
+		return id
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return taskID(files[i]) < taskID(files[j])
+	})
+
+	var output []byte
+	for _, file := range files {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		output = append(output, []byte("==> task "+strconv.Itoa(taskID(file))+" <==\n")...)
+		output = append(output, content...)
+	}
+	return output, nil
+}
+
+// containerResources returns the CPU millicores and memory bytes of a container, preferring limits over requests.
+func containerResources(container v1.Container) (int64, int64) {
+	var milliCPU, memoryBytes int64
+	if cpu, ok := container.Resources.Limits[v1.ResourceCPU]; ok {
+		milliCPU = cpu.MilliValue()
+	} else if cpu, ok := container.Resources.Requests[v1.ResourceCPU]; ok {
+		milliCPU = cpu.MilliValue()
+	}
+	if memory, ok := container.Resources.Limits[v1.ResourceMemory]; ok {
+		memoryBytes = memory.Value()
+	} else if memory, ok := container.Resources.Requests[v1.ResourceMemory]; ok {
+		memoryBytes = memory.Value()
+	}
+	return milliCPU, memoryBytes
+}
+
+// podResources returns the CPU millicores and memory bytes needed by the Pod, preferring limits over
+// requests. The app containers run together, so their resources are summed, while the init containers
+// run one at a time before them, so each resource is the largest between the sum of the app containers
+// and the biggest init container.
+func podResources(podSpec v1.PodSpec) (int64, int64) {
+	var milliCPU, memoryBytes int64
+	for _, container := range podSpec.Containers {
+		containerCPU, containerMemory := containerResources(container)
+		milliCPU += containerCPU
+		memoryBytes += containerMemory
+	}
+	for _, container := range podSpec.InitContainers {
+		containerCPU, containerMemory := containerResources(container)
+		milliCPU = max(milliCPU, containerCPU)
+		memoryBytes = max(memoryBytes, containerMemory)
+	}
+	return milliCPU, memoryBytes
+}
+
+// largestContainerCPU returns the CPU millicores of the Pod container, init ones included, needing
+// the most of them, preferring limits over requests.
+func largestContainerCPU(podSpec v1.PodSpec) int64 {
+	var milliCPU int64
+	for _, container := range append(append([]v1.Container{}, podSpec.InitContainers...), podSpec.Containers...) {
+		containerCPU, _ := containerResources(container)
+		milliCPU = max(milliCPU, containerCPU)
+	}
+	return milliCPU
+}
+
+// containerStepCommand returns the srun command running a container as a job step of its own, if
+// config.ContainerSteps is set, so that its CPU and memory are confined to the slice of the allocation
+// derived from its resources, rounded as for the sbatch flags. Containers without resources get
+// a step overlapping the others, with all the CPUs and memory of the allocation on the node, since
+// an exclusive step would otherwise be given a single CPU.
+func containerStepCommand(container v1.Container, config commonIL.InterLinkConfig) []string {
+	if !config.ContainerSteps {
+		return nil
+	}
+	milliCPU, memoryBytes := containerResources(container)
+	if milliCPU == 0 && memoryBytes == 0 {
+		return []string{srunPath(config), "--ntasks=1", "--overlap", "--cpus-per-task=$SLURM_CPUS_ON_NODE", "--mem=0"}
+	}
+	command := []string{srunPath(config), "--ntasks=1", "--exclusive"}
+	if milliCPU > 0 {
+		command = append(command, "--cpus-per-task="+strconv.FormatInt((milliCPU+999)/1000, 10))
+	}
+	if memoryBytes > 0 {
+		command = append(command, "--mem="+strconv.FormatInt((memoryBytes+1024*1024-1)/(1024*1024), 10)+"M")
+	}
+	return command
+}
+
+// resourceFlags translates the CPU and memory resources of the Pod containers into sbatch flags.
+// Limits are preferred over requests and the values are summed, since all the containers run in
+// the same allocation. In multi-prog mode every container is a task of its own, so the CPUs per
+// task are the ones of the largest container instead. CPU millicores are rounded up to whole cores.
+// Flags explicitly set through the flags annotation win over the derived ones.
+func resourceFlags(sbatchFlags []string, podSpec v1.PodSpec, multiProg bool) []string {
+	milliCPU, memoryBytes := podResources(podSpec)
+	if multiProg {
+		milliCPU = largestContainerCPU(podSpec)
+	}
+
+	var flags []string
+	if milliCPU > 0 && !hasSbatchFlag(sbatchFlags, "--cpus-per-task", "-c") {
+		flags = append(flags, "--cpus-per-task="+strconv.FormatInt((milliCPU+999)/1000, 10))
+	}
+	if memoryBytes > 0 && !hasSbatchFlag(sbatchFlags, "--mem", "--mem-per-cpu", "--mem-per-gpu") {
+		flags = append(flags, "--mem="+strconv.FormatInt((memoryBytes+1024*1024-1)/(1024*1024), 10)+"M")
+	}
+	return flags
+}
+
+// gresRegex matches comma separated lists of name[:type][:count] generic resources, which can be
+// safely written to the job script.
+var gresRegex = regexp.MustCompile(`^[A-Za-z0-9_.-]+(:[A-Za-z0-9_.-]+)*(,[A-Za-z0-9_.-]+(:[A-Za-z0-9_.-]+)*)*$`)
+
+// resolveGres returns the value for the #SBATCH --gres directive. The slurm-job.vk.io/gres annotation
+// takes precedence, otherwise the GPUs requested in the container limits (nvidia.com/gpu or the
+// configured GPUResourceName) are summed across all the containers of the Pod.
+func resolveGres(sbatchFlags []string, metadata metav1.ObjectMeta, podSpec v1.PodSpec, config commonIL.InterLinkConfig) (string, error) {
+	if hasSbatchFlag(sbatchFlags, "--gres") {
+		return "", nil
+	}
+	if gres, ok := metadata.Annotations["slurm-job.vk.io/gres"]; ok {
+		if !gresRegex.MatchString(gres) {
+			return "", fmt.Errorf("%w: invalid generic resources %s", errInvalidScript, strconv.Quote(gres))
+		}
+		return gres, nil
+	}
+	if _, ok := metadata.Annotations["slurm-job.vk.io/gpu-sharing"]; ok {
+		return "", nil
+	}
+
+	resourceNames := []v1.ResourceName{"nvidia.com/gpu"}
+	if config.GPUResourceName != "" && config.GPUResourceName != "nvidia.com/gpu" {
+		resourceNames = append(resourceNames, v1.ResourceName(config.GPUResourceName))
+	}
+
+	var gpus int64
+	for _, container := range podSpec.Containers {
+		for _, resourceName := range resourceNames {
+			if gpu, ok := container.Resources.Limits[resourceName]; ok {
+				gpus += gpu.Value()
+			}
+		}
+	}
+	if gpus == 0 {
+		return "", nil
+	}
+	return "gpu:" + strconv.FormatInt(gpus, 10), nil
+}
+
+// podQOSClass computes the Kubernetes QoS class of a Pod from its containers resources:
+// BestEffort when no container sets any CPU/memory request or limit, Guaranteed when every
+// container sets CPU and memory limits with requests equal to them (or unset), Burstable otherwise.
+func podQOSClass(podSpec v1.PodSpec) v1.PodQOSClass {
+	containers := append([]v1.Container{}, podSpec.InitContainers...)
+	containers = append(containers, podSpec.Containers...)
+
+	bestEffort := true
+	guaranteed := true
+	for _, container := range containers {
+		for _, resourceName := range []v1.ResourceName{v1.ResourceCPU, v1.ResourceMemory} {
+			request, hasRequest := container.Resources.Requests[resourceName]
+			limit, hasLimit := container.Resources.Limits[resourceName]
+			if hasRequest || hasLimit {
+				bestEffort = false
+			}
+			if !hasLimit || (hasRequest && request.Cmp(limit) != 0) {
+				guaranteed = false
+			}
+		}
+	}
+
+	switch {
+	case bestEffort:
+		return v1.PodQOSBestEffort
+	case guaranteed:
+		return v1.PodQOSGuaranteed
+	default:
+		return v1.PodQOSBurstable
+	}
+}
+
+// qosNameRegex matches the QOS names that can be safely written to the job script.
+var qosNameRegex = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// resolveQOS returns the Slurm QOS set through the slurm-job.vk.io/qos annotation, the one mapped to
+// the Pod QoS class through config.QOSClassMapping or config.DefaultQOS, in this order of precedence.
+// A QOS explicitly set through the flags annotation wins.
+func resolveQOS(sbatchFlags []string, metadata metav1.ObjectMeta, podSpec v1.PodSpec, config commonIL.InterLinkConfig) (string, error) {
+	if hasSbatchFlag(sbatchFlags, "--qos", "-q") {
+		return "", nil
+	}
+	qos, ok := metadata.Annotations["slurm-job.vk.io/qos"]
+	if !ok {
+		qos, ok = config.QOSClassMapping[string(podQOSClass(podSpec))]
+	}
+	if !ok {
+		qos = config.DefaultQOS
+	}
+	if qos != "" && !qosNameRegex.MatchString(qos) {
+		return "", errors.New("invalid QOS name " + strconv.Quote(qos))
+	}
+	return qos, nil
+}
+
+// srunPath returns the configured srun binary, falling back to the one in PATH.
+func srunPath(config commonIL.InterLinkConfig) string {
+	if config.Srunpath != "" {
+		return config.Srunpath
+	}
+	return "srun"
+}
+
+// scontrolPath returns the configured scontrol binary, falling back to the one in PATH.
+func scontrolPath(config commonIL.InterLinkConfig) string {
+	if config.Scontrolpath != "" {
+		return config.Scontrolpath
+	}
+	return "scontrol"
+}
+
+// seffPath returns the configured seff binary, falling back to the one in PATH.
+func seffPath(config commonIL.InterLinkConfig) string {
+	if config.Seffpath != "" {
+		return config.Seffpath
+	}
+	return "seff"
+}
+
+// seffEfficiencyRegex matches the "CPU Efficiency: 45.30% of ..." and "Memory Efficiency: ..." lines printed by seff.
+var seffEfficiencyRegex = regexp.MustCompile(`(?m)^\s*(CPU|Memory) Efficiency:\s+([0-9.]+)%`)
+
+// jobEfficiency runs seff on an ended job and returns its CPU and memory efficiency as Pod annotations.
+func jobEfficiency(jid string, config commonIL.InterLinkConfig, Ctx context.Context) (map[string]string, error) {
+	output, err := commandOutput(Ctx, config, seffPath(config), jid)
+	if err != nil {
+		return nil, err
+	}
+	efficiency := make(map[string]string)
+	for _, match := range seffEfficiencyRegex.FindAllStringSubmatch(string(output), -1) {
+		efficiency["slurm-job.vk.io/"+strings.ToLower(match[1])+"-efficiency"] = match[2] + "%"
+	}
+	if len(efficiency) == 0 {
+		return nil, errors.New("no efficiency found in seff output")
+	}
+	return efficiency, nil
+}
+
+// attachEfficiency adds the efficiency of the job to the status of a Pod which reached a terminal
+// phase, if config.JobEfficiency is set. seff is only run once per job, the result being kept in jid.
+func (h *SidecarHandler) attachEfficiency(podStatus *commonIL.PodStatus, jid *JidStruct) {
+	if !h.Config.JobEfficiency || (podStatus.Phase != v1.PodSucceeded && podStatus.Phase != v1.PodFailed) {
+		return
+	}
+	if jid.Efficiency == nil {
+		efficiency, err := jobEfficiency(jid.JID, h.Config, h.Ctx)
+		if err != nil {
+			log.G(h.Ctx).Warning("Unable to retrieve the efficiency of Job " + jid.JID + ": " + err.Error())
+			return
+		}
+		jid.Efficiency = efficiency
+		h.markJIDsDirty()
+	}
+	if podStatus.Annotations == nil {
+		podStatus.Annotations = make(map[string]string)
+	}
+	for key, value := range jid.Efficiency {
+		podStatus.Annotations[key] = value
+	}
+}
+
+// sinfoPath returns the configured sinfo binary, falling back to the one in PATH.
+func sinfoPath(config commonIL.InterLinkConfig) string {
+	if config.Sinfopath != "" {
+		return config.Sinfopath
+	}
+	return "sinfo"
+}
+
+// nodeCapacity holds the resources of the largest node of a partition.
+type nodeCapacity struct {
+	cpus     int64
+	memoryMB int64
+	gpus     int64
+}
+
+// partitionCapacity queries sinfo for the largest CPU count, memory and GPU count available on a
+// single node of the partition, or of the whole cluster if the partition is empty.
+func partitionCapacity(partition string, config commonIL.InterLinkConfig, Ctx context.Context) (nodeCapacity, error) {
+	args := []string{"--noheader", "-o", "%c %m %G"}
+	if partition != "" {
+		args = append(args, "-p", partition)
+	}
+	output, err := commandOutput(Ctx, config, sinfoPath(config), args...)
+	if err != nil {
+		return nodeCapacity{}, err
+	}
+	return parseSinfoCapacity(string(output))
+}
+
+// parseSinfoCapacity parses the "%c %m %G" output of sinfo, e.g. "64 257000 gpu:a100:4(S:0-1)".
+func parseSinfoCapacity(output string) (nodeCapacity, error) {
+	var capacity nodeCapacity
+	found := false
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		cpus, err := strconv.ParseInt(strings.TrimSuffix(fields[0], "+"), 10, 64)
+		if err != nil {
+			continue
+		}
+		memoryMB, err := strconv.ParseInt(strings.TrimSuffix(fields[1], "+"), 10, 64)
+		if err != nil {
+			continue
+		}
+		found = true
+		capacity.cpus = max(capacity.cpus, cpus)
+		capacity.memoryMB = max(capacity.memoryMB, memoryMB)
+		if len(fields) > 2 {
+			for _, gres := range strings.Split(fields[2], ",") {
+				gres = strings.SplitN(gres, "(", 2)[0]
+				if !strings.HasPrefix(gres, "gpu") {
+					continue
+				}
+				parts := strings.Split(gres, ":")
+				if gpus, err := strconv.ParseInt(parts[len(parts)-1], 10, 64); err == nil {
+					capacity.gpus = max(capacity.gpus, gpus)
+				}
+			}
+		}
+	}
+	if !found {
+		return capacity, errors.New("no nodes found in sinfo output")
+	}
+	return capacity, nil
+}
+
+// checkResources rejects Pods requesting more CPUs, memory or GPUs than the largest node of the target
+// partition provides, since Slurm would accept the job and leave it pending forever. It does nothing
+// unless config.ResourcePreflight is set, and lets the Pod through if sinfo can't be queried.
+func checkResources(metadata metav1.ObjectMeta, podSpec v1.PodSpec, config commonIL.InterLinkConfig, Ctx context.Context) error {
+	if !config.ResourcePreflight {
+		return nil
+	}
+
+	var sbatchFlags []string
+	if slurmFlags, ok := metadata.Annotations["slurm-job.vk.io/flags"]; ok {
+		sbatchFlags = splitFlags(slurmFlags)
+	}
+	partition := resolvePartition(sbatchFlags)
+	if partition == "" {
+		var err error
+		partition, err = requestedPartition(metadata, podSpec, config)
+		if err != nil {
+			return err
+		}
+	}
+
+	capacity, err := partitionCapacity(partition, config, Ctx)
+	if err != nil {
+		log.G(Ctx).Warning("Unable to query the capacity of partition " + partition + ", skipping the resource preflight: " + err.Error())
+		return nil
+	}
+
+	milliCPU, memoryBytes := podResources(podSpec)
+	cpus := (milliCPU + 999) / 1000
+	memoryMB := (memoryBytes + 1024*1024 - 1) / (1024 * 1024)
+	gres, err := resolveGres(sbatchFlags, metadata, podSpec, config)
+	if err != nil {
+		return err
+	}
+	var gpus int64
+	if gres != "" {
+		parts := strings.Split(gres, ":")
+		gpus, _ = strconv.ParseInt(parts[len(parts)-1], 10, 64)
+	}
+
+	target := "partition " + partition
+	if partition == "" {
+		target = "the cluster"
+	}
+	switch {
+	case cpus > capacity.cpus:
+		return fmt.Errorf("the Pod requests %d CPUs, but the nodes of %s provide at most %d", cpus, target, capacity.cpus)
+	case capacity.memoryMB > 0 && memoryMB > capacity.memoryMB:
+		return fmt.Errorf("the Pod requests %dM of memory, but the nodes of %s provide at most %dM", memoryMB, target, capacity.memoryMB)
+	case gpus > capacity.gpus:
+		return fmt.Errorf("the Pod requests %d GPUs, but the nodes of %s provide at most %d", gpus, target, capacity.gpus)
+	}
+	return nil
+}
+
+// accountNameRegex matches the account names that can be safely written to the job script.
+var accountNameRegex = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// unmappedNamespaces holds the namespaces without a Slurm account already warned about, so that the
+// warning is logged once per namespace rather than for every Pod.
+var unmappedNamespaces sync.Map
+
+// resolveAccount returns the Slurm account set through the slurm-job.vk.io/account annotation, mapped
+// to the Pod namespace through config.NamespaceAccounts or config.DefaultAccount, in this order of
+// precedence. An account explicitly set through the flags annotation wins.
+func resolveAccount(sbatchFlags []string, metadata metav1.ObjectMeta, config commonIL.InterLinkConfig, Ctx context.Context) (string, error) {
+	if hasSbatchFlag(sbatchFlags, "--account", "-A") {
+		return "", nil
+	}
+	account, ok := metadata.Annotations["slurm-job.vk.io/account"]
+	if !ok {
+		account, ok = config.NamespaceAccounts[metadata.Namespace]
+	}
+	if !ok {
+		if _, warned := unmappedNamespaces.LoadOrStore(metadata.Namespace, true); !warned {
+			log.G(Ctx).Warning("--- No Slurm account mapped to namespace " + metadata.Namespace)
+		}
+		account = config.DefaultAccount
+	}
+	if account != "" && !accountNameRegex.MatchString(account) {
+		return "", errors.New("invalid account name " + strconv.Quote(account))
+	}
+	return account, nil
+}
+
+// checkAccount returns an error if config.RequireAccount is set and the Pod will be submitted without
+// any account, because its namespace isn't mapped, no default account is configured and no account
+// is set through the annotations.
+func checkAccount(metadata metav1.ObjectMeta, config commonIL.InterLinkConfig) error {
+	if !config.RequireAccount || config.DefaultAccount != "" {
+		return nil
+	}
+	if _, ok := config.NamespaceAccounts[metadata.Namespace]; ok {
+		return nil
+	}
+	if metadata.Annotations["slurm-job.vk.io/account"] != "" {
+		return nil
+	}
+	if hasSbatchFlag(splitFlags(metadata.Annotations["slurm-job.vk.io/flags"]), "--account", "-A") {
+		return nil
+	}
+	return errors.New("namespace " + metadata.Namespace + " has no associated Slurm account, while this sidecar requires one")
+}
+
+// resolveTimeLimit returns the value for the #SBATCH --time directive. A time limit explicitly set
+// through the flags annotation always wins, so an empty string is returned to avoid duplicating it.
+// Otherwise the pod's activeDeadlineSeconds is used, falling back to config.DefaultTimeLimit.
+func resolveTimeLimit(sbatchFlags []string, podSpec v1.PodSpec, config commonIL.InterLinkConfig) string {
+	if hasSbatchFlag(sbatchFlags, "--time", "-t") {
+		return ""
+	}
+
+	if podSpec.ActiveDeadlineSeconds != nil && *podSpec.ActiveDeadlineSeconds > 0 {
+		return formatSlurmTime(*podSpec.ActiveDeadlineSeconds)
+	}
+
+	return config.DefaultTimeLimit
+}
+
+// formatSlurmTime converts a duration in seconds to the days-hours:minutes:seconds format understood by Slurm.
+func formatSlurmTime(seconds int64) string {
+	days := seconds / 86400
+	hours := (seconds % 86400) / 3600
+	minutes := (seconds % 3600) / 60
+	secs := seconds % 60
+	return fmt.Sprintf("%d-%02d:%02d:%02d", days, hours, minutes, secs)
+}
+
+// gpuSharingDirectives returns the sbatch flags, script prefix and script postfix needed to run the
+// job with a fractional GPU. "mps" starts an MPS control daemon for the duration of the job, while
+// any other value is interpreted as a MIG profile requested through --gres. The requested mode must
+// be listed in config.GPUSharingProfiles.
+func gpuSharingDirectives(mode string, path string, config commonIL.InterLinkConfig) (string, string, string, error) {
+	allowed := false
+	for _, profile := range config.GPUSharingProfiles {
+		if mode == profile {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return "", "", "", errors.New("GPU sharing mode " + mode + " is not supported by this sidecar")
+	}
+
+	if mode == "mps" {
+		prefix := "\nexport CUDA_MPS_PIPE_DIRECTORY=" + path + "/mps-pipe" +
+			"\nexport CUDA_MPS_LOG_DIRECTORY=" + path + "/mps-log" +
+			"\nmkdir -p $CUDA_MPS_PIPE_DIRECTORY $CUDA_MPS_LOG_DIRECTORY" +
+			"\nnvidia-cuda-mps-control -d"
+		postfix := "\nwait\necho quit | nvidia-cuda-mps-control"
+		return "\n#SBATCH --gres=gpu:1", prefix, postfix, nil
+	}
+
+	return "\n#SBATCH --gres=gpu:" + mode + ":1", "", "", nil
+}
+
+// defaultJobShells are the interpreters the job.vk.io/shell annotation may select when
+// config.AllowedShells is not set.
+var defaultJobShells = []string{"/bin/bash", "/usr/bin/bash", "/bin/sh", "/usr/bin/sh"}
+
+// jobShell returns the interpreter of the job script, config.BashPath unless the job.vk.io/shell
+// annotation selects another one, which must be listed in config.AllowedShells, or in
+// defaultJobShells if not set. Shells other than bash are refused when config.CombinedOutput or
+// config.Tsocks is set, since the script then relies on bash only syntax.
+func jobShell(metadata metav1.ObjectMeta, config commonIL.InterLinkConfig) (string, error) {
+	shell, ok := metadata.Annotations["job.vk.io/shell"]
+	if !ok || shell == config.BashPath {
+		return config.BashPath, nil
+	}
+	allowedShells := config.AllowedShells
+	if len(allowedShells) == 0 {
+		allowedShells = defaultJobShells
+	}
+	for _, allowedShell := range allowedShells {
+		if shell != allowedShell {
+			continue
+		}
+		if filepath.Base(shell) != "bash" && (config.CombinedOutput || config.Tsocks) {
+			return "", errors.New("shell " + shell + " requested through the job.vk.io/shell annotation is not bash, which CombinedOutput and Tsocks require")
+		}
+		return shell, nil
+	}
+	return "", errors.New("shell " + shell + " requested through the job.vk.io/shell annotation is not one of " + strings.Join(allowedShells, ", "))
+}
+
+// outputRedirect returns the redirection of the output of a container: stdout to <container>.out and
+// stderr to <container>.err or, if config.CombinedOutput is set, both of them to <container>.out.
+func outputRedirect(path string, containerName string, config commonIL.InterLinkConfig) string {
+	if config.CombinedOutput {
+		return " &> " + path + "/" + containerName + ".out"
+	}
+	return " > " + path + "/" + containerName + ".out 2> " + path + "/" + containerName + ".err"
+}
+
+// produceMultiProgConfig writes a wrapper script for every container and a srun --multi-prog
+// configuration file assigning each wrapper to its own rank, so that all the containers of
+// the pod are co-scheduled and share the lifecycle of a single job step.
+func produceMultiProgConfig(path string, commands []SingularityCommand, config commonIL.InterLinkConfig, Ctx context.Context) (string, error) {
+	multiProgConfig := ""
+
+	for rank, singularityCommand := range commands {
+		wrapperPath := path + "/" + singularityCommand.containerName + ".sh"
+		wrapper := "#!" + config.BashPath +
+			"\n" + strings.Join(singularityCommand.command[:], " ") +
+			outputRedirect(path, singularityCommand.containerName, config) + " &" +
+			"\npid=$!" +
+			"\necho $pid > " + path + "/" + singularityCommand.containerName + ".pid" +
+			"\nwait $pid" +
+			"\necho $? > " + path + "/" + singularityCommand.containerName + ".status\n"
+
+		err := os.WriteFile(wrapperPath, []byte(wrapper), 0774)
+		if err != nil {
+			log.G(Ctx).Error("Unable to write wrapper script " + wrapperPath)
+			return "", err
+		}
+		log.G(Ctx).Debug("--- Written wrapper script " + wrapperPath)
+
+		multiProgConfig += strconv.Itoa(rank) + " " + config.BashPath + " " + wrapperPath + "\n"
+	}
+
+	multiProgPath := path + "/multi-prog.conf"
+	err := os.WriteFile(multiProgPath, []byte(multiProgConfig), 0644)
+	if err != nil {
+		log.G(Ctx).Error("Unable to write multi-prog config " + multiProgPath)
+		return "", err
+	}
+	log.G(Ctx).Debug("--- Written multi-prog config " + multiProgPath)
+
+	return multiProgPath, nil
+}
+
+// transientSbatchErrors lists the sbatch error messages caused by an overloaded or unreachable
+// controller, after which the submission is worth retrying.
+var transientSbatchErrors = []string{
+	"socket timed out on send/recv operation",
+	"unable to contact slurm controller",
+	"slurm temporarily unable to accept job",
+	"resource temporarily unavailable",
+	"zero bytes were transmitted or received",
+}
+
+// queueFullSbatchErrors lists the sbatch error messages caused by the submission quota of the user or
+// of the account being exhausted: retrying is pointless until some of the queued jobs end.
+var queueFullSbatchErrors = []string{
+	"qosmaxsubmitjobperuserlimit",
+	"qosmaxsubmitjobperaccountlimit",
+	"assocmaxsubmitjoblimit",
+	"job violates accounting/qos policy (job submit limit",
+}
+
+// errQueueFull is returned by SLURMBatchSubmit when sbatch refused the job because the submission
+// quota is exhausted.
+var errQueueFull = errors.New("QueueFull")
+
+// queueFullEvents counts the submissions refused because of an exhausted quota, exposed through /debug/vars.
+var queueFullEvents = expvar.NewInt("slurm_queue_full_events")
+
+func isQueueFullSbatchError(stderr string) bool {
+	stderr = strings.ToLower(stderr)
+	for _, pattern := range queueFullSbatchErrors {
+		if strings.Contains(stderr, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+func isTransientSbatchError(stderr string) bool {
+	stderr = strings.ToLower(stderr)
+	for _, pattern := range transientSbatchErrors {
+		if strings.Contains(stderr, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// errCommandTimeout is returned when a Slurm command doesn't complete within config.CommandTimeout.
+var errCommandTimeout = errors.New("command timed out")
+
+// commandTimeout returns config.CommandTimeout, 30 seconds by default.
+func commandTimeout(config commonIL.InterLinkConfig) time.Duration {
+	if config.CommandTimeout != "" {
+		if timeout, err := time.ParseDuration(config.CommandTimeout); err == nil && timeout > 0 {
+			return timeout
+		}
+	}
+	return 30 * time.Second
+}
+
+// commandContext returns a context expiring after commandTimeout, for the Slurm commands not to hang
+// the handlers when the controller is unreachable.
+func commandContext(Ctx context.Context, config commonIL.InterLinkConfig) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(Ctx, commandTimeout(config))
+}
+
+// timeoutError wraps errCommandTimeout if the command was killed because ctx expired, and returns err otherwise.
+func timeoutError(ctx context.Context, command string, config commonIL.InterLinkConfig, err error) error {
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("%w: %s was killed after %s", errCommandTimeout, command, commandTimeout(config))
+	}
+	return err
+}
+
+// commandOutput runs the command and returns its standard output, as exec.Cmd.Output does, killing it
+// once config.CommandTimeout expired, in which case an error wrapping errCommandTimeout is returned.
+func commandOutput(Ctx context.Context, config commonIL.InterLinkConfig, name string, args ...string) ([]byte, error) {
+	ctx, cancel := commandContext(Ctx, config)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.WaitDelay = time.Second
+	output, err := cmd.Output()
+	return output, timeoutError(ctx, name, config, err)
+}
+
+// executeWithTimeout runs the task as ExecTask.Execute does, killing it once config.CommandTimeout
+// expired, in which case an error wrapping errCommandTimeout is returned.
+func executeWithTimeout(Ctx context.Context, task exec2.ExecTask, config commonIL.InterLinkConfig) (exec2.ExecResult, error) {
+	ctx, cancel := commandContext(Ctx, config)
+	defer cancel()
+
+	var cmd *exec.Cmd
+	if task.Shell {
+		// exec replaces the shell, so that the command itself is killed
+		cmd = exec.CommandContext(ctx, "/bin/bash", "-c", "exec "+strings.TrimSpace(task.Command+" "+strings.Join(task.Args, " ")))
+	} else {
+		cmd = exec.CommandContext(ctx, task.Command, task.Args...)
+	}
+	cmd.WaitDelay = time.Second
+	var stdout, stderr strings.Builder
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	err := timeoutError(ctx, task.Command, config, cmd.Run())
+	result := exec2.ExecResult{Stdout: stdout.String(), Stderr: stderr.String()}
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			// like Execute, a failing command is reported through its exit code and stderr
+			result.ExitCode = exitErr.ExitCode()
+			return result, nil
+		}
+		return result, err
+	}
+	return result, nil
+}
+
+// SLURMBatchSubmit submits the job script through sbatch. Submissions failing because of a transient
+// controller error are retried up to config.SbatchMaxAttempts times (3 by default), with an exponential
+// backoff starting from config.SbatchRetryDelay (1s by default). Submissions refused because the queue
+// is full are not retried and an error wrapping errQueueFull is returned, as are the ones which timed out,
+// with an error wrapping errCommandTimeout.
+func SLURMBatchSubmit(path string, config commonIL.InterLinkConfig, Ctx context.Context) (string, error) {
+	maxAttempts := config.SbatchMaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = 3
+	}
+	delay := time.Second
+	if config.SbatchRetryDelay != "" {
+		if configured, err := time.ParseDuration(config.SbatchRetryDelay); err == nil {
+			delay = configured
+		}
+	}
+
+	for attempt := 1; ; attempt++ {
+		log.G(Ctx).Info("- Submitting Slurm job (attempt " + strconv.Itoa(attempt) + "/" + strconv.Itoa(maxAttempts) + ")")
+		cmd := []string{path}
+		shell := exec2.ExecTask{
+			Command: config.Sbatchpath,
+			Args:    cmd,
+			Shell:   true,
+		}
+
+		sbatchStart := time.Now()
+		execReturn, err := executeWithTimeout(Ctx, shell, config)
+		observeCommand("sbatch", sbatchStart)
+		if errors.Is(err, errCommandTimeout) {
+			// the job may have been queued anyway, it is not submitted again
+			log.G(Ctx).Error("sbatch didn't complete in time: " + err.Error())
+			return "", err
+		}
+		if err != nil {
+			log.G(Ctx).Error("Unable to create file " + path)
+			return "", err
+		}
+
+		if execReturn.Stderr != "" {
+			if parseJID(execReturn.Stdout) == "" {
+				if isQueueFullSbatchError(execReturn.Stderr) {
+					queueFullEvents.Add(1)
+					log.G(Ctx).Warning("sbatch refused the job, the submission quota is exhausted: " + execReturn.Stderr)
+					return "", fmt.Errorf("%w: %s", errQueueFull, strings.TrimSpace(execReturn.Stderr))
+				}
+				if isTransientSbatchError(execReturn.Stderr) && attempt < maxAttempts {
+					log.G(Ctx).Warning("sbatch failed with a transient error, retrying in " + delay.String() + ": " + execReturn.Stderr)
+					select {
+					case <-time.After(delay):
+					case <-Ctx.Done():
+						return "", Ctx.Err()
+					}
+					delay *= 2
+					continue
+				}
+				log.G(Ctx).Error("Could not run sbatch: " + execReturn.Stderr)
+				return "", errors.New(execReturn.Stderr)
+			}
+			log.G(Ctx).Warning("sbatch printed warnings: " + execReturn.Stderr)
+		}
+		log.G(Ctx).Debug("Job submitted")
+		return string(execReturn.Stdout), nil
+	}
+}
+
+// parseJID looks for the "Submitted batch job N" line in the sbatch output, line by line, so that
+// banners or warnings printed by the site configuration don't interfere. It returns an empty
+// string if no job ID could be found.
+func parseJID(output string) string {
+	r := regexp.MustCompile(`^\s*Submitted batch job (?P<jid>\d+)\s*$`)
+	for _, line := range strings.Split(output, "\n") {
+		if jid := r.FindStringSubmatch(line); len(jid) == 2 {
+			return jid[1]
+		}
+	}
+	return ""
+}
+
+// recoverSubmittedJob looks for the job of a Pod in squeue by its name, which is the Pod UID, for
+// the submissions whose sbatch timed out after the controller accepted the job. An empty job ID is
+// returned if no job is listed.
+func recoverSubmittedJob(podUID string, config commonIL.InterLinkConfig, Ctx context.Context) (string, error) {
+	shell := exec2.ExecTask{
+		Command: config.Squeuepath,
+		Args:    []string{"--noheader", "-a", "--name=" + podUID, "-o", "%A"},
+		Shell:   true,
+	}
+	execReturn, err := executeWithTimeout(Ctx, shell, config)
+	if err != nil {
+		return "", err
+	}
+	if execReturn.Stderr != "" {
+		return "", errors.New(strings.TrimSpace(execReturn.Stderr))
+	}
+	jid := ""
+	for _, line := range strings.Split(execReturn.Stdout, "\n") {
+		// the latest submission wins, should sbatch have been run more than once
+		if line = strings.TrimSpace(line); line != "" && (len(line) > len(jid) || (len(line) == len(jid) && line > jid)) {
+			jid = line
+		}
+	}
+	return jid, nil
+}
+
+// errDependencyNotSubmitted is returned when a Pod depends on another one whose job is not known yet.
+var errDependencyNotSubmitted = errors.New("dependency not submitted yet")
+
+// failedPods returns the UIDs of the pods whose last reported status is Failed.
+func (h *SidecarHandler) failedPods() map[string]bool {
+	h.statusMutex.Lock()
+	defer h.statusMutex.Unlock()
+	failed := make(map[string]bool)
+	for uid, entry := range h.statusCache {
+		if entry.status.Phase == v1.PodFailed {
+			failed[uid] = true
+		}
+	}
+	return failed
+}
+
+// resolveDependencies returns the JIDs of the jobs the Pod depends on through the slurm-job.vk.io/depends-on
+// annotation, which holds a Pod UID or a label selector matching Pods of the same namespace. The jobs of
+// the failed pods are skipped, as an afterok dependency on them would never be satisfied.
+// errDependencyNotSubmitted is returned if no job matches yet, so that the submission can be retried later.
+func resolveDependencies(metadata metav1.ObjectMeta, JIDs *map[string]*JidStruct, failed map[string]bool) ([]string, error) {
+	dependsOn, ok := metadata.Annotations["slurm-job.vk.io/depends-on"]
+	if !ok || strings.TrimSpace(dependsOn) == "" {
+		return nil, nil
+	}
+	dependsOn = strings.TrimSpace(dependsOn)
+
+	if jid, ok := (*JIDs)[dependsOn]; ok && jid.Namespace == metadata.Namespace {
+		if failed[dependsOn] {
+			return nil, errors.New("the job of Pod " + dependsOn + " failed")
+		}
+		return []string{jid.JID}, nil
+	}
+
+	selector, err := labels.Parse(dependsOn)
+	if err != nil {
+		return nil, errors.New("invalid slurm-job.vk.io/depends-on annotation " + strconv.Quote(dependsOn) + ": " + err.Error())
+	}
+	var dependencies []string
+	skipped := 0
+	for _, jid := range *JIDs {
+		if jid.Namespace == metadata.Namespace && jid.PodUID != string(metadata.UID) && selector.Matches(labels.Set(jid.Labels)) {
+			if failed[jid.PodUID] {
+				skipped++
+				continue
+			}
+			dependencies = append(dependencies, jid.JID)
+		}
+	}
+	if len(dependencies) == 0 {
+		if skipped > 0 {
+			return nil, errors.New("the jobs of all the " + strconv.Itoa(skipped) + " Pods matching " + dependsOn + " failed")
+		}
+		return nil, fmt.Errorf("%w: no job matches %s", errDependencyNotSubmitted, dependsOn)
+	}
+	sort.Strings(dependencies)
+	return dependencies, nil
+}
+
+// writeJIDFile writes the JobID.jid file of a Pod working directory through a temporary file, so that
+// it is never found truncated.
+func writeJIDFile(path string, jid string) error {
+	err := os.WriteFile(path+"/JobID.jid.tmp", []byte(jid), 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(path+"/JobID.jid.tmp", path+"/JobID.jid")
+}
+
+// handleJID tracks the job submitted for a Pod. The timestamps of an entry already tracking the same
+// job, e.g. loaded from disk, are preserved.
+func (h *SidecarHandler) handleJID(podUID string, output string, pod v1.Pod, path string) error {
+	jid := parseJID(output)
+	if jid == "" {
+		return errors.New("unable to find the job ID in sbatch output: " + strconv.Quote(output))
+	}
+	err := writeJIDFile(path, jid)
+	if err != nil {
+		log.G(h.Ctx).Error("Can't create jid_file")
+		return err
+	}
+
+	var containerNames []string
+	for _, container := range pod.Spec.Containers {
+		containerNames = append(containerNames, container.Name)
+	}
+	jidStruct := &JidStruct{PodUID: string(pod.UID), JID: jid, Namespace: pod.Namespace, Labels: pod.Labels, ContainerNames: containerNames, LastSeen: time.Now()}
+	if existing, ok := (*h.JIDs)[podUID]; ok {
+		// a Pod submitted again keeps the timestamps recorded so far, e.g. loaded from the index
+		jidStruct.StartTime = existing.StartTime
+		jidStruct.EndTime = existing.EndTime
+	}
+	(*h.JIDs)[podUID] = jidStruct
+	h.markJIDsDirty()
+	log.G(h.Ctx).Info("Job ID is: " + (*h.JIDs)[podUID].JID)
+	return nil
+}
+
+const timestampFormat = "2006-01-02 15:04:05.999999999 -0700 MST"
+
+// submittedSentinel is written in the working directory of a Pod once its submission fully
+// completed, so that a working directory without it belongs to a Pod still being submitted.
+const submittedSentinel = "submitted.ok"
+
+// markSubmitted records the submission time of a job, both in memory and as the sentinel file.
+func (h *SidecarHandler) markSubmitted(jid *JidStruct, path string, submittedAt time.Time) error {
+	jid.SubmittedAt = submittedAt
+	h.markJIDsDirty()
+	return os.WriteFile(path+"/"+submittedSentinel, []byte(submittedAt.Format(timestampFormat)), 0644)
+}
+
+// submitting reports whether the Pod working directory exists but its submission didn't complete yet.
+func submitting(path string) bool {
+	if _, err := os.Stat(path); err != nil {
+		return false
+	}
+	_, err := os.Stat(path + "/" + submittedSentinel)
+	return os.IsNotExist(err)
+}
+
+// untrackedPodStatus builds the status of a Pod without a tracked job. A Pod whose submission is
+// in progress is reported as Pending, any other as waiting for a job which can't be found.
+func untrackedPodStatus(pod *v1.Pod, path string) commonIL.PodStatus {
+	if submitting(path) {
+		return newPodStatus(pod, nil, waitingContainerStatuses(pod, nil, "ContainerCreating", "the Slurm job of pod "+pod.Name+" is being submitted"))
+	}
+	return newPodStatus(pod, nil, waitingContainerStatuses(pod, nil, "JobNotFound", "no Slurm job is tracked for pod "+pod.Name))
+}
+
+// restartable reports whether the failed job of a Pod has to be resubmitted, i.e. the Pod restartPolicy
+// is OnFailure and the job has been restarted less than config.MaxRestarts times (3 by default).
+// Job arrays are never resubmitted, since their tasks fail on their own, and neither are the jobs
+// which hit their time limit or have been cancelled, since running them again would end the same way,
+// nor the ones of Pods being deleted.
+func restartable(pod *v1.Pod, jid *JidStruct, podStatus commonIL.PodStatus, config commonIL.InterLinkConfig) bool {
+	if pod.Spec.RestartPolicy != v1.RestartPolicyOnFailure || podStatus.Phase != v1.PodFailed || jid.ArrayJob || !jid.CancelAt.IsZero() {
+		return false
+	}
+	for _, containerStatus := range podStatus.Containers {
+		if terminated := containerStatus.State.Terminated; terminated != nil && (terminated.Reason == "DeadlineExceeded" || terminated.Reason == "Cancelled") {
+			return false
+		}
+	}
+	maxRestarts := config.MaxRestarts
+	if maxRestarts <= 0 {
+		maxRestarts = 3
+	}
+	return jid.Restarts < maxRestarts
+}
+
+// restartJob submits again the job script of a Pod and tracks the new job in place of failedJID.
+// The files left by the previous run are removed first, so that they are not mistaken for the ones
+// of the new run. It runs without holding statusMutex or jidsMutex while sbatch is called, and
+// clears the restarting flag of the Pod once done. A failed resubmission still counts as a restart,
+// so the Pod is eventually reported as failed.
+func (h *SidecarHandler) restartJob(pod *v1.Pod, failedJID string) {
+	uid := string(pod.UID)
+	path := h.Config.DataRootFolder + pod.Namespace + "-" + uid
+	defer func() {
+		h.statusMutex.Lock()
+		delete(h.restarting, uid)
+		// the next request reads the status of the new job rather than the one of the failed run
+		delete(h.statusCache, uid)
+		h.statusMutex.Unlock()
+		if err := h.flushJIDs(); err != nil {
+			log.G(h.Ctx).Warning(err)
+		}
+	}()
+
+	for _, containers := range [][]v1.Container{pod.Spec.InitContainers, pod.Spec.Containers} {
+		for _, ct := range containers {
+			for _, suffix := range []string{".out", ".err", ".status", ".pid", ".pull"} {
+				os.Remove(path + "/" + ct.Name + suffix)
+			}
+		}
+	}
+	os.Remove(path + "/StartedAt.time")
+	os.Remove(path + "/FinishedAt.time")
+
+	newJID := ""
+	out, err := SLURMBatchSubmit(path+"/job.sh", h.Config, h.Ctx)
+	if err == nil {
+		newJID = parseJID(out)
+		if newJID == "" {
+			err = errors.New("unable to find the job ID in sbatch output: " + strconv.Quote(out))
+		}
+	}
+	if err == nil {
+		err = writeJIDFile(path, newJID)
+	}
+
+	h.jidsMutex.Lock()
+	defer h.jidsMutex.Unlock()
+	jid, ok := (*h.JIDs)[uid]
+	if !ok || jid.JID != failedJID {
+		// the Pod has been deleted or resubmitted in the meantime
+		if newJID != "" {
+			log.G(h.Ctx).Info("Pod " + pod.Name + " changed while restarting its job, cancelling Job " + newJID)
+			if err := cancelJob(newJID, h.Config, h.Ctx); err != nil {
+				log.G(h.Ctx).Warning(err)
+			}
+		}
+		return
+	}
+	jid.Restarts++
+	h.markJIDsDirty()
+	if err != nil {
+		log.G(h.Ctx).Warning("Unable to restart Job " + failedJID + " of pod " + pod.Name + ": " + err.Error())
+		return
+	}
+
+	log.G(h.Ctx).Info("Job " + failedJID + " of pod " + pod.Name + " failed, resubmitted as " + newJID)
+	jid.JID = newJID
+	jid.StartTime = time.Time{}
+	jid.EndTime = time.Time{}
+	jid.Containers = nil
+	jid.NodeName = ""
+	jid.HostIP = ""
+	jid.Efficiency = nil
+}
+
+// setJobStartTime records the time a job has been first seen running, both in memory and on disk.
+func (h *SidecarHandler) setJobStartTime(jid *JidStruct, path string, startTime time.Time) error {
+	if !jid.StartTime.IsZero() {
+		return nil
+	}
+	jid.StartTime = startTime
+	h.markJIDsDirty()
+	return os.WriteFile(path+"/StartedAt.time", []byte(startTime.Format(timestampFormat)), 0644)
+}
+
+// setJobEndTime records the time a job has been first seen terminated, both in memory and on disk.
+func (h *SidecarHandler) setJobEndTime(jid *JidStruct, path string, endTime time.Time) error {
+	if !jid.EndTime.IsZero() {
+		return nil
+	}
+	jid.EndTime = endTime
+	h.markJIDsDirty()
+	return os.WriteFile(path+"/FinishedAt.time", []byte(endTime.Format(timestampFormat)), 0644)
+}
+
+// readContainerStatus reads the .status file of a container. finished is false when the file
+// doesn't exist yet or is still empty.
+func readContainerStatus(path string, containerName string) (exitCode int32, reason string, message string, finished bool) {
+	statusb, err := os.ReadFile(path + "/" + containerName + ".status")
+	if err != nil {
+		return 0, "", "", false
+	}
+	return parseExitStatus(string(statusb))
+}
+
+// terminatedContainerStatuses builds the status of every container of a Pod whose job ended. Each
+// container reports the exit code found in its own .status file, or fallbackExitCode and
+// fallbackReason if missing.
+func (h *SidecarHandler) terminatedContainerStatuses(pod *v1.Pod, path string, jid *JidStruct, fallbackExitCode int32, fallbackReason string) []v1.ContainerStatus {
+	var containerStatuses []v1.ContainerStatus
+	for _, ct := range pod.Spec.Containers {
+		if !jid.submitted(ct.Name) {
+			containerStatuses = append(containerStatuses, unsubmittedContainerStatus(ct, jid))
+			continue
+		}
+		exitCode, reason, message, finished := readContainerStatus(path, ct.Name)
+		if jid.ArrayJob {
+			// the tasks of a job array share the .status files, the outcome of the array is the fallback
+			finished = false
+		}
+		if !finished {
+			exitCode = fallbackExitCode
+			reason = fallbackReason
+			if fallbackReason == "" {
+				reason, message = exitCodeReason(exitCode)
+			}
+			if fallbackReason == "Cancelled" {
+				message = "Slurm job " + jid.JID + " was cancelled before the container ended"
+			}
+		} else if fallbackReason == "OOMKilled" && exitCode == oomKilledExitCode {
+			// the container itself got the SIGKILL sent when the job exceeded its memory
+			reason = fallbackReason
+			message = ""
+		} else if fallbackReason == "DeadlineExceeded" && exitCode != 0 {
+			// the container was stopped because the job hit its time limit
+			reason = fallbackReason
+			message = "Slurm job " + jid.JID + " reached its time limit, " + message
+		}
+		if reason == "OOMKilled" && message == "" {
+			message = "Slurm job " + jid.JID + " exceeded its memory limit"
+		}
+		containerStart, containerEnd := h.updateContainerTimes(path, ct.Name, jid)
+		containerStatuses = append(containerStatuses, v1.ContainerStatus{
+			Name: ct.Name,
+			State: v1.ContainerState{Terminated: &v1.ContainerStateTerminated{
+				ExitCode:   exitCode,
+				Reason:     reason,
+				Message:    message,
+				StartedAt:  metav1.Time{Time: containerStart},
+				FinishedAt: metav1.Time{Time: containerEnd},
+			}},
+			Ready: false,
+		})
+	}
+	return containerStatuses
+}
+
+// runningContainerStatuses builds the status of every container of a Pod whose job is running.
+// Containers which already wrote their .status file are reported as terminated. The annotations
+// are the ones of the Pod allowed by filterAnnotations.
+func (h *SidecarHandler) runningContainerStatuses(pod *v1.Pod, annotations map[string]string, path string, jid *JidStruct) []v1.ContainerStatus {
+	var containerStatuses []v1.ContainerStatus
+	for _, ct := range pod.Spec.Containers {
+		if !jid.submitted(ct.Name) {
+			containerStatuses = append(containerStatuses, unsubmittedContainerStatus(ct, jid))
+			continue
+		}
+		containerStart, containerEnd := h.updateContainerTimes(path, ct.Name, jid)
+		exitCode, reason, message, finished := readContainerStatus(path, ct.Name)
+		// a task of a job array ending doesn't mean the containers of the others did
+		if finished && !jid.ArrayJob {
+			containerStatuses = append(containerStatuses, v1.ContainerStatus{
+				Name: ct.Name,
+				State: v1.ContainerState{Terminated: &v1.ContainerStateTerminated{
+					ExitCode:   exitCode,
+					Reason:     reason,
+					Message:    message,
+					StartedAt:  metav1.Time{Time: containerStart},
+					FinishedAt: metav1.Time{Time: containerEnd},
+				}},
+				Ready: false,
+			})
+			continue
+		}
+		if state, message := h.imagePullProgress(path, ct.Name, jid); state != imagePullDone {
+			containerStatuses = append(containerStatuses, v1.ContainerStatus{
+				Name:  ct.Name,
+				State: v1.ContainerState{Waiting: &v1.ContainerStateWaiting{Reason: "ContainerCreating", Message: message}},
+				Ready: false,
+			})
+			continue
+		}
+		containerStatuses = append(containerStatuses, v1.ContainerStatus{
+			Name:  ct.Name,
+			State: v1.ContainerState{Running: &v1.ContainerStateRunning{StartedAt: metav1.Time{Time: containerStart}}},
+			Ready: containerReady(annotations, path, ct.Name),
+		})
+	}
+	return containerStatuses
+}
+
+// containerReady reports whether a running container is ready. The containers of a Pod with the
+// job.vk.io/readiness-file annotation, or its job.vk.io/readiness-file.<containerName> variant, are
+// only ready once that file exists, its path being relative to the Pod working directory. The
+// annotations must have been filtered through filterAnnotations.
+func containerReady(annotations map[string]string, path string, containerName string) bool {
+	readinessFile, ok := annotations["job.vk.io/readiness-file."+containerName]
+	if !ok {
+		readinessFile, ok = annotations["job.vk.io/readiness-file"]
+	}
+	if !ok {
+		return true
+	}
+	fullPath := filepath.Join(path, readinessFile)
+	if !strings.HasPrefix(fullPath, filepath.Clean(path)+string(filepath.Separator)) {
+		// the file can't live outside of the working directory
+		return false
+	}
+	_, err := os.Stat(fullPath)
+	return err == nil
+}
+
+// trackImagePulls marks the containers whose image is fetched from a registry (docker://, oras://, ...),
+// so that the pull progress is reported while the job is running.
+func (h *SidecarHandler) trackImagePulls(jid *JidStruct, containers []v1.Container) {
+	for _, container := range containers {
+		if !strings.Contains(container.Image, "://") {
+			continue
+		}
+		if jid.Containers == nil {
+			jid.Containers = make(map[string]*ContainerTimes)
+		}
+		jid.Containers[container.Name] = &ContainerTimes{ImagePull: imagePullPending}
+	}
+	h.markJIDsDirty()
+}
+
+// imagePullProgress parses the container output for the messages printed by the runtime while pulling
+// and converting the image, records the reached state in the JIDs store and returns it together with
+// a message suitable for a Waiting container status. Containers whose image pull isn't tracked are
+// always reported as done.
+func (h *SidecarHandler) imagePullProgress(path string, containerName string, jid *JidStruct) (string, string) {
+	times, ok := jid.Containers[containerName]
+	if !ok || times.ImagePull == "" || times.ImagePull == imagePullDone {
+		return imagePullDone, ""
+	}
+
+	// images cached as SIF files are pulled before the containers start, in a file of their own
+	pull, pullErr := os.ReadFile(path + "/" + containerName + ".pull")
+	output, err := os.ReadFile(path + "/" + containerName + ".out")
+	if err != nil && pullErr != nil {
+		return times.ImagePull, "Waiting for image pull to start"
+	}
+	// the runtime reports the pull progress on stderr, which may have its own file
+	if stderr, err := os.ReadFile(path + "/" + containerName + ".err"); err == nil {
+		output = append(stderr, output...)
+	}
+	output = append(pull, output...)
+
+	state := imagePullPending
+	blobs := map[string]bool{}
+	for _, line := range strings.Split(string(output), "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "":
+		case strings.Contains(line, "Getting image source signatures"):
+			state = imagePullPulling
+		case strings.HasPrefix(line, "Copying blob"):
+			state = imagePullPulling
+			fields := strings.Fields(line)
+			if len(fields) > 2 {
+				blobs[fields[2]] = blobs[fields[2]] || strings.HasSuffix(line, "done") || strings.Contains(line, "skipped")
+			}
+		case strings.HasPrefix(line, "Copying config"), strings.HasPrefix(line, "Writing manifest"),
+			strings.Contains(line, "Converting OCI blobs to SIF format"), strings.Contains(line, "Creating SIF file"),
+			strings.Contains(line, "Extracting"):
+			state = imagePullExtracting
+		case strings.Contains(line, "Using cached"):
+			state = imagePullDone
+		case strings.Contains(line, "INFO:") || strings.Contains(line, "Storing signatures"):
+		default:
+			// anything else is printed by the container itself, so the image is ready
+			if state != imagePullPulling {
+				state = imagePullDone
+			}
+		}
+	}
+	if state == imagePullPending && len(output) > 0 && !strings.Contains(string(output), "INFO:") {
+		state = imagePullDone
+	}
+
+	if state != times.ImagePull {
+		log.G(h.Ctx).Debug("--- Image pull of container " + containerName + " is " + state)
+		times.ImagePull = state
+		h.markJIDsDirty()
+	}
+
+	switch state {
+	case imagePullPulling:
+		copied := 0
+		for _, done := range blobs {
+			if done {
+				copied++
+			}
+		}
+		if len(blobs) == 0 {
+			return state, "Pulling image"
+		}
+		return state, "Pulling image (" + strconv.Itoa(copied*100/len(blobs)) + "%)"
+	case imagePullExtracting:
+		return state, "Extracting image"
+	case imagePullPending:
+		return state, "Waiting for image pull to start"
+	}
+	return state, ""
+}
+
+// lostContainerStatuses builds the status of every container of a Pod whose working directory is
+// missing, e.g. because it was deleted by hand or the shared filesystem was remounted. While the job
+// is still known to squeue the containers are reported as Waiting, otherwise the job outcome is
+// reconciled from sacct. Both carry the Lost reason.
+func lostContainerStatuses(pod *v1.Pod, path string, jid *JidStruct, active bool, config commonIL.InterLinkConfig, Ctx context.Context) []v1.ContainerStatus {
+	message := "working directory " + path + " of Slurm job " + jid.JID + " is missing"
+	if active {
+		return waitingContainerStatuses(pod, jid, "Lost", message)
+	}
+
+	exitCode := int32(unknownExitCode)
+	finishedAt := jid.EndTime
+	if sacctInfo, err := getSacctInfo(jid.JID, config, Ctx); err == nil {
+		exitCode = sacctInfo.ExitCode
+		finishedAt = sacctInfo.End
+		message += ", job ended in state " + sacctInfo.State
+	}
+
+	var containerStatuses []v1.ContainerStatus
+	for _, ct := range pod.Spec.Containers {
+		if !jid.submitted(ct.Name) {
+			containerStatuses = append(containerStatuses, unsubmittedContainerStatus(ct, jid))
+			continue
+		}
+		containerStatuses = append(containerStatuses, v1.ContainerStatus{
+			Name: ct.Name,
+			State: v1.ContainerState{Terminated: &v1.ContainerStateTerminated{
+				ExitCode:   exitCode,
+				Reason:     "Lost",
+				Message:    message,
+				StartedAt:  metav1.Time{Time: jid.StartTime},
+				FinishedAt: metav1.Time{Time: finishedAt},
+			}},
+			Ready: false,
+		})
+	}
+	return containerStatuses
+}
+
+// newPodStatus builds the status of a Pod from the status of its containers. jid is nil for the
+// Pods without a tracked job.
+func newPodStatus(pod *v1.Pod, jid *JidStruct, containerStatuses []v1.ContainerStatus) commonIL.PodStatus {
+	podStatus := commonIL.PodStatus{
+		PodName:      pod.Name,
+		PodUID:       string(pod.UID),
+		PodNamespace: pod.Namespace,
+		Phase:        podPhase(containerStatuses),
+		Containers:   containerStatuses,
+	}
+	if jid != nil {
+		podStatus.NodeName = jid.NodeName
+		// containers share the network namespace of the node they run on
+		podStatus.HostIP = jid.HostIP
+		podStatus.PodIP = jid.HostIP
+		for i := range podStatus.Containers {
+			podStatus.Containers[i].RestartCount = int32(jid.Restarts)
+		}
+	}
+	return podStatus
+}
+
+// podPhase aggregates the state of the containers into the Pod phase: once all of them terminated the
+// Pod is Succeeded if every exit code is zero and Failed otherwise, whatever the state of the job.
+func podPhase(containerStatuses []v1.ContainerStatus) v1.PodPhase {
+	if len(containerStatuses) == 0 {
+		return v1.PodPending
+	}
+	running := false
+	terminated := 0
+	failed := false
+	for _, containerStatus := range containerStatuses {
+		switch {
+		case containerStatus.State.Terminated != nil:
+			terminated++
+			failed = failed || containerStatus.State.Terminated.ExitCode != 0
+		case containerStatus.State.Running != nil:
+			running = true
+		}
+	}
+	switch {
+	case terminated == len(containerStatuses) && failed:
+		return v1.PodFailed
+	case terminated == len(containerStatuses):
+		return v1.PodSucceeded
+	case running || terminated > 0:
+		return v1.PodRunning
+	}
+	return v1.PodPending
+}
+
+// jobFailureReason returns the container reason matching the compact state of a failed job.
+func jobFailureReason(state string) string {
+	switch state {
+	case "TO", "DL":
+		return "DeadlineExceeded"
+	case "NF", "BF":
+		return "NodeFailure"
+	case "PR":
+		return "Preempted"
+	}
+	return "Error"
+}
+
+// waitingContainerStatuses builds the status of every container of a Pod whose job didn't start yet,
+// or which has no tracked job at all, in which case jid is nil.
+func waitingContainerStatuses(pod *v1.Pod, jid *JidStruct, reason string, message string) []v1.ContainerStatus {
+	var containerStatuses []v1.ContainerStatus
+	for _, ct := range pod.Spec.Containers {
+		if jid != nil && !jid.submitted(ct.Name) {
+			containerStatuses = append(containerStatuses, unsubmittedContainerStatus(ct, jid))
+			continue
+		}
+		containerStatuses = append(containerStatuses, v1.ContainerStatus{
+			Name:  ct.Name,
+			State: v1.ContainerState{Waiting: &v1.ContainerStateWaiting{Reason: reason, Message: message}},
+			Ready: false,
+		})
+	}
+	return containerStatuses
+}
+
+// updateContainerTimes records the start and finish times of a single container, derived from the
+// modification times of its .out and .status files, and returns them. The job-level timestamps are
+// returned as a fallback when the container files have not been written yet.
+func (h *SidecarHandler) updateContainerTimes(path string, containerName string, jid *JidStruct) (time.Time, time.Time) {
+	if jid.Containers == nil {
+		jid.Containers = make(map[string]*ContainerTimes)
+	}
+	times, ok := jid.Containers[containerName]
+	if !ok {
+		times = &ContainerTimes{}
+		jid.Containers[containerName] = times
+	}
+
+	if times.StartTime.IsZero() {
+		if info, err := os.Stat(path + "/" + containerName + ".out"); err == nil {
+			times.StartTime = info.ModTime()
+			h.markJIDsDirty()
+			log.G(h.Ctx).Debug("--- Container " + containerName + " started at " + times.StartTime.String())
+		}
+	}
+	if times.EndTime.IsZero() {
+		if info, err := os.Stat(path + "/" + containerName + ".status"); err == nil {
+			times.EndTime = info.ModTime()
+			h.markJIDsDirty()
+			log.G(h.Ctx).Debug("--- Container " + containerName + " finished at " + times.EndTime.String())
+		}
+	}
+
+	startTime := times.StartTime
+	if startTime.IsZero() {
+		startTime = jid.StartTime
+	}
+	endTime := times.EndTime
+	if endTime.IsZero() {
+		endTime = jid.EndTime
+	}
+	return startTime, endTime
+}
+
+// squeueColumnWidth is the fixed width requested for every squeue --Format column, so that rows can be
+// split by position and values containing spaces (e.g. pending reasons) survive intact.
+const squeueColumnWidth = 128
+
+// squeueFormat returns the lowercase squeue --Format columns used to query job states.
+// config.SqueueFormat must contain at least the JobID and State columns, while the NodeList, Reason
+// and ArrayJobID columns are always added if missing.
+func squeueFormat(config commonIL.InterLinkConfig) []string {
+	format := config.SqueueFormat
+	if format == "" {
+		format = "JobID,State"
+	}
+	var columns []string
+	hasNodeList := false
+	hasReason := false
+	hasArrayJobID := false
+	for _, column := range strings.Split(format, ",") {
+		column = strings.ToLower(strings.TrimSpace(strings.SplitN(column, ":", 2)[0]))
+		if column != "" {
+			columns = append(columns, column)
+			hasNodeList = hasNodeList || column == "nodelist"
+			hasReason = hasReason || column == "reason"
+			hasArrayJobID = hasArrayJobID || column == "arrayjobid"
+		}
+	}
+	if !hasNodeList {
+		columns = append(columns, "nodelist")
+	}
+	if !hasReason {
+		columns = append(columns, "reason")
+	}
+	if !hasArrayJobID {
+		columns = append(columns, "arrayjobid")
+	}
+	return columns
+}
+
+// squeueFormatArg builds the value for squeue --Format, forcing the width of every column.
+func squeueFormatArg(columns []string) string {
+	var format []string
+	for _, column := range columns {
+		format = append(format, column+":"+strconv.Itoa(squeueColumnWidth))
+	}
+	return strings.Join(format, ",")
+}
+
+// parseSqueueRows splits every row printed by squeue into a map keyed by lowercase column name.
+func parseSqueueRows(output string, columns []string) []map[string]string {
+	var rows []map[string]string
+	for _, line := range strings.Split(output, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		row := make(map[string]string)
+		for i, column := range columns {
+			start := i * squeueColumnWidth
+			if start >= len(line) {
+				break
+			}
+			end := start + squeueColumnWidth
+			if end > len(line) || i == len(columns)-1 {
+				end = len(line)
+			}
+			row[column] = strings.TrimSpace(line[start:end])
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+// arrayStatePriority orders the compact states of the tasks of a job array still in the queue: as long
+// as a task runs the array job is running, otherwise it is pending while any task is. Finished tasks
+// come last, the outcome of the array job being aggregated by sacct once all of them left the queue.
+var arrayStatePriority = map[string]int{"R": 6, "CG": 5, "PD": 4, "S": 3, "RD": 2, "RH": 2}
+
+// squeueJob holds the fields of a job listed by squeue.
+type squeueJob struct {
+	// State is the compact job state, e.g. R
+	State string
+	// NodeList is the list of nodes the job is running on, empty while it is pending
+	NodeList string
+	// Reason is the reason the job is waiting, e.g. Resources, or None
+	Reason string
+}
+
+// queryJobs queries squeue once for all the given jobs and returns them keyed by job ID. Jobs squeue
+// doesn't know anymore are omitted from the result. If squeue fails without listing any job, the
+// jobs are queried one by one, and an error is returned only for a timeout or a single job squeue
+// failed to query for any other reason than not knowing it.
+func queryJobs(jids []string, config commonIL.InterLinkConfig, Ctx context.Context) (map[string]squeueJob, error) {
+	jobs := make(map[string]squeueJob)
+	if len(jids) == 0 {
+		return jobs, nil
+	}
+
+	squeueColumns := squeueFormat(config)
+	shell := exec2.ExecTask{
+		Command: config.Squeuepath,
+		Args:    []string{"--noheader", "-a", "-j " + strings.Join(jids, ","), "--Format=" + squeueFormatArg(squeueColumns)},
+		Shell:   true,
+	}
+	squeueStart := time.Now()
+	execReturn, err := executeWithTimeout(Ctx, shell, config)
+	observeCommand("squeue", squeueStart)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, row := range parseSqueueRows(execReturn.Stdout, squeueColumns) {
+		jobID := row["jobid"]
+		if row["arrayjobid"] != "" && row["arrayjobid"] != "N/A" {
+			// the tasks of a job array are listed on their own, the array job reflects the most advanced one
+			jobID = row["arrayjobid"]
+		}
+		if jobID == "" {
+			continue
+		}
+		job := squeueJob{State: compactJobState(row["state"]), NodeList: row["nodelist"], Reason: row["reason"]}
+		if listed, ok := jobs[jobID]; !ok || arrayStatePriority[job.State] > arrayStatePriority[listed.State] {
+			jobs[jobID] = job
+		}
+	}
+	if len(jobs) == 0 && execReturn.Stderr != "" {
+		if len(jids) == 1 {
+			if strings.Contains(strings.ToLower(execReturn.Stderr), "invalid job id") {
+				// the job has been purged by the controller, it is just not listed anymore
+				return jobs, nil
+			}
+			return nil, errors.New(strings.TrimSpace(execReturn.Stderr))
+		}
+		// squeue rejects the whole list if one of the jobs is invalid, e.g. already purged by the
+		// controller, in which case every job is queried on its own
+		for _, jid := range jids {
+			jobsOfJID, err := queryJobs([]string{jid}, config, Ctx)
+			if errors.Is(err, errCommandTimeout) {
+				return nil, err
+			} else if err != nil {
+				continue
+			}
+			for jobID, job := range jobsOfJID {
+				jobs[jobID] = job
+			}
+		}
+	}
+	return jobs, nil
+}
+
+// setJobNodeName records the node(s) a job has been scheduled on and, if config.ResolveNodeIP is
+// set, the IP address of the first of them, once it has been resolved in the background.
+func (h *SidecarHandler) setJobNodeName(jid *JidStruct, nodeList string) {
+	if nodeList != "" && !strings.HasPrefix(nodeList, "(") && !strings.EqualFold(nodeList, "None assigned") && nodeList != jid.NodeName {
+		jid.NodeName = nodeList
+		jid.HostIP = ""
+		h.markJIDsDirty()
+	}
+	if !h.Config.ResolveNodeIP || jid.NodeName == "" || jid.HostIP != "" {
+		return
+	}
+	hostIP, ok := cachedNodeIP(firstHostname(jid.NodeName), h.Config, h.Ctx)
+	if !ok {
+		return
+	}
+	jid.HostIP = hostIP
+	h.markJIDsDirty()
+}
+
+// nodeIPFailureTTL is how long a failed resolution of the IP address of a node is remembered before
+// being tried again.
+const nodeIPFailureTTL = 5 * time.Minute
+
+// nodeIPEntry is the outcome of the resolution of the IP address of a node.
+type nodeIPEntry struct {
+	ip        string
+	resolving bool
+	failedAt  time.Time
+}
+
+// nodeIPs caches the IP addresses of the nodes, which are resolved in the background so that the
+// status requests never wait for config.NodeIPCommand or the DNS.
+var nodeIPs = make(map[string]*nodeIPEntry)
+var nodeIPsMutex sync.Mutex
+
+// cachedNodeIP returns the IP address of a node, if already resolved. Otherwise its resolution is
+// started in the background, unless it is running or failed less than nodeIPFailureTTL ago, and
+// false is returned.
+func cachedNodeIP(nodeName string, config commonIL.InterLinkConfig, Ctx context.Context) (string, bool) {
+	nodeIPsMutex.Lock()
+	defer nodeIPsMutex.Unlock()
+	entry, ok := nodeIPs[nodeName]
+	if ok && entry.ip != "" {
+		return entry.ip, true
+	}
+	if ok && (entry.resolving || time.Since(entry.failedAt) < nodeIPFailureTTL) {
+		return "", false
+	}
+	nodeIPs[nodeName] = &nodeIPEntry{resolving: true}
+	go func() {
+		hostIP, err := resolveNodeIP(nodeName, config, Ctx)
+		nodeIPsMutex.Lock()
+		defer nodeIPsMutex.Unlock()
+		if err != nil {
+			log.G(Ctx).Warning("Unable to resolve the IP address of node " + nodeName + ", retrying in " + nodeIPFailureTTL.String() + ": " + err.Error())
+			nodeIPs[nodeName] = &nodeIPEntry{failedAt: time.Now()}
+			return
+		}
+		nodeIPs[nodeName] = &nodeIPEntry{ip: hostIP}
+	}()
+	return "", false
+}
+
+// firstHostname returns the first host of a Slurm node list, e.g. node01 for node[01-04,07],node12.
+func firstHostname(nodeList string) string {
+	end := strings.IndexAny(nodeList, ",[")
+	if end < 0 {
+		return nodeList
+	}
+	if nodeList[end] == ',' {
+		return nodeList[:end]
+	}
+	suffix := strings.SplitN(nodeList[end+1:], "]", 2)[0]
+	suffix = strings.SplitN(strings.SplitN(suffix, ",", 2)[0], "-", 2)[0]
+	return nodeList[:end] + suffix
+}
+
+// resolveNodeIP returns the IP address of a node, printed by config.NodeIPCommand when set, which is
+// passed the node name as argument, or looked up in the DNS with config.NodeDomainSuffix appended.
+func resolveNodeIP(nodeName string, config commonIL.InterLinkConfig, Ctx context.Context) (string, error) {
+	if config.NodeIPCommand != "" {
+		output, err := commandOutput(Ctx, config, config.NodeIPCommand, nodeName)
+		if err != nil {
+			return "", err
+		}
+		fields := strings.Fields(string(output))
+		if len(fields) == 0 || net.ParseIP(fields[0]) == nil {
+			return "", errors.New(config.NodeIPCommand + " printed no valid IP address for node " + nodeName)
+		}
+		return fields[0], nil
+	}
+	addresses, err := net.LookupHost(nodeName + config.NodeDomainSuffix)
+	if err != nil {
+		return "", err
+	}
+	return addresses[0], nil
+}
+
+// compactJobState converts the long job state printed by squeue (e.g. RUNNING) into its compact form (e.g. R).
+func compactJobState(state string) string {
+	compactStates := map[string]string{
+		"BOOT_FAIL":     "BF",
+		"CANCELLED":     "CA",
+		"COMPLETED":     "CD",
+		"CONFIGURING":   "CF",
+		"COMPLETING":    "CG",
+		"DEADLINE":      "DL",
+		"FAILED":        "F",
+		"NODE_FAIL":     "NF",
+		"OUT_OF_MEMORY": "OOM",
+		"PENDING":       "PD",
+		"PREEMPTED":     "PR",
+		"RUNNING":       "R",
+		"RESV_DEL_HOLD": "RD",
+		"REQUEUE_FED":   "RF",
+		"REQUEUE_HOLD":  "RH",
+		"REQUEUED":      "RQ",
+		"RESIZING":      "RS",
+		"REVOKED":       "RV",
+		"SIGNALING":     "SI",
+		"SPECIAL_EXIT":  "SE",
+		"STAGE_OUT":     "SO",
+		"STOPPED":       "ST",
+		"SUSPENDED":     "S",
+		"TIMEOUT":       "TO",
+	}
+	fields := strings.Fields(state)
+	if len(fields) == 0 {
+		return ""
+	}
+	state = strings.ToUpper(fields[0])
+	if compact, ok := compactStates[state]; ok {
+		return compact
+	}
+	return state
+}
+
+// getScontrolJob runs scontrol show job and returns its Key=Value fields.
+func getScontrolJob(jid string, config commonIL.InterLinkConfig, Ctx context.Context) (map[string]string, error) {
+	execReturn, err := executeWithTimeout(Ctx, exec2.ExecTask{Command: scontrolPath(config), Args: []string{"show", "job", jid}}, config)
+	if err == nil && execReturn.ExitCode != 0 {
+		err = errors.New(strings.TrimSpace(execReturn.Stderr))
+	}
+	if err != nil {
+		log.G(Ctx).Warning("Unable to run scontrol for job " + jid + ": " + err.Error())
+		return nil, err
+	}
+	return parseScontrolOutput(execReturn.Stdout), nil
+}
+
+func parseScontrolOutput(output string) map[string]string {
+	fields := make(map[string]string)
+	for _, token := range strings.Fields(output) {
+		keyValue := strings.SplitN(token, "=", 2)
+		if len(keyValue) == 2 {
+			if _, ok := fields[keyValue[0]]; !ok {
+				fields[keyValue[0]] = keyValue[1]
+			}
+		}
+	}
+	return fields
+}
+
+// pendingReasonMessages explains the most common reasons squeue reports for a pending job.
+var pendingReasonMessages = map[string]string{
+	"Resources":                "the job is waiting for resources to become available",
+	"Priority":                 "one or more higher priority jobs are queued ahead of the job",
+	"Dependency":               "the job is waiting for the jobs it depends on to complete",
+	"DependencyNeverSatisfied": "the jobs the job depends on failed, it will never start",
+	"BeginTime":                "the earliest start time of the job has not been reached yet",
+	"JobHeldUser":              "the job has been held by the user",
+	"JobHeldAdmin":             "the job has been held by an administrator",
+	"ReqNodeNotAvail":          "the nodes required by the job are not available",
+	"PartitionDown":            "the partition of the job is down",
+	"PartitionTimeLimit":       "the time limit of the job exceeds the one of its partition",
+	"QOSMaxJobsPerUserLimit":   "the QOS limit on the number of running jobs per user has been reached",
+	"AssocGrpCpuLimit":         "the CPU limit of the account has been reached",
+	"AssocGrpMemLimit":         "the memory limit of the account has been reached",
+}
+
+// pendingReasonRegex matches the squeue reasons which can be reported as is, e.g. not "(null)".
+var pendingReasonRegex = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_]*$`)
+
+// pendingReason maps the reason squeue reports for a pending job to the reason and message of the
+// waiting containers. Reasons without explanation are reported as they are, with a generic message.
+func pendingReason(reason string) (string, string) {
+	if reason == "" || reason == "None" || !pendingReasonRegex.MatchString(reason) {
+		return "", ""
+	}
+	if message, ok := pendingReasonMessages[reason]; ok {
+		return reason, message
+	}
+	return reason, "the job is pending in the Slurm queue: " + reason
+}
+
+// getHoldReason returns the reason why a job has been held, as reported by scontrol,
+// or an empty string if it can't be retrieved.
+func getHoldReason(jid string, config commonIL.InterLinkConfig, Ctx context.Context) string {
+	fields, err := getScontrolJob(jid, config, Ctx)
+	if err != nil || fields["Reason"] == "" {
+		return ""
+	}
+	return "Job held by Slurm: " + fields["Reason"]
+}
+
+// sacctPath returns the configured sacct binary, falling back to the one in PATH.
+func sacctPath(config commonIL.InterLinkConfig) string {
+	if config.Sacctpath != "" {
+		return config.Sacctpath
+	}
+	return "sacct"
+}
+
+// getSacctState returns the accounting state of the job allocation, e.g. COMPLETED or COMPLETING.
+func getSacctState(jid string, config commonIL.InterLinkConfig, Ctx context.Context) (string, error) {
+	sacctInfo, err := getSacctInfo(jid, config, Ctx)
+	if err != nil {
+		return "", err
+	}
+	return sacctInfo.State, nil
+}
+
+type SacctInfo struct {
+	State    string
+	ExitCode int32
+	Signal   int32
+	Start    time.Time
+	End      time.Time
+	NodeList string
+	// OOM is set when the job, or one of its steps, was killed for exceeding its memory
+	OOM bool
+}
+
+// getSacctInfo queries the accounting database for a job which is no longer listed by squeue.
+// sacct prints a row for the allocation and one for each step (JID.batch, JID.extern, ...): the
+// allocation row gives the job state, while the exit code is taken from the first step reporting
+// a failure, if any.
+func getSacctInfo(jid string, config commonIL.InterLinkConfig, Ctx context.Context) (*SacctInfo, error) {
+	output, err := commandOutput(Ctx, config, sacctPath(config), "-j", jid, "--noheader", "--parsable2", "--format=JobID,State,ExitCode,Start,End,NodeList")
+	if err != nil {
+		log.G(Ctx).Error("Unable to retrieve accounting information for job " + jid + ": " + err.Error())
+		return nil, err
+	}
+	return parseSacctOutput(jid, string(output))
+}
+
+func parseSacctOutput(jid string, output string) (*SacctInfo, error) {
+	var sacctInfo *SacctInfo
+	var stepExitCode, stepSignal int32
+	stepOOM := false
+	// job arrays have no allocation row of their own, only one per task (JID_0, JID_1, ...)
+	var arrayInfo *SacctInfo
+
+	for _, line := range strings.Split(strings.TrimSpace(output), "\n") {
+		fields := strings.Split(strings.TrimSpace(line), "|")
+		if len(fields) < 5 {
+			continue
+		}
+		exitCode, signal := parseSacctExitCode(fields[2])
+		oom := strings.HasPrefix(fields[1], "OUT_OF_MEMORY")
+
+		if fields[0] == jid {
+			sacctInfo = &SacctInfo{ExitCode: exitCode, Signal: signal, OOM: oom}
+			// states like "CANCELLED by 1000" carry extra words
+			if state := strings.Fields(fields[1]); len(state) > 0 {
+				sacctInfo.State = state[0]
+			}
+			sacctInfo.Start, _ = time.ParseInLocation("2006-01-02T15:04:05", fields[3], time.Local)
+			sacctInfo.End, _ = time.ParseInLocation("2006-01-02T15:04:05", fields[4], time.Local)
+			if len(fields) > 5 {
+				sacctInfo.NodeList = fields[5]
+			}
+		} else if strings.HasPrefix(fields[0], jid+"_") && !strings.Contains(fields[0], ".") {
+			arrayInfo = aggregateArrayTask(arrayInfo, fields, exitCode, signal, oom)
+		} else if strings.HasPrefix(fields[0], jid+".") {
+			// the allocation may just be FAILED while the step hitting the limit is OUT_OF_MEMORY
+			stepOOM = stepOOM || oom
+			if stepExitCode == 0 && stepSignal == 0 {
+				stepExitCode, stepSignal = exitCode, signal
+			}
+		}
+	}
+
+	if sacctInfo == nil && arrayInfo != nil {
+		return arrayInfo, nil
+	}
+	if sacctInfo == nil {
+		return nil, errors.New("no accounting information found for job " + jid)
+	}
+	if sacctInfo.ExitCode == 0 && sacctInfo.Signal == 0 {
+		sacctInfo.ExitCode, sacctInfo.Signal = stepExitCode, stepSignal
+	}
+	sacctInfo.OOM = sacctInfo.OOM || stepOOM
+	if sacctInfo.OOM {
+		// sacct reports an OOM with odd pairs like 0:125, report it like the kubelet does
+		sacctInfo.ExitCode, sacctInfo.Signal = oomKilledExitCode, 9
+	}
+	return sacctInfo, nil
+}
+
+// aggregateArrayTask merges the sacct row of a task of a job array into the information of the whole
+// array: it reports the state and exit code of the first failed task, if any, from the start of the
+// first task to the end of the last one.
+func aggregateArrayTask(arrayInfo *SacctInfo, fields []string, exitCode int32, signal int32, oom bool) *SacctInfo {
+	state := ""
+	if stateFields := strings.Fields(fields[1]); len(stateFields) > 0 {
+		state = stateFields[0]
+	}
+	start, _ := time.ParseInLocation("2006-01-02T15:04:05", fields[3], time.Local)
+	end, _ := time.ParseInLocation("2006-01-02T15:04:05", fields[4], time.Local)
+	if arrayInfo == nil {
+		arrayInfo = &SacctInfo{State: state, ExitCode: exitCode, Signal: signal, OOM: oom, Start: start, End: end}
+		if len(fields) > 5 {
+			arrayInfo.NodeList = fields[5]
+		}
+		return arrayInfo
+	}
+	if arrayInfo.State == "COMPLETED" && state != "COMPLETED" {
+		arrayInfo.State, arrayInfo.ExitCode, arrayInfo.Signal = state, exitCode, signal
+	}
+	arrayInfo.OOM = arrayInfo.OOM || oom
+	if !start.IsZero() && (arrayInfo.Start.IsZero() || start.Before(arrayInfo.Start)) {
+		arrayInfo.Start = start
+	}
+	// an unfinished task leaves the end of the array unknown
+	if end.IsZero() || (!arrayInfo.End.IsZero() && end.After(arrayInfo.End)) {
+		arrayInfo.End = end
+	}
+	return arrayInfo
+}
+
+// parseSacctExitCode splits the exitcode:signal pair printed by sacct.
+func parseSacctExitCode(exitCode string) (int32, int32) {
+	parts := strings.SplitN(exitCode, ":", 2)
+	code, _ := strconv.Atoi(parts[0])
+	signal := 0
+	if len(parts) == 2 {
+		signal, _ = strconv.Atoi(parts[1])
+	}
+	if code == 0 && signal != 0 {
+		code = 128 + signal
+	}
+	return int32(code), int32(signal)
+}
+
+// unknownExitCode is reported when the content of a .status file can't be interpreted at all.
+const unknownExitCode = 255
+
+// cancelledExitCode is reported for the containers killed by the cancellation of their job, as if
+// they had been terminated by SIGTERM.
+const cancelledExitCode = 143
+
+// oomKilledExitCode is reported for the containers killed by Slurm for exceeding the memory of
+// their job, as if they had been terminated by SIGKILL.
+const oomKilledExitCode = 137
+
+// parseExitStatus interprets the content of a container .status file. It returns the exit code,
+// a reason and a message describing it, see exitCodeReason, and whether the container finished.
+// An empty file means the container is still running.
+func parseExitStatus(content string) (int32, string, string, bool) {
+	content = strings.TrimSpace(content)
+	if content == "" {
+		return 0, "", "", false
+	}
+
+	if status, err := strconv.Atoi(content); err == nil {
+		reason, message := exitCodeReason(int32(status))
+		return int32(status), reason, message, true
+	}
+
+	switch strings.ToLower(content) {
+	case "killed":
+		return 137, "Killed", "", true
+	case "terminated":
+		return 143, "Terminated", "", true
+	case "interrupted":
+		return 130, "Interrupted", "", true
+	case "hangup":
+		return 129, "Hangup", "", true
+	}
+
+	return unknownExitCode, "Unknown", "Unable to parse container exit status: " + strconv.Quote(content), true
+}
+
+// signalReasons names the reasons of the exit codes, 128+signal, of the containers terminated by the
+// most common signals.
+var signalReasons = map[int32]string{
+	1:  "Hangup",
+	2:  "Interrupted",
+	6:  "Aborted",
+	9:  "Killed",
+	11: "SegmentationFault",
+	15: "Terminated",
+}
+
+// exitCodeReason returns a human-readable reason and message for the exit code of a container, as the
+// kubelet would: Completed for 0, ContainerCannotRun when the command couldn't be executed, a reason
+// named after the signal for 128+signal values and Error otherwise.
+func exitCodeReason(exitCode int32) (string, string) {
+	message := "exit code " + strconv.Itoa(int(exitCode))
+	switch {
+	case exitCode == 0:
+		return "Completed", ""
+	case exitCode == 126:
+		return "ContainerCannotRun", message + ": the command is not executable"
+	case exitCode == 127:
+		return "ContainerCannotRun", message + ": the command was not found"
+	case exitCode > 128 && exitCode <= 128+64:
+		signal := exitCode - 128
+		reason, ok := signalReasons[signal]
+		if !ok {
+			reason = "Signaled"
+		}
+		return reason, message + ": terminated by signal " + strconv.Itoa(int(signal))
+	}
+	return "Error", message
+}
+
+// podSpecHash returns a digest of the Pod spec, used to tell an in-place update of an already
+// submitted Pod apart from a plain resubmission of the same spec.
+func podSpecHash(pod v1.Pod) (string, error) {
+	specBytes, err := json.Marshal(pod.Spec)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(specBytes)), nil
+}
+
+// storeSpecHash saves the spec digest of a submitted Pod in the JID store and on disk.
+func (h *SidecarHandler) storeSpecHash(podUID string, specHash string, path string) error {
+	if jid, ok := (*h.JIDs)[podUID]; ok {
+		jid.SpecHash = specHash
+		h.markJIDsDirty()
+	}
+	err := os.WriteFile(path+"/SpecHash.sha", []byte(specHash), 0644)
+	if err != nil {
+		log.G(h.Ctx).Error("Unable to write spec hash file for pod " + podUID)
+		return err
+	}
+	return nil
+}
+
+// memoryEmptyDirDirectives returns the job script lines creating the EmptyDir volumes with the Memory
+// medium below config.MemoryEmptyDirBase (/dev/shm by default), a tmpfs on the node. They are removed
+// by an EXIT trap, which also runs when the job script is terminated or an init container fails, and
+// the postfix waits for the containers so that the trap doesn't fire while they run. If the tmpfs
+// can't be written the volumes fall back to the emptyDirs folder of the working directory, as the
+// other EmptyDirs.
+func memoryEmptyDirDirectives(podSpec v1.PodSpec, path string, podUID string, config commonIL.InterLinkConfig) (string, string) {
+	var volumes []string
+	for _, vol := range podSpec.Volumes {
+		if vol.EmptyDir != nil && vol.EmptyDir.Medium == v1.StorageMediumMemory {
+			volumes = append(volumes, vol.Name)
+		}
+	}
+	if len(volumes) == 0 {
+		return "", ""
+	}
+	base := config.MemoryEmptyDirBase
+	if base == "" {
+		base = "/dev/shm"
+	}
+	memoryDir := strings.TrimSuffix(base, "/") + "/interlink-" + podUID
+	prefix := "\ntrap 'rm -rf \"" + memoryDir + "\"' EXIT" +
+		"\nexport MEMORY_EMPTYDIRS=\"" + memoryDir + "\"" +
+		"\nif ! mkdir -p \"$MEMORY_EMPTYDIRS\" 2> /dev/null; then" +
+		"\n  echo \"" + base + " is not available, memory EmptyDirs fall back to disk\" >&2" +
+		"\n  export MEMORY_EMPTYDIRS=\"" + path + "/emptyDirs\"" +
+		"\nfi"
+	for _, volume := range volumes {
+		prefix += "\nmkdir -p \"$MEMORY_EMPTYDIRS/" + volume + "\""
+	}
+	// the containers run in the background, the memory is given back once all of them ended
+	return prefix, "\nwait"
+}
+
+// emptyDirCheckInterval is how often the job script checks the size of the EmptyDirs with a sizeLimit.
+var emptyDirCheckInterval = 10 * time.Second
+
+// emptyDirLimitDirectives returns the job script lines enforcing the sizeLimit of the Pod EmptyDirs,
+// if any. A watcher running in the background measures them with du every emptyDirCheckInterval and,
+// once one of them exceeds its limit, kills the app containers through their PID files, failing them
+// as the kubelet would evict the Pod. The watcher ends by itself once all the containers wrote their
+// exit code, so that it doesn't hold the job script waiting for them.
+func emptyDirLimitDirectives(podSpec v1.PodSpec, path string, containers int) string {
+	checks := ""
+	for _, vol := range podSpec.Volumes {
+		if vol.EmptyDir == nil || vol.EmptyDir.SizeLimit == nil {
+			continue
+		}
+		dir := "\"" + path + "/emptyDirs/" + vol.Name + "\""
+		if vol.EmptyDir.Medium == v1.StorageMediumMemory {
+			dir = "\"$MEMORY_EMPTYDIRS/" + vol.Name + "\""
+		}
+		limitKiB := (vol.EmptyDir.SizeLimit.Value() + 1023) / 1024
+		checks += "\n  if [ \"$(du -sk " + dir + " 2> /dev/null | cut -f1)\" -gt " + strconv.FormatInt(limitKiB, 10) + " ] 2> /dev/null; then" +
+			"\n    echo \"EmptyDir " + vol.Name + " exceeds its sizeLimit of " + vol.EmptyDir.SizeLimit.String() + ", killing the containers\" >&2" +
+			"\n    for pidFile in " + path + "/*.pid; do kill -KILL $(cat \"$pidFile\") 2> /dev/null; done" +
+			"\n    break" +
+			"\n  fi"
+	}
+	if checks == "" {
+		return ""
+	}
+	return "\n(while [ $(ls " + path + "/*.status 2> /dev/null | wc -l) -lt " + strconv.Itoa(containers) + " ]; do" +
+		"\n  sleep " + strconv.Itoa(int(emptyDirCheckInterval.Seconds())) +
+		checks +
+		"\ndone) &"
+}
+
+// cleanWorkingDir removes the content of a Pod working directory. When keepEmptyDirs is set the
+// emptyDirs folder is preserved, since EmptyDir volumes must survive container restarts within
+// the same Pod and are only cleared when the Pod itself is deleted.
+func cleanWorkingDir(path string, keepEmptyDirs bool, Ctx context.Context) {
+	if !keepEmptyDirs {
+		os.RemoveAll(path)
+		return
+	}
+
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		log.G(Ctx).Debug(err)
+		return
+	}
+	for _, entry := range entries {
+		if entry.Name() == "emptyDirs" {
+			continue
+		}
+		err = os.RemoveAll(filepath.Join(path, entry.Name()))
+		if err != nil {
+			log.G(Ctx).Warning(err)
+		}
+	}
+}
+
+// cleanEmptyDirs removes the EmptyDir volumes of a Pod.
+func cleanEmptyDirs(path string, Ctx context.Context) {
+	err := os.RemoveAll(filepath.Join(path, "emptyDirs"))
+	if err != nil {
+		log.G(Ctx).Warning(err)
+	} else {
+		log.G(Ctx).Debug("-- Removed EmptyDirs in " + path)
+	}
+}
+
+func (h *SidecarHandler) removeJID(podUID string) {
+	delete(*h.JIDs, podUID)
+	h.markJIDsDirty()
+}
+
+// isBenignScancelError reports whether scancel's stderr only contains warnings about the job
+// already being in a completing/completed state or being gone altogether, which must not prevent
+// the pod cleanup.
+func isBenignScancelError(stderr string) bool {
+	if strings.TrimSpace(stderr) == "" {
+		return false
+	}
+	for _, line := range strings.Split(strings.TrimSpace(stderr), "\n") {
+		line = strings.ToLower(line)
+		if !strings.Contains(line, "already completing or completed") && !strings.Contains(line, "job is completing") && !strings.Contains(line, "invalid job id") {
+			return false
+		}
+	}
+	return true
+}
+
+// cancelJob runs scancel on the given job with the optional extra arguments. Warnings about the
+// job being already completing or completed are tolerated, while real errors are returned.
+func cancelJob(jid string, config commonIL.InterLinkConfig, Ctx context.Context, args ...string) error {
+	ctx, cancel := commandContext(Ctx, config)
+	defer cancel()
+	_, err := exec.CommandContext(ctx, config.Scancelpath, append(args, jid)...).Output()
+	if err = timeoutError(ctx, config.Scancelpath, config, err); err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && isBenignScancelError(string(exitErr.Stderr)) {
+			log.G(Ctx).Warning("- Job " + jid + " is already completing, completed or gone: " + strings.TrimSpace(string(exitErr.Stderr)))
+			return nil
+		}
+		if errors.As(err, &exitErr) && len(exitErr.Stderr) > 0 {
+			err = errors.New(strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return err
+	}
+	return nil
+}
+
+// stopSignalRegex matches signal names or numbers accepted by scancel --signal.
+var stopSignalRegex = regexp.MustCompile(`^(SIG)?[A-Z0-9]+$`)
+
+// signalContainers delivers the signal to the container processes themselves, rather than to the
+// wrappers around them. With config.ContainerSteps each container runs as a job step, which scancel
+// signals on every node of the allocation. Otherwise the PIDs recorded by the job script in the
+// <container>.pid files are killed through a job step running on every node, each of them only
+// signalling the processes belonging to the job, since the batch host isn't known. An error is
+// returned if no PID has been recorded yet or the step couldn't be run.
+func signalContainers(jid string, path string, pod v1.Pod, signal string, config commonIL.InterLinkConfig, Ctx context.Context) error {
+	if config.ContainerSteps {
+		err := cancelJob(jid, config, Ctx, "--signal="+signal)
+		if err != nil {
+			return err
+		}
+		log.G(Ctx).Debug("- Sent signal " + signal + " to the steps of Job " + jid)
+		return nil
+	}
+
+	var pids []string
+	for _, container := range pod.Spec.Containers {
+		pid, err := os.ReadFile(path + "/" + container.Name + ".pid")
+		if err != nil {
+			continue
+		}
+		if pid := strings.TrimSpace(string(pid)); pidRegex.MatchString(pid) {
+			pids = append(pids, pid)
+		}
+	}
+	if len(pids) == 0 {
+		return errors.New("no container PID recorded in " + path)
+	}
+
+	// a PID may belong to an unrelated process on the nodes other than the batch host
+	script := "for pid in " + strings.Join(pids, " ") + "; do " +
+		"grep -qsxz -e 'SLURM_JOB_ID=" + jid + "' -e 'SLURM_ARRAY_JOB_ID=" + jid + "' /proc/$pid/environ && kill -s " + strings.TrimPrefix(signal, "SIG") + " $pid; " +
+		"done; true"
+	args := []string{"--jobid=" + jid, "--overlap", "--ntasks-per-node=1", "sh", "-c", script}
+	ctx, cancel := commandContext(Ctx, config)
+	defer cancel()
+	output, err := exec.CommandContext(ctx, srunPath(config), args...).CombinedOutput()
+	if err = timeoutError(ctx, srunPath(config), config, err); errors.Is(err, errCommandTimeout) {
+		return err
+	} else if err != nil {
+		return errors.New(strings.TrimSpace(string(output)) + " " + err.Error())
+	}
+	log.G(Ctx).Debug("- Sent signal " + signal + " to PIDs " + strings.Join(pids, ", ") + " of Job " + jid)
+	return nil
+}
+
+// pidRegex matches the content of the <container>.pid files.
+var pidRegex = regexp.MustCompile(`^[0-9]+$`)
+
+// deleteContainer cancels the job of a Pod and stops tracking it, then removes cleanupPath, if not
+// empty. When the Pod has a stop signal, the signal is delivered right away while the job is only
+// cancelled, and cleanupPath removed, once the termination grace period expired. The pending
+// cancellation is recorded in the JIDs index, so that it is resumed after a restart.
+func (h *SidecarHandler) deleteContainer(pod v1.Pod, cleanupPath string) error {
+	podUID := string(pod.UID)
+	log.G(h.Ctx).Info("- Deleting Job for pod " + podUID)
+	jidStruct, ok := h.lookupJID(podUID)
+	if !ok {
+		log.G(h.Ctx).Info("- No Job tracked for pod " + podUID + ", nothing to cancel")
+		return nil
+	}
+	jid := jidStruct.JID
+
+	stopSignal, hasStopSignal := filterAnnotations(pod.Annotations, h.Config, h.Ctx)["slurm-job.vk.io/stop-signal"]
+	if hasStopSignal && !stopSignalRegex.MatchString(stopSignal) {
+		log.G(h.Ctx).Warning("- Invalid stop signal " + stopSignal + ", using scancel default")
+		hasStopSignal = false
+	}
+
+	if hasStopSignal {
+		// the configured signal is delivered first, and the job is cancelled for good once the
+		// termination grace period expired
+		workingPath := h.Config.DataRootFolder + pod.Namespace + "-" + podUID
+		err := signalContainers(jid, workingPath, pod, stopSignal, h.Config, h.Ctx)
+		if err != nil {
+			log.G(h.Ctx).Warning("- Unable to signal the containers of Job " + jid + ", signalling the whole job: " + err.Error())
+			err = cancelJob(jid, h.Config, h.Ctx, "--signal="+stopSignal, "--full")
+		}
+		if err != nil {
+			log.G(h.Ctx).Error(err)
+			return err
+		}
+		log.G(h.Ctx).Info("- Sent signal " + stopSignal + " to Job " + jid)
+
+		gracePeriod := 30 * time.Second
+		if pod.Spec.TerminationGracePeriodSeconds != nil {
+			gracePeriod = time.Duration(*pod.Spec.TerminationGracePeriodSeconds) * time.Second
+		}
+		h.jidsMutex.Lock()
+		if tracked, ok := (*h.JIDs)[podUID]; ok && tracked.JID == jid {
+			tracked.CancelAt = time.Now().Add(gracePeriod)
+			tracked.CleanupPath = cleanupPath
+			h.markJIDsDirty()
+		}
+		h.jidsMutex.Unlock()
+		h.schedulePendingCancel(podUID, jid, cleanupPath, gracePeriod)
+		return nil
+	}
+
+	err := cancelJob(jid, h.Config, h.Ctx)
+	if err != nil {
+		log.G(h.Ctx).Error(err)
+		return err
 	}
+	log.G(h.Ctx).Info("- Deleted Job ", jid)
 
-	if config.Commandprefix != "" {
-		prefix += "\n" + config.Commandprefix
+	h.jidsMutex.Lock()
+	h.removeJID(podUID)
+	h.jidsMutex.Unlock()
+	if cleanupPath != "" {
+		return os.RemoveAll(cleanupPath)
 	}
+	return nil
+}
 
-	if preExecAnnotations, ok := metadata.Annotations["job.vk.io/pre-exec"]; ok {
-		prefix += "\n" + preExecAnnotations
+// resubmitCancelTimeout bounds how long the job of a Pod whose spec changed may take to be gone
+// once cancelled, and resubmitPollInterval how often squeue is asked about it meanwhile.
+const resubmitCancelTimeout = time.Minute
+const resubmitPollInterval = time.Second
+
+// cancelForResubmit cancels the job of a Pod whose spec changed right away, ignoring its stop
+// signal, and waits until squeue no longer reports it as active, so that the job replacing it
+// doesn't overlap with it. The job then stops being tracked, so that the timestamps of the old job
+// aren't carried over to the new one.
+func (h *SidecarHandler) cancelForResubmit(podUID string, jid string) error {
+	err := cancelJob(jid, h.Config, h.Ctx)
+	if err != nil {
+		return err
+	}
+	deadline := time.Now().Add(resubmitCancelTimeout)
+	for {
+		active, err := isJobActive(jid, h.Config, h.Ctx)
+		if err != nil {
+			return err
+		}
+		if !active {
+			break
+		}
+		if time.Now().After(deadline) {
+			return errors.New("job " + jid + " is still active " + resubmitCancelTimeout.String() + " after being cancelled")
+		}
+		select {
+		case <-time.After(resubmitPollInterval):
+		case <-h.Ctx.Done():
+			return h.Ctx.Err()
+		}
 	}
+	log.G(h.Ctx).Info("- Deleted Job ", jid)
 
-	sbatch_macros := "#!" + config.BashPath +
-		"\n#SBATCH --job-name=" + podUID +
-		"\n#SBATCH --output=" + path + "/job.out" +
-		sbatch_flags_as_string +
-		"\n" +
-		prefix +
-		"\n"
+	h.jidsMutex.Lock()
+	if tracked, ok := (*h.JIDs)[podUID]; ok && tracked.JID == jid {
+		h.removeJID(podUID)
+	}
+	h.jidsMutex.Unlock()
+	return nil
+}
 
-	log.G(Ctx).Debug("--- Writing file")
+// pendingCancelRetry is how long a pending cancellation waits before being tried again, if scancel
+// failed, and pendingCancelAttempts how many times it is tried at most.
+const pendingCancelRetry = time.Minute
+const pendingCancelAttempts = 10
 
-	var stringToBeWritten string
+// schedulePendingCancel cancels the job of a deleted Pod once delay elapsed, then stops tracking it
+// and removes cleanupPath. As long as scancel fails, the cancellation is tried again, unless sacct
+// reports the job as finished anyway, up to pendingCancelAttempts times. A job which can't be
+// cancelled, or whose cancellation is interrupted by the sidecar shutting down, keeps being tracked
+// with its pending cancellation, which is resumed at the next start.
+func (h *SidecarHandler) schedulePendingCancel(podUID string, jid string, cleanupPath string, delay time.Duration) {
+	go func() {
+		for attempt := 1; ; attempt++ {
+			select {
+			case <-time.After(delay):
+			case <-h.Ctx.Done():
+				return
+			}
+			err := cancelJob(jid, h.Config, h.Ctx)
+			if err == nil {
+				log.G(h.Ctx).Info("- Deleted Job ", jid)
+				break
+			}
+			if sacctInfo, sacctErr := getSacctInfo(jid, h.Config, h.Ctx); sacctErr == nil && finishedJobStates[sacctInfo.State] {
+				log.G(h.Ctx).Info("- Job " + jid + " of deleted pod " + podUID + " already finished")
+				break
+			}
+			if attempt >= pendingCancelAttempts {
+				log.G(h.Ctx).Error("Unable to cancel Job " + jid + " of deleted pod " + podUID + " after " + strconv.Itoa(attempt) + " attempts, giving up: " + err.Error())
+				return
+			}
+			log.G(h.Ctx).Warning("Unable to cancel Job " + jid + " of deleted pod " + podUID + ", retrying in " + pendingCancelRetry.String() + ": " + err.Error())
+			delay = pendingCancelRetry
+		}
 
-	stringToBeWritten += sbatch_macros
+		h.jidsMutex.Lock()
+		// the Pod may have been resubmitted in the meantime, in which case the new job is kept
+		if tracked, ok := (*h.JIDs)[podUID]; ok && tracked.JID == jid {
+			h.removeJID(podUID)
+		}
+		h.jidsMutex.Unlock()
+		if cleanupPath != "" {
+			os.RemoveAll(cleanupPath)
+		}
+		if err := h.flushJIDs(); err != nil {
+			log.G(h.Ctx).Warning(err)
+		}
+	}()
+}
 
-	for _, singularityCommand := range commands {
-		stringToBeWritten += "\n" + strings.Join(singularityCommand.command[:], " ") +
-			" &> " + path + "/" + singularityCommand.containerName + ".out; " +
-			"echo $? > " + path + "/" + singularityCommand.containerName + ".status &"
+// ResumePendingCancels schedules again the cancellations of the jobs of Pods deleted with a stop
+// signal before a restart. The overdue ones are run right away. It must be called once the JIDs
+// have been loaded.
+func (h *SidecarHandler) ResumePendingCancels() {
+	h.jidsMutex.RLock()
+	defer h.jidsMutex.RUnlock()
+	for podUID, jid := range *h.JIDs {
+		if jid.CancelAt.IsZero() {
+			continue
+		}
+		log.G(h.Ctx).Info("Resuming the pending cancellation of Job " + jid.JID + " of pod " + podUID)
+		h.schedulePendingCancel(podUID, jid.JID, jid.CleanupPath, time.Until(jid.CancelAt))
 	}
+}
 
-	stringToBeWritten += "\n" + postfix
+// podLinksDir is the directory, relative to DataRootFolder, holding the stable links to the Pods working directories.
+const podLinksDir = "by-name"
 
-	_, err = f.WriteString(stringToBeWritten)
+// podLinkPath returns the stable path <DataRootFolder>/by-name/<namespace>/<podName> of a Pod working directory.
+func podLinkPath(config commonIL.InterLinkConfig, pod v1.Pod) string {
+	return filepath.Join(config.DataRootFolder, podLinksDir, pod.Namespace, pod.Name)
+}
 
+// linkPodDir points the stable by-name path of the Pod to its working directory, replacing the link
+// left by a previous Pod with the same name. It does nothing unless config.StablePodLinks is set.
+func linkPodDir(config commonIL.InterLinkConfig, pod v1.Pod, path string, Ctx context.Context) error {
+	if !config.StablePodLinks {
+		return nil
+	}
+	target, err := filepath.Abs(path)
 	if err != nil {
-		log.G(Ctx).Error(err)
-		return "", err
-	} else {
-		log.G(Ctx).Debug("---- Written file")
+		return err
 	}
-
-	return f.Name(), nil
+	link := podLinkPath(config, pod)
+	err = os.MkdirAll(filepath.Dir(link), os.ModePerm)
+	if err != nil {
+		return err
+	}
+	os.Remove(link)
+	err = os.Symlink(target, link)
+	if err != nil {
+		return err
+	}
+	log.G(Ctx).Debug("-- Linked " + link + " to " + target)
+	return nil
 }
 
-func SLURMBatchSubmit(path string, config commonIL.InterLinkConfig, Ctx context.Context) (string, error) {
-	log.G(Ctx).Info("- Submitting Slurm job")
-	cmd := []string{path}
-	shell := exec2.ExecTask{
-		Command: config.Sbatchpath,
-		Args:    cmd,
-		Shell:   true,
+// unlinkPodDir removes the stable by-name path of the Pod, if it still points to the given working directory.
+func unlinkPodDir(config commonIL.InterLinkConfig, pod v1.Pod, path string, Ctx context.Context) {
+	if !config.StablePodLinks {
+		return
 	}
-
-	execReturn, err := shell.Execute()
+	link := podLinkPath(config, pod)
+	target, err := os.Readlink(link)
 	if err != nil {
-		log.G(Ctx).Error("Unable to create file " + path)
-		return "", err
+		return
 	}
-	execReturn.Stdout = strings.ReplaceAll(execReturn.Stdout, "\n", "")
-
-	if execReturn.Stderr != "" {
-		log.G(Ctx).Error("Could not run sbatch: " + execReturn.Stderr)
-		return "", errors.New(execReturn.Stderr)
-	} else {
-		log.G(Ctx).Debug("Job submitted")
+	if absPath, err := filepath.Abs(path); err == nil && target == absPath {
+		os.Remove(link)
+		// drop the namespace directory as well once its last link is gone
+		os.Remove(filepath.Dir(link))
+		log.G(Ctx).Debug("-- Removed link " + link)
 	}
-	return string(execReturn.Stdout), nil
 }
 
-func handleJID(podUID string, output string, pod v1.Pod, path string, JIDs *map[string]*JidStruct, Ctx context.Context) error {
-	r := regexp.MustCompile(`Submitted batch job (?P<jid>\d+)`)
-	jid := r.FindStringSubmatch(output)
-	f, err := os.Create(path + "/JobID.jid")
-	if err != nil {
-		log.G(Ctx).Error("Can't create jid_file")
-		return err
+// isMountedBy reports whether the named volume is mounted by the container.
+func isMountedBy(volumeName string, container v1.Container) bool {
+	for _, mountSpec := range container.VolumeMounts {
+		if mountSpec.Name == volumeName {
+			return true
+		}
 	}
-	_, err = f.WriteString(jid[1])
-	f.Close()
-	if err != nil {
-		log.G(Ctx).Error(err)
-		return err
+	return false
+}
+
+// volumeType returns the name of the volume source set in the given spec, e.g. "hostPath".
+func volumeType(volumeSource v1.VolumeSource) string {
+	value := reflect.ValueOf(volumeSource)
+	for i := 0; i < value.NumField(); i++ {
+		if !value.Field(i).IsNil() {
+			return strings.Split(value.Type().Field(i).Tag.Get("json"), ",")[0]
+		}
 	}
+	return "unknown"
+}
 
-	(*JIDs)[podUID] = &JidStruct{PodUID: string(pod.UID), JID: jid[1]}
-	log.G(Ctx).Info("Job ID is: " + (*JIDs)[podUID].JID)
+// checkUnsupportedVolumes looks for volumes mounted by the container which mountData doesn't know
+// how to handle. They are logged as warnings, or cause the submission to fail if config.StrictVolumes is set.
+func checkUnsupportedVolumes(container v1.Container, pod v1.Pod, config commonIL.InterLinkConfig, Ctx context.Context) error {
+	for _, mountSpec := range container.VolumeMounts {
+		for _, vol := range pod.Spec.Volumes {
+			if vol.Name != mountSpec.Name {
+				continue
+			}
+			if vol.ConfigMap != nil || vol.Secret != nil || vol.EmptyDir != nil || vol.PersistentVolumeClaim != nil || vol.DownwardAPI != nil || vol.Projected != nil || vol.HostPath != nil {
+				continue
+			}
+			msg := "volume " + vol.Name + " of type " + volumeType(vol.VolumeSource) + " mounted by container " + container.Name + " is not supported"
+			if config.StrictVolumes {
+				return errors.New(msg)
+			}
+			log.G(Ctx).Warning("-- " + msg + ", it won't be mounted")
+		}
+	}
 	return nil
 }
 
-func removeJID(podUID string, JIDs *map[string]*JidStruct) {
-	delete(*JIDs, podUID)
+// refreshMountedData rewrites the files of the ConfigMap and Secret volumes of a Pod in place. The
+// containers bind every file on its own, so the inodes are kept for them to see the new content. Keys
+// added after the submission have no bind and are skipped, as are projected volumes.
+func refreshMountedData(path string, data commonIL.RetrievedPodData, Ctx context.Context) error {
+	files := make(map[string][]byte)
+	for _, cont := range data.Containers {
+		for _, vol := range data.Pod.Spec.Volumes {
+			for _, cfgMap := range cont.ConfigMaps {
+				if vol.ConfigMap != nil && vol.ConfigMap.Name == cfgMap.Name {
+					for key, value := range cfgMap.Data {
+						files[filepath.Join(path, "configMaps", vol.Name, key)] = []byte(value)
+					}
+				}
+			}
+			for _, secret := range cont.Secrets {
+				if vol.Secret != nil && vol.Secret.SecretName == secret.Name {
+					for key, value := range secret.Data {
+						files[filepath.Join(path, "secrets", vol.Name, key)] = value
+					}
+				}
+			}
+		}
+	}
+
+	for fullPath, content := range files {
+		updated, err := refreshFile(fullPath, content)
+		if err != nil {
+			return err
+		}
+		if updated {
+			log.G(Ctx).Info("--- Updated file " + fullPath)
+		}
+	}
+	return nil
 }
 
-func deleteContainer(podUID string, path string, config commonIL.InterLinkConfig, JIDs *map[string]*JidStruct, Ctx context.Context) error {
-	log.G(Ctx).Info("- Deleting Job for pod " + podUID)
-	_, err := exec.Command(config.Scancelpath, (*JIDs)[podUID].JID).Output()
+// refreshFile replaces an existing file whose content differs. The new content is written to a
+// temporary file which is then renamed over the old one, so that readers never see it half written.
+func refreshFile(fullPath string, content []byte) (bool, error) {
+	info, err := os.Stat(fullPath)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	current, err := os.ReadFile(fullPath)
 	if err != nil {
-		log.G(Ctx).Error(err)
-		return err
-	} else {
-		log.G(Ctx).Info("- Deleted Job ", (*JIDs)[podUID].JID)
+		return false, err
+	}
+	if string(current) == string(content) {
+		return false, nil
+	}
+	tmpPath := fullPath + ".tmp"
+	err = os.WriteFile(tmpPath, content, info.Mode().Perm())
+	if err == nil {
+		// WriteFile doesn't change the mode of a leftover temporary file, nor does it apply it past the umask.
+		err = os.Chmod(tmpPath, info.Mode().Perm())
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, fullPath)
 	}
-	os.RemoveAll(path + "/" + podUID)
-	removeJID(podUID, JIDs)
 	if err != nil {
-		log.G(Ctx).Warning(err)
-		return err
+		os.Remove(tmpPath)
+		return false, err
+	}
+	return true, nil
+}
+
+// writeVolumeFiles writes the files of a ConfigMap or Secret volume in its directory, in the order of
+// their keys. If any of them can't be written the whole directory is removed, so that no partial
+// volume is left behind, and the write error is returned.
+func writeVolumeFiles(dir string, files map[string][]byte, mode os.FileMode, Ctx context.Context) (err error) {
+	defer func() {
+		if err != nil {
+			if removeErr := os.RemoveAll(dir); removeErr != nil {
+				log.G(Ctx).Error("Unable to remove directory " + dir + ": " + removeErr.Error())
+			}
+		}
+	}()
+
+	var keys []string
+	for key := range files {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fullPath := filepath.Join(dir, key)
+		err = os.WriteFile(fullPath, files[key], mode)
+		if err != nil {
+			log.G(Ctx).Errorf("Could not write file %s", fullPath)
+			return err
+		}
+		log.G(Ctx).Debug("--- Written file " + fullPath)
 	}
 	return nil
 }
@@ -459,7 +4513,7 @@ func mountData(path string, container v1.Container, pod v1.Pod, data interface{}
 									configMapNamePaths = append(configMapNamePaths, fullPath)
 
 									if os.Getenv("SHARED_FS") != "true" {
-										env := string(container.Name) + "_CFG_" + key
+										env := envNameRegex.ReplaceAllString(container.Name+"_CFG_"+string(pod.UID)+"_"+key, "_")
 										log.G(Ctx).Debug("---- Setting env " + env + " to mount the file later")
 										os.Setenv(env, mount.Data[key])
 										envs = append(envs, env)
@@ -489,21 +4543,13 @@ func mountData(path string, container v1.Container, pod v1.Pod, data interface{}
 								}
 
 								log.G(Ctx).Debug("--- Writing ConfigMaps files")
+								files := make(map[string][]byte)
 								for k, v := range configMaps {
-									// TODO: Ensure that these files are deleted in failure cases
-									fullPath := filepath.Join(podConfigMapDir, k)
-									err = os.WriteFile(fullPath, []byte(v), mode)
-									if err != nil {
-										log.G(Ctx).Errorf("Could not write ConfigMap file %s", fullPath)
-										os.RemoveAll(fullPath)
-										if err != nil {
-											log.G(Ctx).Error("Unable to remove file " + fullPath)
-											return nil, nil, err
-										}
-										return nil, nil, err
-									} else {
-										log.G(Ctx).Debug("Written ConfigMap file " + fullPath)
-									}
+									files[k] = []byte(v)
+								}
+								err = writeVolumeFiles(podConfigMapDir, files, mode, Ctx)
+								if err != nil {
+									return nil, nil, err
 								}
 							}
 							return configMapNamePaths, envs, nil
@@ -524,6 +4570,13 @@ func mountData(path string, container v1.Container, pod v1.Pod, data interface{}
 						if podVolumeSpec != nil && podVolumeSpec.Secret != nil {
 							log.G(Ctx).Info("--- Mounting Secret " + podVolumeSpec.Secret.SecretName)
 							mode := os.FileMode(*podVolumeSpec.Secret.DefaultMode)
+							if mount.Type == v1.SecretTypeTLS {
+								for _, key := range []string{v1.TLSCertKey, v1.TLSPrivateKeyKey} {
+									if _, ok := mount.Data[key]; !ok {
+										log.G(Ctx).Warning("--- TLS Secret " + mount.Name + " has no " + key + " key")
+									}
+								}
+							}
 							podSecretDir := filepath.Join(path+"/", "secrets/", vol.Name)
 
 							if mount.Data != nil {
@@ -534,7 +4587,7 @@ func mountData(path string, container v1.Container, pod v1.Pod, data interface{}
 									secretNamePaths = append(secretNamePaths, fullPath)
 
 									if os.Getenv("SHARED_FS") != "true" {
-										env := string(container.Name) + "_SECRET_" + key
+										env := envNameRegex.ReplaceAllString(container.Name+"_SECRET_"+string(pod.UID)+"_"+key, "_")
 										log.G(Ctx).Debug("---- Setting env " + env + " to mount the file later")
 										os.Setenv(env, string(mount.Data[key]))
 										envs = append(envs, env)
@@ -544,41 +4597,26 @@ func mountData(path string, container v1.Container, pod v1.Pod, data interface{}
 
 							if os.Getenv("SHARED_FS") == "true" {
 								log.G(Ctx).Info("--- Shared FS enabled, files will be directly created before the job submission")
-								cmd := []string{"-p " + podSecretDir}
-								shell := exec2.ExecTask{
-									Command: "mkdir",
-									Args:    cmd,
-									Shell:   true,
+								// the shared filesystem is reachable by other users, so neither the Secret
+								// directories nor the files are ever accessible to them, whatever the defaultMode
+								err = os.MkdirAll(podSecretDir, 0700)
+								if err == nil {
+									err = os.Chmod(filepath.Dir(podSecretDir), 0700)
 								}
-
-								execReturn, err := shell.Execute()
-								if strings.Compare(execReturn.Stdout, "") != 0 {
+								if err == nil {
+									err = os.Chmod(podSecretDir, 0700)
+								}
+								if err != nil {
 									log.G(Ctx).Error(err)
 									return nil, nil, err
-								}
-								if execReturn.Stderr != "" {
-									log.G(Ctx).Error(execReturn.Stderr)
-									return nil, nil, errors.New(execReturn.Stderr)
 								} else {
 									log.G(Ctx).Debug("--- Created folder " + podSecretDir)
 								}
 
 								log.G(Ctx).Debug("--- Writing Secret files")
-								for k, v := range secrets {
-									// TODO: Ensure that these files are deleted in failure cases
-									fullPath := filepath.Join(podSecretDir, k)
-									os.WriteFile(fullPath, v, mode)
-									if err != nil {
-										log.G(Ctx).Errorf("Could not write Secret file %s", fullPath)
-										err = os.RemoveAll(fullPath)
-										if err != nil {
-											log.G(Ctx).Error("Unable to remove file " + fullPath)
-											return nil, nil, err
-										}
-										return nil, nil, err
-									} else {
-										log.G(Ctx).Debug("--- Written Secret file " + fullPath)
-									}
+								err = writeVolumeFiles(podSecretDir, secrets, mode&0600, Ctx)
+								if err != nil {
+									return nil, nil, err
 								}
 							}
 							return secretNamePaths, envs, nil
@@ -586,6 +4624,11 @@ func mountData(path string, container v1.Container, pod v1.Pod, data interface{}
 
 					case string:
 						if podVolumeSpec != nil && podVolumeSpec.EmptyDir != nil {
+							if podVolumeSpec.EmptyDir.Medium == v1.StorageMediumMemory {
+								// the directory is created on the node by the job script, see memoryEmptyDirDirectives
+								log.G(Ctx).Info("-- Binding EmptyDir " + vol.Name + " from the memory of the node")
+								return []string{"\"$MEMORY_EMPTYDIRS/" + vol.Name + "\":" + mountSpec.MountPath + "/" + mountSpec.Name + ","}, nil, nil
+							}
 							var edPath string
 							edPath = filepath.Join(path + "/" + "emptyDirs/" + vol.Name)
 							log.G(Ctx).Info("-- Creating EmptyDir in " + edPath)
@@ -607,6 +4650,53 @@ func mountData(path string, container v1.Container, pod v1.Pod, data interface{}
 							edPath += (":" + mountSpec.MountPath + "/" + mountSpec.Name + ",")
 							return []string{edPath}, nil, nil
 						}
+
+					case v1.PersistentVolumeClaimVolumeSource:
+						if podVolumeSpec != nil && podVolumeSpec.PersistentVolumeClaim != nil && podVolumeSpec.PersistentVolumeClaim.ClaimName == mount.ClaimName {
+							if config.PVCHostPathTemplate == "" {
+								return nil, nil, errors.New("PersistentVolumeClaim " + mount.ClaimName + " can't be mounted, PVCHostPathTemplate is not configured")
+							}
+							hostPath := strings.NewReplacer("{ClaimName}", mount.ClaimName, "{Namespace}", pod.Namespace).Replace(config.PVCHostPathTemplate)
+							info, err := os.Stat(hostPath)
+							if err != nil || !info.IsDir() {
+								log.G(Ctx).Error("Host path " + hostPath + " for PersistentVolumeClaim " + mount.ClaimName + " doesn't exist")
+								return nil, nil, errors.New("host path " + hostPath + " for PersistentVolumeClaim " + mount.ClaimName + " doesn't exist")
+							}
+							log.G(Ctx).Info("-- Binding PersistentVolumeClaim " + mount.ClaimName + " from " + hostPath)
+							bindPath := hostPath + ":" + mountSpec.MountPath
+							if mountSpec.ReadOnly || mount.ReadOnly {
+								bindPath += ":ro"
+							}
+							return []string{bindPath + ","}, nil, nil
+						}
+
+					case v1.HostPathVolumeSource:
+						if podVolumeSpec != nil && podVolumeSpec.HostPath != nil && podVolumeSpec.HostPath.Path == mount.Path {
+							if !hostPathAllowed(mount.Path, config.HostPathAllowedPrefixes) {
+								return nil, nil, errors.New("host path " + mount.Path + " of volume " + vol.Name + " is not under any of the HostPathAllowedPrefixes")
+							}
+							err := checkHostPath(mount)
+							if err != nil {
+								log.G(Ctx).Error(err)
+								return nil, nil, err
+							}
+							log.G(Ctx).Info("-- Binding host path " + mount.Path)
+							bindPath := filepath.Clean(mount.Path) + ":" + mountSpec.MountPath
+							if mountSpec.ReadOnly {
+								bindPath += ":ro"
+							}
+							return []string{bindPath + ","}, nil, nil
+						}
+
+					case v1.Volume:
+						if mount.Name == vol.Name && mount.DownwardAPI != nil {
+							return mountDownwardAPI(path, container, pod, *mount.DownwardAPI, vol.Name, mountSpec, Ctx)
+						}
+
+					case projectedVolume:
+						if mount.volume.Name == vol.Name && mount.volume.Projected != nil {
+							return mountProjected(path, container, pod, mount, mountSpec, Ctx)
+						}
 					}
 				}
 			}
@@ -614,3 +4704,303 @@ func mountData(path string, container v1.Container, pod v1.Pod, data interface{}
 	}
 	return nil, nil, nil
 }
+
+// hostPathAllowed reports whether the host path is one of the allowed prefixes or lies below one of
+// them. No host path is allowed if the list is empty.
+func hostPathAllowed(hostPath string, allowedPrefixes []string) bool {
+	hostPath = filepath.Clean(hostPath)
+	for _, prefix := range allowedPrefixes {
+		prefix = filepath.Clean(prefix)
+		if hostPath == prefix || strings.HasPrefix(hostPath, strings.TrimSuffix(prefix, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// checkHostPath validates a hostPath volume according to its type, creating the directory or the
+// file for the DirectoryOrCreate and FileOrCreate types, like the kubelet does.
+func checkHostPath(hostPath v1.HostPathVolumeSource) error {
+	pathType := v1.HostPathUnset
+	if hostPath.Type != nil {
+		pathType = *hostPath.Type
+	}
+
+	switch pathType {
+	case v1.HostPathUnset:
+		return nil
+	case v1.HostPathDirectoryOrCreate:
+		return os.MkdirAll(hostPath.Path, 0755)
+	case v1.HostPathFileOrCreate:
+		file, err := os.OpenFile(hostPath.Path, os.O_RDONLY|os.O_CREATE, 0644)
+		if err != nil {
+			return err
+		}
+		return file.Close()
+	}
+
+	info, err := os.Stat(hostPath.Path)
+	if err != nil {
+		return errors.New("host path " + hostPath.Path + " of type " + string(pathType) + " doesn't exist: " + err.Error())
+	}
+	var matches bool
+	switch pathType {
+	case v1.HostPathDirectory:
+		matches = info.IsDir()
+	case v1.HostPathFile:
+		matches = info.Mode().IsRegular()
+	case v1.HostPathSocket:
+		matches = info.Mode()&os.ModeSocket != 0
+	case v1.HostPathCharDev:
+		matches = info.Mode()&os.ModeCharDevice != 0
+	case v1.HostPathBlockDev:
+		matches = info.Mode()&os.ModeDevice != 0 && info.Mode()&os.ModeCharDevice == 0
+	default:
+		return errors.New("unknown type " + string(pathType) + " of host path " + hostPath.Path)
+	}
+	if !matches {
+		return errors.New("host path " + hostPath.Path + " is not of type " + string(pathType))
+	}
+	return nil
+}
+
+// envNameRegex matches the characters which can't be part of a shell variable name.
+var envNameRegex = regexp.MustCompile(`[^A-Za-z0-9_]`)
+
+// resolveFieldRef returns the value of a downwardAPI fieldRef, e.g. metadata.name or metadata.labels['app'].
+// Whole labels and annotations maps are rendered one key="value" per line, sorted by key, like the kubelet does.
+func resolveFieldRef(pod v1.Pod, fieldPath string) (string, error) {
+	renderMap := func(values map[string]string) string {
+		var keys []string
+		for key := range values {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		var lines []string
+		for _, key := range keys {
+			lines = append(lines, key+"="+strconv.Quote(values[key]))
+		}
+		return strings.Join(lines, "\n")
+	}
+
+	switch {
+	case fieldPath == "metadata.name":
+		return pod.Name, nil
+	case fieldPath == "metadata.namespace":
+		return pod.Namespace, nil
+	case fieldPath == "metadata.uid":
+		return string(pod.UID), nil
+	case fieldPath == "metadata.labels":
+		return renderMap(pod.Labels), nil
+	case fieldPath == "metadata.annotations":
+		return renderMap(pod.Annotations), nil
+	case strings.HasPrefix(fieldPath, "metadata.labels['") && strings.HasSuffix(fieldPath, "']"):
+		return pod.Labels[strings.TrimSuffix(strings.TrimPrefix(fieldPath, "metadata.labels['"), "']")], nil
+	case strings.HasPrefix(fieldPath, "metadata.annotations['") && strings.HasSuffix(fieldPath, "']"):
+		return pod.Annotations[strings.TrimSuffix(strings.TrimPrefix(fieldPath, "metadata.annotations['"), "']")], nil
+	}
+	return "", errors.New("unsupported downwardAPI field " + fieldPath)
+}
+
+// volumeFile is a file to be materialized inside a volume directory, at a path relative to it.
+type volumeFile struct {
+	path string
+	data []byte
+	mode os.FileMode
+}
+
+// materializeVolumeFiles writes the files of a volume under dir and returns their bind paths. Without a
+// shared filesystem, the contents are exported as env variables and written by the job script instead,
+// like ConfigMaps and Secrets. Their names include the Pod UID, since the values are Pod specific and
+// the sidecar environment is shared by the concurrent submissions. Private volumes, i.e. the ones
+// holding Secret data, are kept out of reach of other users like Secret volumes: their directories
+// get mode 0700 and their files are never readable by group or others, whatever their mode.
+func materializeVolumeFiles(dir string, files []volumeFile, private bool, envInfix string, container v1.Container, podUID string, mountSpec v1.VolumeMount, Ctx context.Context) ([]string, []string, error) {
+	err := os.RemoveAll(dir)
+	if err != nil {
+		log.G(Ctx).Error("Unable to delete root folder")
+		return nil, nil, err
+	}
+
+	dirMode := os.ModePerm
+	if private && os.Getenv("SHARED_FS") == "true" {
+		dirMode = 0700
+		err = os.MkdirAll(dir, dirMode)
+		if err == nil {
+			err = os.Chmod(filepath.Dir(dir), dirMode)
+		}
+		if err == nil {
+			err = os.Chmod(dir, dirMode)
+		}
+		if err != nil {
+			log.G(Ctx).Error(err)
+			return nil, nil, err
+		}
+	}
+
+	var namePaths []string
+	var envs []string
+	for _, file := range files {
+		fullPath := filepath.Join(dir, file.path)
+		namePaths = append(namePaths, fullPath+":"+mountSpec.MountPath+"/"+file.path+",")
+
+		if os.Getenv("SHARED_FS") != "true" {
+			env := envNameRegex.ReplaceAllString(container.Name+"_"+envInfix+"_"+podUID+"_"+file.path, "_")
+			log.G(Ctx).Debug("---- Setting env " + env + " to mount the file later")
+			os.Setenv(env, string(file.data))
+			envs = append(envs, env)
+			continue
+		}
+
+		err = os.MkdirAll(filepath.Dir(fullPath), dirMode)
+		if err != nil {
+			log.G(Ctx).Error(err)
+			return nil, nil, err
+		}
+		mode := file.mode
+		if private {
+			mode &= 0600
+		}
+		err = os.WriteFile(fullPath, file.data, mode)
+		if err != nil {
+			log.G(Ctx).Errorf("Could not write file %s", fullPath)
+			return nil, nil, err
+		}
+		log.G(Ctx).Debug("--- Written file " + fullPath)
+	}
+	return namePaths, envs, nil
+}
+
+// downwardAPIFiles resolves the fieldRef items of a downwardAPI volume or projection.
+func downwardAPIFiles(pod v1.Pod, items []v1.DownwardAPIVolumeFile, defaultMode os.FileMode, Ctx context.Context) ([]volumeFile, error) {
+	var files []volumeFile
+	for _, item := range items {
+		if item.FieldRef == nil {
+			log.G(Ctx).Warning("---- Only fieldRef items of downwardAPI volumes are supported, skipping " + item.Path)
+			continue
+		}
+		value, err := resolveFieldRef(pod, item.FieldRef.FieldPath)
+		if err != nil {
+			return nil, err
+		}
+		mode := defaultMode
+		if item.Mode != nil {
+			mode = os.FileMode(*item.Mode)
+		}
+		files = append(files, volumeFile{path: item.Path, data: []byte(value), mode: mode})
+	}
+	return files, nil
+}
+
+// keyFiles selects the keys of a ConfigMap or Secret to be projected, honoring the items path overrides.
+// Without items, every key is projected to a file with the same name.
+func keyFiles(data map[string][]byte, items []v1.KeyToPath, defaultMode os.FileMode) []volumeFile {
+	var files []volumeFile
+	if len(items) == 0 {
+		var keys []string
+		for key := range data {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			files = append(files, volumeFile{path: key, data: data[key], mode: defaultMode})
+		}
+		return files
+	}
+	for _, item := range items {
+		value, ok := data[item.Key]
+		if !ok {
+			continue
+		}
+		mode := defaultMode
+		if item.Mode != nil {
+			mode = os.FileMode(*item.Mode)
+		}
+		files = append(files, volumeFile{path: item.Path, data: value, mode: mode})
+	}
+	return files
+}
+
+// mountDownwardAPI materializes the items of a downwardAPI volume in downwardAPI/<volName>, returning
+// their bind paths.
+func mountDownwardAPI(path string, container v1.Container, pod v1.Pod, downwardAPI v1.DownwardAPIVolumeSource, volName string, mountSpec v1.VolumeMount, Ctx context.Context) ([]string, []string, error) {
+	log.G(Ctx).Info("--- Mounting downwardAPI volume " + volName)
+	mode := os.FileMode(0644)
+	if downwardAPI.DefaultMode != nil {
+		mode = os.FileMode(*downwardAPI.DefaultMode)
+	}
+	files, err := downwardAPIFiles(pod, downwardAPI.Items, mode, Ctx)
+	if err != nil {
+		log.G(Ctx).Error(err)
+		return nil, nil, err
+	}
+	return materializeVolumeFiles(filepath.Join(path+"/", "downwardAPI/", volName), files, false, "DAPI", container, string(pod.UID), mountSpec, Ctx)
+}
+
+// projectedVolume bundles a projected volume with the ConfigMaps and Secrets retrieved for its sources.
+type projectedVolume struct {
+	volume     v1.Volume
+	configMaps []v1.ConfigMap
+	secrets    []v1.Secret
+}
+
+// mountProjected materializes all the sources of a projected volume in projected/<volName>, returning
+// their bind paths. ServiceAccount token sources are not supported and are skipped.
+func mountProjected(path string, container v1.Container, pod v1.Pod, projected projectedVolume, mountSpec v1.VolumeMount, Ctx context.Context) ([]string, []string, error) {
+	volName := projected.volume.Name
+	log.G(Ctx).Info("--- Mounting projected volume " + volName)
+	mode := os.FileMode(0644)
+	if projected.volume.Projected.DefaultMode != nil {
+		mode = os.FileMode(*projected.volume.Projected.DefaultMode)
+	}
+
+	var files []volumeFile
+	private := false
+	for _, source := range projected.volume.Projected.Sources {
+		switch {
+		case source.ConfigMap != nil:
+			found := false
+			for _, cfgMap := range projected.configMaps {
+				if cfgMap.Name != source.ConfigMap.Name {
+					continue
+				}
+				found = true
+				data := make(map[string][]byte)
+				for key, value := range cfgMap.Data {
+					data[key] = []byte(value)
+				}
+				for key, value := range cfgMap.BinaryData {
+					data[key] = value
+				}
+				files = append(files, keyFiles(data, source.ConfigMap.Items, mode)...)
+			}
+			if !found && (source.ConfigMap.Optional == nil || !*source.ConfigMap.Optional) {
+				return nil, nil, errors.New("ConfigMap " + source.ConfigMap.Name + " of projected volume " + volName + " has not been retrieved")
+			}
+		case source.Secret != nil:
+			private = true
+			found := false
+			for _, secret := range projected.secrets {
+				if secret.Name != source.Secret.Name {
+					continue
+				}
+				found = true
+				files = append(files, keyFiles(secret.Data, source.Secret.Items, mode)...)
+			}
+			if !found && (source.Secret.Optional == nil || !*source.Secret.Optional) {
+				return nil, nil, errors.New("Secret " + source.Secret.Name + " of projected volume " + volName + " has not been retrieved")
+			}
+		case source.DownwardAPI != nil:
+			downwardAPI, err := downwardAPIFiles(pod, source.DownwardAPI.Items, mode, Ctx)
+			if err != nil {
+				log.G(Ctx).Error(err)
+				return nil, nil, err
+			}
+			files = append(files, downwardAPI...)
+		case source.ServiceAccountToken != nil:
+			log.G(Ctx).Warning("---- ServiceAccount token sources of projected volumes are not supported, skipping " + source.ServiceAccountToken.Path)
+		}
+	}
+
+	return materializeVolumeFiles(filepath.Join(path+"/", "projected/", volName), files, private, "PROJ", container, string(pod.UID), mountSpec, Ctx)
+}
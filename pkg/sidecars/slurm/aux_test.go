@@ -0,0 +1,1067 @@
+package slurm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	commonIL "github.com/intertwin-eu/interlink/pkg/common"
+)
+
+func TestCompactJobState(t *testing.T) {
+	tests := map[string]string{
+		"RUNNING":           "R",
+		"CANCELLED by 1000": "CA",
+		"completed":         "CD",
+		"":                  "",
+		"   ":               "",
+		"UNKNOWN_STATE":     "UNKNOWN_STATE",
+		"OUT_OF_MEMORY\n":   "OOM",
+	}
+	for state, expected := range tests {
+		if compact := compactJobState(state); compact != expected {
+			t.Errorf("compactJobState(%q) = %q, expected %q", state, compact, expected)
+		}
+	}
+}
+
+func TestContainerStepCommand(t *testing.T) {
+	config := commonIL.InterLinkConfig{ContainerSteps: true}
+	tests := []struct {
+		name      string
+		resources v1.ResourceRequirements
+		expected  string
+	}{
+		{
+			name:     "no resources",
+			expected: "srun --ntasks=1 --overlap --cpus-per-task=$SLURM_CPUS_ON_NODE --mem=0",
+		},
+		{
+			name: "limits",
+			resources: v1.ResourceRequirements{Limits: v1.ResourceList{
+				v1.ResourceCPU:    resource.MustParse("1500m"),
+				v1.ResourceMemory: resource.MustParse("1G"),
+			}},
+			expected: "srun --ntasks=1 --exclusive --cpus-per-task=2 --mem=954M",
+		},
+		{
+			name: "limits preferred over requests",
+			resources: v1.ResourceRequirements{
+				Requests: v1.ResourceList{v1.ResourceCPU: resource.MustParse("1"), v1.ResourceMemory: resource.MustParse("1Gi")},
+				Limits:   v1.ResourceList{v1.ResourceCPU: resource.MustParse("4")},
+			},
+			expected: "srun --ntasks=1 --exclusive --cpus-per-task=4 --mem=1024M",
+		},
+		{
+			name:      "memory only",
+			resources: v1.ResourceRequirements{Requests: v1.ResourceList{v1.ResourceMemory: resource.MustParse("512Mi")}},
+			expected:  "srun --ntasks=1 --exclusive --mem=512M",
+		},
+	}
+	for _, test := range tests {
+		command := containerStepCommand(v1.Container{Name: "main", Resources: test.resources}, config)
+		if strings.Join(command, " ") != test.expected {
+			t.Errorf("%s: got %q, expected %q", test.name, strings.Join(command, " "), test.expected)
+		}
+	}
+
+	if command := containerStepCommand(v1.Container{Name: "main"}, commonIL.InterLinkConfig{}); command != nil {
+		t.Errorf("expected no step command when ContainerSteps is disabled, got %q", command)
+	}
+}
+
+func TestResourceFlags(t *testing.T) {
+	withResources := func(name string, cpu string, memory string) v1.Container {
+		return v1.Container{Name: name, Resources: v1.ResourceRequirements{Limits: v1.ResourceList{
+			v1.ResourceCPU:    resource.MustParse(cpu),
+			v1.ResourceMemory: resource.MustParse(memory),
+		}}}
+	}
+	podSpec := v1.PodSpec{
+		InitContainers: []v1.Container{withResources("migrate", "8", "1Gi")},
+		Containers:     []v1.Container{withResources("main", "2", "3Gi"), withResources("sidecar", "1", "1Gi")},
+	}
+
+	// the init container needs more CPUs than the app containers together, but less memory
+	flags := resourceFlags(nil, podSpec, false)
+	if strings.Join(flags, " ") != "--cpus-per-task=8 --mem=4096M" {
+		t.Errorf("got %q, expected --cpus-per-task=8 --mem=4096M", flags)
+	}
+
+	// each container is a task of its own in multi-prog mode
+	podSpec.InitContainers = nil
+	flags = resourceFlags(nil, podSpec, true)
+	if strings.Join(flags, " ") != "--cpus-per-task=2 --mem=4096M" {
+		t.Errorf("got %q in multi-prog mode, expected --cpus-per-task=2 --mem=4096M", flags)
+	}
+
+	flags = resourceFlags([]string{"--cpus-per-task=1", "--mem-per-cpu=1G"}, podSpec, false)
+	if len(flags) != 0 {
+		t.Errorf("got %q, expected the explicit flags to win", flags)
+	}
+}
+
+func TestEmptyDirLimitDirectives(t *testing.T) {
+	limit := resource.MustParse("4Ki")
+	unlimited := v1.Volume{Name: "cache", VolumeSource: v1.VolumeSource{EmptyDir: &v1.EmptyDirVolumeSource{}}}
+	limited := v1.Volume{Name: "scratch", VolumeSource: v1.VolumeSource{EmptyDir: &v1.EmptyDirVolumeSource{SizeLimit: &limit}}}
+
+	if prefix := emptyDirLimitDirectives(v1.PodSpec{Volumes: []v1.Volume{unlimited}}, "/work", 1); prefix != "" {
+		t.Errorf("expected no directives without a sizeLimit, got %q", prefix)
+	}
+
+	bash, err := exec.LookPath("bash")
+	if err != nil {
+		t.Skip("bash is not available")
+	}
+	defer func(interval time.Duration) { emptyDirCheckInterval = interval }(emptyDirCheckInterval)
+	emptyDirCheckInterval = time.Second
+	path := t.TempDir()
+	if err := os.MkdirAll(path+"/emptyDirs/scratch", 0755); err != nil {
+		t.Fatal(err)
+	}
+	prefix := emptyDirLimitDirectives(v1.PodSpec{Volumes: []v1.Volume{unlimited, limited}}, path, 1)
+	// the container fills the EmptyDir past its limit and would then run for a minute
+	container := "{ bash -c 'head -c 65536 /dev/zero > " + path + "/emptyDirs/scratch/data; sleep 60' & " +
+		"pid=$!; echo $pid > " + path + "/main.pid; wait $pid; echo $? > " + path + "/main.status; } &"
+	start := time.Now()
+	output, err := exec.Command(bash, "-c", prefix+"\n"+container+"\nwait").CombinedOutput()
+	if err != nil {
+		t.Fatalf("the job script failed: %v: %s", err, output)
+	}
+	if elapsed := time.Since(start); elapsed > 30*time.Second {
+		t.Errorf("the container has been running for %s, expected it to be killed", elapsed)
+	}
+	if !strings.Contains(string(output), "EmptyDir scratch exceeds its sizeLimit of 4Ki") {
+		t.Errorf("unexpected job output %q", output)
+	}
+	status, err := os.ReadFile(path + "/main.status")
+	if err != nil || strings.TrimSpace(string(status)) != "137" {
+		t.Errorf("container exited with %q (%v), expected 137", status, err)
+	}
+}
+
+func TestMemoryEmptyDirDirectives(t *testing.T) {
+	memoryVolume := v1.Volume{Name: "cache", VolumeSource: v1.VolumeSource{EmptyDir: &v1.EmptyDirVolumeSource{Medium: v1.StorageMediumMemory}}}
+	diskVolume := v1.Volume{Name: "scratch", VolumeSource: v1.VolumeSource{EmptyDir: &v1.EmptyDirVolumeSource{}}}
+
+	prefix, postfix := memoryEmptyDirDirectives(v1.PodSpec{Volumes: []v1.Volume{diskVolume}}, "/work", "uid", commonIL.InterLinkConfig{})
+	if prefix != "" || postfix != "" {
+		t.Errorf("expected no directives without memory EmptyDirs, got %q and %q", prefix, postfix)
+	}
+	prefix, _ = memoryEmptyDirDirectives(v1.PodSpec{Volumes: []v1.Volume{memoryVolume}}, "/work", "uid", commonIL.InterLinkConfig{})
+	if !strings.Contains(prefix, "MEMORY_EMPTYDIRS=\"/dev/shm/interlink-uid\"") {
+		t.Errorf("expected the memory EmptyDirs below /dev/shm by default, got %q", prefix)
+	}
+
+	bash, err := exec.LookPath("bash")
+	if err != nil {
+		t.Skip("bash is not available")
+	}
+	workingPath := t.TempDir()
+	base := t.TempDir()
+	tests := []struct {
+		name     string
+		base     string
+		expected string
+		removed  bool
+	}{
+		{name: "tmpfs", base: base, expected: base + "/interlink-uid", removed: true},
+		// directories can't be created in /proc, so the volumes fall back to the working directory
+		{name: "fallback", base: "/proc/interlink", expected: workingPath + "/emptyDirs", removed: false},
+	}
+	for _, test := range tests {
+		podSpec := v1.PodSpec{Volumes: []v1.Volume{memoryVolume, diskVolume}}
+		prefix, postfix := memoryEmptyDirDirectives(podSpec, workingPath, "uid", commonIL.InterLinkConfig{MemoryEmptyDirBase: test.base})
+		output, err := exec.Command(bash, "-c", prefix+"\necho \"$MEMORY_EMPTYDIRS\""+postfix).Output()
+		if err != nil {
+			t.Fatalf("%s: the directives failed: %v", test.name, err)
+		}
+		if memoryDir := strings.TrimSpace(string(output)); memoryDir != test.expected {
+			t.Errorf("%s: memory EmptyDirs in %q, expected %q", test.name, memoryDir, test.expected)
+		}
+		if _, err := os.Stat(test.expected + "/scratch"); err == nil {
+			t.Errorf("%s: the disk EmptyDir has been created with the memory ones", test.name)
+		}
+		_, err = os.Stat(test.expected + "/cache")
+		if test.removed && err == nil {
+			t.Errorf("%s: the memory EmptyDirs survived the job script", test.name)
+		}
+		if !test.removed && err != nil {
+			t.Errorf("%s: the memory EmptyDir has not been created: %v", test.name, err)
+		}
+	}
+}
+
+func TestHandleJIDKeepsTimestamps(t *testing.T) {
+	path := t.TempDir()
+	pod := v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod", Namespace: "default", UID: "uid"}}
+	JIDs := make(map[string]*JidStruct)
+	h := &SidecarHandler{JIDs: &JIDs, Ctx: context.Background()}
+
+	err := h.handleJID("uid", "Submitted batch job 100\n", pod, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	startTime := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+	endTime := startTime.Add(time.Hour)
+	JIDs["uid"].StartTime = startTime
+	JIDs["uid"].EndTime = endTime
+
+	err = h.handleJID("uid", "Submitted batch job 101\n", pod, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jid := JIDs["uid"]
+	if jid.JID != "101" {
+		t.Errorf("tracked job %s, expected 101", jid.JID)
+	}
+	if !jid.StartTime.Equal(startTime) || !jid.EndTime.Equal(endTime) {
+		t.Errorf("timestamps %s and %s, expected %s and %s", jid.StartTime, jid.EndTime, startTime, endTime)
+	}
+	jidFile, err := os.ReadFile(path + "/JobID.jid")
+	if err != nil || string(jidFile) != "101" {
+		t.Errorf("JobID.jid holds %q (%v), expected 101", jidFile, err)
+	}
+}
+
+func TestCancelForResubmit(t *testing.T) {
+	dir := t.TempDir()
+	calls := dir + "/calls"
+	scancel := dir + "/scancel"
+	squeue := dir + "/squeue"
+	// the job keeps being listed by squeue twice after being cancelled
+	scripts := map[string]string{
+		scancel: "#!/bin/sh\necho \"$@\" > " + dir + "/scancel.args\n",
+		squeue:  "#!/bin/sh\necho call >> " + calls + "\nif [ $(wc -l < " + calls + ") -le 2 ]; then echo COMPLETING; fi\n",
+	}
+	for path, script := range scripts {
+		if err := os.WriteFile(path, []byte(script), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	startTime := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+	JIDs := map[string]*JidStruct{"uid": {PodUID: "uid", JID: "100", StartTime: startTime, EndTime: startTime.Add(time.Hour)}}
+	h := &SidecarHandler{JIDs: &JIDs, Ctx: context.Background(), Config: commonIL.InterLinkConfig{Scancelpath: scancel, Squeuepath: squeue}}
+
+	err := h.cancelForResubmit("uid", "100")
+	if err != nil {
+		t.Fatal(err)
+	}
+	args, err := os.ReadFile(dir + "/scancel.args")
+	if err != nil || strings.TrimSpace(string(args)) != "100" {
+		t.Errorf("scancel called with %q (%v), expected 100", args, err)
+	}
+	squeueCalls, _ := os.ReadFile(calls)
+	if n := strings.Count(string(squeueCalls), "call"); n != 3 {
+		t.Errorf("squeue called %d times, expected 3", n)
+	}
+	if _, ok := JIDs["uid"]; ok {
+		t.Errorf("cancelled job still tracked")
+	}
+
+	// the job submitted next starts with fresh timestamps
+	pod := v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod", Namespace: "default", UID: "uid"}}
+	err = h.handleJID("uid", "Submitted batch job 101\n", pod, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !JIDs["uid"].StartTime.IsZero() || !JIDs["uid"].EndTime.IsZero() {
+		t.Errorf("timestamps %s and %s carried over to the resubmitted job", JIDs["uid"].StartTime, JIDs["uid"].EndTime)
+	}
+}
+
+func TestIsJobActive(t *testing.T) {
+	squeue := t.TempDir() + "/squeue"
+	tests := []struct {
+		script string
+		active bool
+		err    bool
+	}{
+		{script: "echo RUNNING", active: true},
+		{script: "echo COMPLETING", active: true},
+		{script: "echo OUT_OF_MEMORY", active: false},
+		{script: "echo TIMEOUT", active: false},
+		{script: "echo 'slurm_load_jobs error: Invalid job id specified' >&2; exit 1", active: false},
+		{script: "echo 'slurm_load_jobs error: Unable to contact slurm controller' >&2; exit 1", err: true},
+	}
+	for _, test := range tests {
+		if err := os.WriteFile(squeue, []byte("#!/bin/sh\n"+test.script+"\n"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		active, err := isJobActive("100", commonIL.InterLinkConfig{Squeuepath: squeue}, context.Background())
+		if (err != nil) != test.err || active != test.active {
+			t.Errorf("%s: got %t, %v, expected %t and error %t", test.script, active, err, test.active, test.err)
+		}
+	}
+
+	// the startup policy isn't applied blindly when squeue fails
+	JIDs := map[string]*JidStruct{"uid": {PodUID: "uid", JID: "100"}}
+	err := ApplyStartupPolicy(commonIL.InterLinkConfig{Squeuepath: squeue, StartupJobPolicy: "fail"}, &JIDs, context.Background())
+	if err == nil || !strings.Contains(err.Error(), "Unable to contact slurm controller") {
+		t.Errorf("got %v, expected the squeue error", err)
+	}
+}
+
+func TestFollowLogsStops(t *testing.T) {
+	path := t.TempDir()
+	squeue := path + "/squeue"
+	JIDs := map[string]*JidStruct{"uid": {PodUID: "uid", JID: "100"}}
+	h := &SidecarHandler{JIDs: &JIDs, Ctx: context.Background(), Config: commonIL.InterLinkConfig{Squeuepath: squeue}}
+	for state, ended := range map[string]bool{"RUNNING": false, "CANCELLED": true} {
+		if err := os.WriteFile(squeue, []byte("#!/bin/sh\necho "+state+"\n"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if h.jobEnded("uid") != ended {
+			t.Errorf("job %s reported as ended %t, expected %t", state, !ended, ended)
+		}
+	}
+	if !h.jobEnded("untracked") {
+		t.Errorf("the job of an untracked pod is not reported as ended")
+	}
+
+	// following stops as soon as the sidecar shuts down, although the job is still running
+	if err := os.WriteFile(path+"/main.out", []byte("line\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	h.Ctx = ctx
+	done := make(chan struct{})
+	go func() {
+		h.followLogs(httptest.NewRecorder(), httptest.NewRequest("GET", "/getLogs", nil), "uid", path+"/main.out", path+"/main.status", 0)
+		close(done)
+	}()
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("followLogs didn't stop once the sidecar context got cancelled")
+	}
+}
+
+func TestContainerReadyFilteredAnnotations(t *testing.T) {
+	path := t.TempDir()
+	annotations := map[string]string{"job.vk.io/readiness-file": "ready"}
+
+	if containerReady(filterAnnotations(annotations, commonIL.InterLinkConfig{}, context.Background()), path, "main") {
+		t.Errorf("container ready without its readiness file")
+	}
+	// a readiness file the sidecar doesn't allow is ignored
+	config := commonIL.InterLinkConfig{AllowedAnnotations: []string{"slurm-job.vk.io/flags"}}
+	if !containerReady(filterAnnotations(annotations, config, context.Background()), path, "main") {
+		t.Errorf("container not ready although its readiness file annotation is not allowed")
+	}
+}
+
+func TestSchedulePendingCancel(t *testing.T) {
+	dir := t.TempDir()
+	scancel := dir + "/scancel"
+	sacct := dir + "/sacct"
+	scripts := map[string]string{
+		scancel: "#!/bin/sh\necho 'scancel: error: Unable to contact slurm controller' >&2\nexit 1\n",
+		sacct:   "#!/bin/sh\necho '100|CANCELLED by 1000|0:15|||'\n",
+	}
+	for path, script := range scripts {
+		if err := os.WriteFile(path, []byte(script), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	config := commonIL.InterLinkConfig{DataRootFolder: dir + "/", Scancelpath: scancel, Sacctpath: sacct}
+	JIDs := map[string]*JidStruct{"uid": {PodUID: "uid", JID: "100"}}
+	h := &SidecarHandler{JIDs: &JIDs, Ctx: context.Background(), Config: config}
+	cleanupPath := dir + "/default-uid"
+	if err := os.Mkdir(cleanupPath, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// scancel keeps failing, but the job already finished according to sacct, and the index is
+	// written once it stopped being tracked
+	h.schedulePendingCancel("uid", "100", cleanupPath, 0)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := os.Stat(dir + "/" + jidsIndexFile); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the JIDs index has not been written")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, ok := h.lookupJID("uid"); ok {
+		t.Errorf("the finished job is still tracked")
+	}
+	if _, err := os.Stat(cleanupPath); !os.IsNotExist(err) {
+		t.Errorf("%s has not been removed: %v", cleanupPath, err)
+	}
+
+	// a pending cancellation interrupted by the sidecar shutting down is kept for the next start
+	pendingJIDs := map[string]*JidStruct{"uid": {PodUID: "uid", JID: "100"}}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	h = &SidecarHandler{JIDs: &pendingJIDs, Ctx: ctx, Config: config}
+	h.schedulePendingCancel("uid", "100", "", time.Hour)
+	time.Sleep(100 * time.Millisecond)
+	if _, ok := h.lookupJID("uid"); !ok {
+		t.Errorf("the job stopped being tracked although its cancellation didn't run")
+	}
+}
+
+// fakeSbatch writes an sbatch replacement failing with a transient error for the given number of
+// calls, which are counted in the returned file, before submitting the job.
+func fakeSbatch(t *testing.T, failures int) (string, string) {
+	dir := t.TempDir()
+	calls := dir + "/calls"
+	sbatch := dir + "/sbatch"
+	script := "#!/bin/sh\n" +
+		"echo call >> " + calls + "\n" +
+		"if [ $(wc -l < " + calls + ") -le " + strconv.Itoa(failures) + " ]; then\n" +
+		"  echo 'sbatch: error: Socket timed out on send/recv operation' >&2\n" +
+		"  exit 1\n" +
+		"fi\n" +
+		"echo 'Submitted batch job 42'\n"
+	err := os.WriteFile(sbatch, []byte(script), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sbatch, calls
+}
+
+func TestSLURMBatchSubmitRetries(t *testing.T) {
+	if _, err := exec.LookPath("bash"); err != nil {
+		t.Skip("bash is not available")
+	}
+	tests := []struct {
+		name        string
+		failures    int
+		maxAttempts int
+		calls       int
+		submitted   bool
+	}{
+		{name: "no failure", failures: 0, maxAttempts: 3, calls: 1, submitted: true},
+		{name: "transient failures", failures: 2, maxAttempts: 3, calls: 3, submitted: true},
+		{name: "attempts exhausted", failures: 3, maxAttempts: 3, calls: 3, submitted: false},
+		{name: "single attempt", failures: 1, maxAttempts: 1, calls: 1, submitted: false},
+	}
+	for _, test := range tests {
+		sbatch, calls := fakeSbatch(t, test.failures)
+		config := commonIL.InterLinkConfig{Sbatchpath: sbatch, SbatchMaxAttempts: test.maxAttempts, SbatchRetryDelay: "1ms"}
+
+		output, err := SLURMBatchSubmit("job.sh", config, context.Background())
+		if test.submitted && (err != nil || parseJID(output) != "42") {
+			t.Errorf("%s: got %q (%v), expected job 42 to be submitted", test.name, output, err)
+		}
+		if !test.submitted && err == nil {
+			t.Errorf("%s: got %q, expected the submission to fail", test.name, output)
+		}
+		callsFile, err := os.ReadFile(calls)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count := strings.Count(string(callsFile), "call"); count != test.calls {
+			t.Errorf("%s: sbatch called %d times, expected %d", test.name, count, test.calls)
+		}
+	}
+}
+
+// envTestValues are environment values which must reach the containers unchanged.
+var envTestValues = map[string]string{
+	"MULTILINE": "first line\nsecond line",
+	"QUOTES":    `it's "quoted"`,
+	"SPECIAL":   "$HOME `id` $(id) a,b;c\\d",
+	"EMPTY":     "",
+}
+
+func TestPrepareEnvsQuoting(t *testing.T) {
+	bash, err := exec.LookPath("bash")
+	if err != nil {
+		t.Skip("bash is not available")
+	}
+	var container v1.Container
+	container.Name = "main"
+	for name, value := range envTestValues {
+		container.Env = append(container.Env, v1.EnvVar{Name: name, Value: value})
+	}
+
+	// singularity and apptainer read the variables from an env file, sourced here by bash
+	workingPath := t.TempDir()
+	envs, err := prepareEnvs(workingPath, container, commonIL.InterLinkConfig{}, context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(envs) != 2 || envs[0] != "--env-file" {
+		t.Fatalf("got %q, expected an --env-file flag", envs)
+	}
+	for name, value := range envTestValues {
+		output, err := exec.Command(bash, "-c", "source "+envs[1]+"; printf %s \"$"+name+"\"").Output()
+		if err != nil {
+			t.Fatalf("sourcing %s failed: %v", envs[1], err)
+		}
+		if string(output) != value {
+			t.Errorf("env file: %s is %q, expected %q", name, output, value)
+		}
+	}
+
+	// podman gets a quoted --env flag per variable, written as is to the job script
+	envs, err = prepareEnvs(workingPath, container, commonIL.InterLinkConfig{ContainerRuntime: "podman"}, context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(envs) != 2*len(envTestValues) {
+		t.Fatalf("got %q, expected an --env flag per variable", envs)
+	}
+	for i := 0; i < len(envs); i += 2 {
+		output, err := exec.Command(bash, "-c", "printf %s "+envs[i+1]).Output()
+		if err != nil {
+			t.Fatalf("%s doesn't parse: %v", envs[i+1], err)
+		}
+		nameValue := strings.SplitN(string(output), "=", 2)
+		if envs[i] != "--env" || len(nameValue) != 2 || nameValue[1] != envTestValues[nameValue[0]] {
+			t.Errorf("podman flag %s %s expands to %q", envs[i], envs[i+1], output)
+		}
+	}
+
+	described := describeCommand(append([]string{"podman", "run"}, envs...))
+	for name, value := range envTestValues {
+		if !strings.Contains(described, " "+name+"=<redacted>") {
+			t.Errorf("%s is not redacted in %q", name, described)
+		}
+		if value != "" && strings.Contains(described, value) {
+			t.Errorf("the value of %s shows in %q", name, described)
+		}
+	}
+	if strings.Contains(described, "'") {
+		t.Errorf("quotes left in %q", described)
+	}
+}
+
+func TestShellQuote(t *testing.T) {
+	bash, err := exec.LookPath("bash")
+	if err != nil {
+		t.Skip("bash is not available")
+	}
+	for _, value := range envTestValues {
+		output, err := exec.Command(bash, "-c", "printf %s "+shellQuote(value)).Output()
+		if err != nil {
+			t.Fatalf("%s doesn't parse: %v", shellQuote(value), err)
+		}
+		if string(output) != value {
+			t.Errorf("shellQuote(%q) expands to %q", value, output)
+		}
+	}
+}
+
+func TestParseSacctOutputOOM(t *testing.T) {
+	tests := map[string]string{
+		"allocation": "100|OUT_OF_MEMORY|0:125|2024-01-01T10:00:00|2024-01-01T11:00:00|node1\n" +
+			"100.batch|OUT_OF_MEMORY|0:125|2024-01-01T10:00:00|2024-01-01T11:00:00|node1\n",
+		"step": "100|FAILED|1:0|2024-01-01T10:00:00|2024-01-01T11:00:00|node1\n" +
+			"100.batch|FAILED|1:0|2024-01-01T10:00:00|2024-01-01T11:00:00|node1\n" +
+			"100.0|OUT_OF_MEMORY|0:125|2024-01-01T10:00:00|2024-01-01T11:00:00|node1\n",
+	}
+	for name, output := range tests {
+		sacctInfo, err := parseSacctOutput("100", output)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !sacctInfo.OOM || sacctInfo.ExitCode != oomKilledExitCode || sacctInfo.Signal != 9 {
+			t.Errorf("%s: got OOM %v, exit code %d and signal %d, expected an OOM kill", name, sacctInfo.OOM, sacctInfo.ExitCode, sacctInfo.Signal)
+		}
+	}
+
+	// the containers without a .status file, or killed by the OOM SIGKILL, are reported as OOMKilled
+	path := t.TempDir()
+	err := os.WriteFile(path+"/killed.status", []byte("137"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pod := &v1.Pod{Spec: v1.PodSpec{Containers: []v1.Container{{Name: "missing"}, {Name: "killed"}}}}
+	jid := &JidStruct{JID: "100"}
+	h := &SidecarHandler{JIDs: &map[string]*JidStruct{"uid": jid}, Ctx: context.Background()}
+	for _, status := range h.terminatedContainerStatuses(pod, path, jid, oomKilledExitCode, "OOMKilled") {
+		terminated := status.State.Terminated
+		if terminated == nil || terminated.Reason != "OOMKilled" || terminated.ExitCode != oomKilledExitCode {
+			t.Errorf("container %s: got %+v, expected OOMKilled", status.Name, terminated)
+		}
+	}
+}
+
+func TestSplitFlags(t *testing.T) {
+	tests := map[string][]string{
+		"":                                     nil,
+		"  --mem=1G   --time=10 ":              {"--mem=1G", "--time=10"},
+		`--comment="my job" -J name`:           {`--comment="my job"`, "-J", "name"},
+		`--comment='it "is" mine' --exclusive`: {`--comment='it "is" mine'`, "--exclusive"},
+		`--comment=my\ job --qos=low`:          {`--comment=my\ job`, "--qos=low"},
+		"--mem=1G\n--time=10\t-N 2":            {"--mem=1G", "--time=10", "-N", "2"},
+	}
+	for flags, expected := range tests {
+		tokens := splitFlags(flags)
+		if strings.Join(tokens, "|") != strings.Join(expected, "|") || len(tokens) != len(expected) {
+			t.Errorf("splitFlags(%q) = %q, expected %q", flags, tokens, expected)
+		}
+	}
+}
+
+func TestProduceSLURMScriptFlags(t *testing.T) {
+	path := t.TempDir()
+	metadata := metav1.ObjectMeta{Annotations: map[string]string{"slurm-job.vk.io/flags": `--comment="hello world" --mem=4G`}}
+	commands := []SingularityCommand{{containerName: "main", command: []string{"singularity", "exec", "image", "main"}}}
+	config := commonIL.InterLinkConfig{BashPath: "/bin/bash"}
+	scriptPath, err := produceSLURMScript(path, "default", "uid", metadata, v1.PodSpec{}, commands, "", nil, config, context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	script, err := os.ReadFile(scriptPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var flags []string
+	for _, line := range strings.Split(string(script), "\n") {
+		if strings.TrimSpace(line) == "#SBATCH" {
+			t.Errorf("job.sh holds a blank #SBATCH line")
+		}
+		if strings.HasPrefix(line, "#SBATCH --comment") || strings.HasPrefix(line, "#SBATCH --mem") {
+			flags = append(flags, line)
+		}
+	}
+	expected := []string{`#SBATCH --comment="hello world"`, "#SBATCH --mem=4G"}
+	if strings.Join(flags, "|") != strings.Join(expected, "|") {
+		t.Errorf("job.sh holds the flags %q, expected %q", flags, expected)
+	}
+}
+
+func TestProduceSLURMScriptMPIFlags(t *testing.T) {
+	path := t.TempDir()
+	metadata := metav1.ObjectMeta{Annotations: map[string]string{"slurm-job.vk.io/mpi-flags": `--bind-to core -x "OMP_NUM_THREADS=2"`}}
+	commands := []SingularityCommand{
+		{containerName: "first", command: []string{"singularity", "exec", "image", "first"}},
+		{containerName: "second", command: []string{"singularity", "exec", "image", "second"}},
+	}
+	config := commonIL.InterLinkConfig{BashPath: "/bin/bash"}
+	_, err := produceSLURMScript(path, "default", "uid", metadata, v1.PodSpec{}, commands, "", nil, config, context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, command := range commands {
+		expected := `mpiexec -np $SLURM_NTASKS --bind-to core -x "OMP_NUM_THREADS=2" singularity exec image ` + command.containerName
+		if strings.Join(command.command, " ") != expected {
+			t.Errorf("container %s runs %q, expected %q", command.containerName, command.command, expected)
+		}
+	}
+}
+
+func TestResolveGres(t *testing.T) {
+	tests := map[string]bool{
+		"gpu:2":               true,
+		"gpu:a100:2,mps:100":  true,
+		"gpu:2\n#SBATCH -A x": false,
+		"gpu:2 --exclusive":   false,
+		"gpu:$(id)":           false,
+		"":                    false,
+	}
+	for gres, valid := range tests {
+		metadata := metav1.ObjectMeta{Annotations: map[string]string{"slurm-job.vk.io/gres": gres}}
+		resolved, err := resolveGres(nil, metadata, v1.PodSpec{}, commonIL.InterLinkConfig{})
+		if valid && (err != nil || resolved != gres) {
+			t.Errorf("resolveGres(%q) = %q, %v, expected it unchanged", gres, resolved, err)
+		}
+		if !valid && !errors.Is(err, errInvalidScript) {
+			t.Errorf("resolveGres(%q) = %q, %v, expected an invalid script error", gres, resolved, err)
+		}
+	}
+}
+
+func TestUntrackedPodStatus(t *testing.T) {
+	JIDs := make(map[string]*JidStruct)
+	h := &SidecarHandler{JIDs: &JIDs, Ctx: context.Background()}
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "pod", Namespace: "default", UID: "uid"},
+		Spec:       v1.PodSpec{Containers: []v1.Container{{Name: "first"}, {Name: "second"}}},
+	}
+	path := t.TempDir() + "/default-uid"
+
+	tests := []struct {
+		name   string
+		setup  func() error
+		reason string
+	}{
+		{name: "no working directory", setup: func() error { return nil }, reason: "JobNotFound"},
+		{name: "submission in progress", setup: func() error { return os.Mkdir(path, 0755) }, reason: "ContainerCreating"},
+		{name: "submitted", setup: func() error { return os.WriteFile(path+"/"+submittedSentinel, nil, 0644) }, reason: "JobNotFound"},
+	}
+	for _, test := range tests {
+		if err := test.setup(); err != nil {
+			t.Fatal(err)
+		}
+		podStatus, err := h.jobPodStatus(pod, path, squeueJob{State: "R"}, time.Now())
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if podStatus.PodUID != "uid" || podStatus.Phase != v1.PodPending || len(podStatus.Containers) != 2 {
+			t.Errorf("%s: got %+v, expected a pending status for the two containers", test.name, podStatus)
+		}
+		for _, status := range podStatus.Containers {
+			if status.State.Waiting == nil || status.State.Waiting.Reason != test.reason {
+				t.Errorf("%s: container %s in state %+v, expected waiting for %s", test.name, status.Name, status.State, test.reason)
+			}
+		}
+	}
+}
+
+func TestMountDataSecretPermissions(t *testing.T) {
+	t.Setenv("SHARED_FS", "true")
+	path := t.TempDir()
+	defaultMode := int32(0644)
+	pod := v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "pod", Namespace: "default", UID: "uid"},
+		Spec: v1.PodSpec{Volumes: []v1.Volume{{
+			Name:         "credentials",
+			VolumeSource: v1.VolumeSource{Secret: &v1.SecretVolumeSource{SecretName: "credentials", DefaultMode: &defaultMode}},
+		}}},
+	}
+	container := v1.Container{Name: "main", VolumeMounts: []v1.VolumeMount{{Name: "credentials", MountPath: "/etc/credentials"}}}
+	secret := v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "credentials"},
+		Data:       map[string][]byte{"username": []byte("user"), "password": []byte("secret")},
+	}
+
+	_, _, err := mountData(path, container, pod, secret, commonIL.InterLinkConfig{ExportPodData: true}, context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]os.FileMode{
+		path + "/secrets":                      0700,
+		path + "/secrets/credentials":          0700,
+		path + "/secrets/credentials/username": 0600,
+		path + "/secrets/credentials/password": 0600,
+	}
+	for file, mode := range expected {
+		info, err := os.Stat(file)
+		if err != nil {
+			t.Errorf("%s: %v", file, err)
+			continue
+		}
+		if info.Mode().Perm() != mode {
+			t.Errorf("%s has mode %o, expected %o", file, info.Mode().Perm(), mode)
+		}
+	}
+
+	// a projected volume with a Secret source is as private as a Secret volume
+	projected := v1.Volume{
+		Name: "bundle",
+		VolumeSource: v1.VolumeSource{Projected: &v1.ProjectedVolumeSource{DefaultMode: &defaultMode, Sources: []v1.VolumeProjection{
+			{ConfigMap: &v1.ConfigMapProjection{LocalObjectReference: v1.LocalObjectReference{Name: "settings"}}},
+			{Secret: &v1.SecretProjection{LocalObjectReference: v1.LocalObjectReference{Name: "credentials"}, Items: []v1.KeyToPath{{Key: "password", Path: "nested/password"}}}},
+		}}},
+	}
+	pod.Spec.Volumes = append(pod.Spec.Volumes, projected)
+	container.VolumeMounts = []v1.VolumeMount{{Name: "bundle", MountPath: "/etc/bundle"}}
+	settings := v1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "settings"}, Data: map[string]string{"app.conf": "debug"}}
+
+	_, _, err = mountData(path, container, pod, projectedVolume{volume: projected, configMaps: []v1.ConfigMap{settings}, secrets: []v1.Secret{secret}}, commonIL.InterLinkConfig{ExportPodData: true}, context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = map[string]os.FileMode{
+		path + "/projected":                        0700,
+		path + "/projected/bundle":                 0700,
+		path + "/projected/bundle/nested":          0700,
+		path + "/projected/bundle/app.conf":        0600,
+		path + "/projected/bundle/nested/password": 0600,
+	}
+	for file, mode := range expected {
+		info, err := os.Stat(file)
+		if err != nil {
+			t.Errorf("%s: %v", file, err)
+			continue
+		}
+		if info.Mode().Perm() != mode {
+			t.Errorf("%s has mode %o, expected %o", file, info.Mode().Perm(), mode)
+		}
+	}
+}
+
+func TestWriteVolumeFilesFailure(t *testing.T) {
+	dir := t.TempDir() + "/volume"
+	err := os.Mkdir(dir, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the second key can't be written, its directory doesn't exist
+	files := map[string][]byte{
+		"a.conf":         []byte("first"),
+		"missing/b.conf": []byte("second"),
+	}
+	err = writeVolumeFiles(dir, files, 0644, context.Background())
+	if err == nil {
+		t.Fatal("expected the write of missing/b.conf to fail")
+	}
+	if _, err := os.Stat(dir + "/a.conf"); !os.IsNotExist(err) {
+		t.Errorf("a.conf has been left behind: %v", err)
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("the volume directory has been left behind: %v", err)
+	}
+
+	err = os.Mkdir(dir, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = writeVolumeFiles(dir, map[string][]byte{"a.conf": []byte("first"), "b.conf": []byte("second")}, 0644, context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, content := range map[string]string{"a.conf": "first", "b.conf": "second"} {
+		if written, err := os.ReadFile(dir + "/" + key); err != nil || string(written) != content {
+			t.Errorf("%s holds %q (%v), expected %q", key, written, err, content)
+		}
+	}
+}
+
+func TestHandleJIDUnexpectedOutput(t *testing.T) {
+	pod := v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod", Namespace: "default", UID: "uid"}}
+	tests := map[string]string{
+		"empty":      "",
+		"error only": "sbatch: error: Batch job submission failed: Invalid account\n",
+		"no number":  "Submitted batch job \n",
+		"other text": "Job 100 queued\n",
+	}
+	for name, output := range tests {
+		path := t.TempDir()
+		JIDs := make(map[string]*JidStruct)
+		h := &SidecarHandler{JIDs: &JIDs, Ctx: context.Background()}
+		err := h.handleJID("uid", output, pod, path)
+		if err == nil {
+			t.Errorf("%s: expected an error for sbatch output %q", name, output)
+		}
+		if len(JIDs) != 0 {
+			t.Errorf("%s: job %+v tracked", name, JIDs["uid"])
+		}
+		if _, err := os.Stat(path + "/JobID.jid"); !os.IsNotExist(err) {
+			t.Errorf("%s: JobID.jid has been written", name)
+		}
+	}
+
+	// banners printed by the site configuration around the submission line are ignored
+	path := t.TempDir()
+	JIDs := make(map[string]*JidStruct)
+	h := &SidecarHandler{JIDs: &JIDs, Ctx: context.Background()}
+	err := h.handleJID("uid", "Welcome to the cluster\nSubmitted batch job 100\nHave a nice day\n", pod, path)
+	if err != nil || JIDs["uid"] == nil || JIDs["uid"].JID != "100" {
+		t.Errorf("got %+v (%v), expected job 100 to be tracked", JIDs["uid"], err)
+	}
+}
+
+func TestMultiContainerExitCodes(t *testing.T) {
+	path := t.TempDir()
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "pod", Namespace: "default", UID: "uid"},
+		Spec:       v1.PodSpec{Containers: []v1.Container{{Name: "main"}, {Name: "sidecar"}, {Name: "worker"}}},
+	}
+	JIDs := map[string]*JidStruct{"uid": {PodUID: "uid", JID: "100", ContainerNames: []string{"main", "sidecar", "worker"}}}
+	h := &SidecarHandler{JIDs: &JIDs, Ctx: context.Background(), Config: commonIL.InterLinkConfig{Sacctpath: path + "/sacct"}}
+
+	writeStatus := func(container string, status string) {
+		if err := os.WriteFile(path+"/"+container+".status", []byte(status), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	exitCodes := func(podStatus commonIL.PodStatus) map[string]string {
+		if len(podStatus.Containers) != len(pod.Spec.Containers) {
+			t.Errorf("got %d container statuses, expected %d", len(podStatus.Containers), len(pod.Spec.Containers))
+		}
+		states := make(map[string]string)
+		for _, status := range podStatus.Containers {
+			switch {
+			case status.State.Terminated != nil:
+				states[status.Name] = strconv.Itoa(int(status.State.Terminated.ExitCode)) + " " + status.State.Terminated.Reason
+			case status.State.Running != nil:
+				states[status.Name] = "running"
+			default:
+				states[status.Name] = "waiting"
+			}
+		}
+		return states
+	}
+
+	// while the job runs, the containers which already ended report their own exit code
+	writeStatus("sidecar", "3")
+	podStatus, err := h.jobPodStatus(pod, path, squeueJob{State: "R"}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{"main": "running", "sidecar": "3 Error", "worker": "running"}
+	for container, state := range exitCodes(podStatus) {
+		if state != expected[container] {
+			t.Errorf("running job: container %s is %q, expected %q", container, state, expected[container])
+		}
+	}
+	if podStatus.Phase != v1.PodRunning {
+		t.Errorf("running job: Pod phase %s, expected Running", podStatus.Phase)
+	}
+
+	// once the job ended, every container reports its own exit code
+	writeStatus("main", "0")
+	writeStatus("worker", "137")
+	podStatus, err = h.jobPodStatus(pod, path, squeueJob{State: ""}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = map[string]string{"main": "0 Completed", "sidecar": "3 Error", "worker": "137 Killed"}
+	for container, state := range exitCodes(podStatus) {
+		if state != expected[container] {
+			t.Errorf("ended job: container %s is %q, expected %q", container, state, expected[container])
+		}
+	}
+	if podStatus.Phase != v1.PodFailed {
+		t.Errorf("ended job: Pod phase %s, expected Failed", podStatus.Phase)
+	}
+}
+
+func TestPrepareMountsPrefixPerPod(t *testing.T) {
+	t.Setenv("SHARED_FS", "false")
+	config := commonIL.InterLinkConfig{ExportPodData: true, BashPath: "/bin/bash"}
+	// submit prepares the mounts of a pod and produces its job script, returning its content
+	submit := func(uid string) (string, string, error) {
+		workingPath := t.TempDir() + "/default-" + uid
+		pod := v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: uid, Namespace: "default", UID: types.UID(uid)},
+			Spec: v1.PodSpec{Volumes: []v1.Volume{{
+				Name:         "config",
+				VolumeSource: v1.VolumeSource{Secret: &v1.SecretVolumeSource{SecretName: "config-" + uid, DefaultMode: new(int32)}},
+			}}},
+		}
+		container := v1.Container{Name: "main", VolumeMounts: []v1.VolumeMount{{Name: "config", MountPath: "/etc/config"}}}
+		secret := v1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "config-" + uid}, Data: map[string][]byte{"key": []byte(uid)}}
+		data := []commonIL.RetrievedPodData{{Pod: pod, Containers: []commonIL.RetrievedContainer{{Name: container.Name, Secrets: []v1.Secret{secret}}}}}
+		_, prefix, err := prepareMounts(workingPath, container, data, config, context.Background())
+		if err != nil {
+			return workingPath, "", err
+		}
+		commands := []SingularityCommand{{containerName: container.Name, command: []string{"singularity", "exec", "image"}}}
+		scriptPath, err := produceSLURMScript(workingPath, "default", uid, pod.ObjectMeta, pod.Spec, commands, prefix, nil, config, context.Background())
+		if err != nil {
+			return workingPath, "", err
+		}
+		script, err := os.ReadFile(scriptPath)
+		return workingPath, string(script), err
+	}
+
+	// the pods are submitted concurrently, as by parallel requests, and none gets the lines of the other
+	type submitted struct {
+		workingPath string
+		script      string
+		err         error
+	}
+	secretEnv := regexp.MustCompile(`echo "\$([A-Za-z0-9_]+)"`)
+	uids := []string{"first", "second"}
+	results := make([]chan submitted, len(uids))
+	for i, uid := range uids {
+		results[i] = make(chan submitted, 1)
+		go func(result chan<- submitted, uid string) {
+			workingPath, script, err := submit(uid)
+			result <- submitted{workingPath, script, err}
+		}(results[i], uid)
+	}
+	first, second := <-results[0], <-results[1]
+	for i, result := range []submitted{first, second} {
+		if result.err != nil {
+			t.Fatal(result.err)
+		}
+		if strings.Count(result.script, "\nmkdir -p ") != 1 || !strings.Contains(result.script, "\nmkdir -p "+result.workingPath) {
+			t.Errorf("job script %q doesn't only write the Secret of %s", result.script, result.workingPath)
+		}
+		// the containers share their name, the Secret contents are still exported per pod
+		if match := secretEnv.FindStringSubmatch(result.script); match == nil || os.Getenv(match[1]) != uids[i] {
+			t.Errorf("job script %q doesn't write the Secret content of pod %s", result.script, uids[i])
+		}
+	}
+	if strings.Contains(first.script, second.workingPath) || strings.Contains(second.script, first.workingPath) {
+		t.Errorf("the job scripts %q and %q are mixed", first.script, second.script)
+	}
+}
+
+func TestStatusCachePerPod(t *testing.T) {
+	JIDs := map[string]*JidStruct{
+		"first":  {PodUID: "first", JID: "100"},
+		"second": {PodUID: "second", JID: "101"},
+	}
+	h := &SidecarHandler{JIDs: &JIDs, Ctx: context.Background(), Config: commonIL.InterLinkConfig{DataRootFolder: t.TempDir() + "/"}}
+	h.statusCache = map[string]*cachedPodStatus{
+		"first":  {status: commonIL.PodStatus{PodUID: "first", Phase: v1.PodRunning}, refreshed: time.Now()},
+		"second": {status: commonIL.PodStatus{PodUID: "second", Phase: v1.PodSucceeded}, refreshed: time.Now()},
+	}
+
+	// every request gets the cached status of its own pods only, not the last computed response
+	for uid, phase := range map[string]v1.PodPhase{"second": v1.PodSucceeded, "first": v1.PodRunning} {
+		body, err := json.Marshal([]*v1.Pod{{ObjectMeta: metav1.ObjectMeta{Name: uid, Namespace: "default", UID: types.UID(uid)}}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		recorder := httptest.NewRecorder()
+		h.getStatus(recorder, body)
+		var resp []commonIL.PodStatus
+		err = json.Unmarshal(recorder.Body.Bytes(), &resp)
+		if err != nil {
+			t.Fatalf("%s: %v in %q", uid, err, recorder.Body.String())
+		}
+		if len(resp) != 1 || resp[0].PodUID != uid || resp[0].Phase != phase {
+			t.Errorf("%s: got %+v, expected the %s status of the pod only", uid, resp, phase)
+		}
+	}
+}
+
+func TestCleanWorkingDir(t *testing.T) {
+	createFiles := func(path string) {
+		for _, file := range []string{"job.sh", "main.out", "secrets/credentials/password", "emptyDirs/cache/data"} {
+			err := os.MkdirAll(filepath.Dir(path+"/"+file), 0755)
+			if err == nil {
+				err = os.WriteFile(path+"/"+file, []byte(file), 0644)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// a Pod submitted again keeps the content of its EmptyDirs, and only them
+	path := t.TempDir() + "/default-uid"
+	createFiles(path)
+	cleanWorkingDir(path, true, context.Background())
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "emptyDirs" {
+		t.Errorf("got %v left in the working directory, expected only emptyDirs", entries)
+	}
+	if data, err := os.ReadFile(path + "/emptyDirs/cache/data"); err != nil || string(data) != "emptyDirs/cache/data" {
+		t.Errorf("the EmptyDir content is %q (%v)", data, err)
+	}
+
+	// a deleted Pod loses them
+	createFiles(path)
+	cleanEmptyDirs(path, context.Background())
+	if _, err := os.Stat(path + "/emptyDirs"); !os.IsNotExist(err) {
+		t.Errorf("the EmptyDirs survived the Pod deletion: %v", err)
+	}
+	cleanWorkingDir(path, false, context.Background())
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("the working directory survived: %v", err)
+	}
+}
@@ -0,0 +1,44 @@
+package slurm
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// The sidecar metrics are registered to the default Prometheus registry and exposed on /metrics.
+var (
+	requestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "slurm_sidecar",
+		Name:      "requests_total",
+		Help:      "Number of submit, delete and status requests received.",
+	}, []string{"request"})
+
+	requestFailuresTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "slurm_sidecar",
+		Name:      "request_failures_total",
+		Help:      "Number of submit, delete and status requests which failed.",
+	}, []string{"request"})
+
+	commandDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "slurm_sidecar",
+		Name:      "command_duration_seconds",
+		Help:      "Execution time of the sbatch and squeue calls.",
+		Buckets:   prometheus.ExponentialBuckets(0.05, 2, 10),
+	}, []string{"command"})
+
+	trackedJobs = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "slurm_sidecar",
+		Name:      "tracked_jobs",
+		Help:      "Number of Slurm jobs currently tracked by the sidecar.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(requestsTotal, requestFailuresTotal, commandDuration, trackedJobs)
+}
+
+// observeCommand records the time elapsed since start as an execution of command.
+func observeCommand(command string, start time.Time) {
+	commandDuration.WithLabelValues(command).Observe(time.Since(start).Seconds())
+}
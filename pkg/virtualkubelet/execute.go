@@ -5,6 +5,7 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"os"
@@ -84,6 +85,34 @@ func createRequest(pod commonIL.PodCreateRequests, token string, config commonIL
 	return returnValue, nil
 }
 
+// updateRequest sends the current ConfigMaps and Secrets of an already created Pod to InterLink.
+func updateRequest(pod commonIL.PodCreateRequests, token string, config commonIL.InterLinkConfig) ([]byte, error) {
+	bodyBytes, err := json.Marshal(pod)
+	if err != nil {
+		log.L.Error(err)
+		return nil, err
+	}
+	reader := bytes.NewReader(bodyBytes)
+	req, err := http.NewRequest(http.MethodPost, config.Interlinkurl+":"+config.Interlinkport+"/update", reader)
+	if err != nil {
+		log.L.Error(err)
+		return nil, err
+	}
+
+	req.Header.Add("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.L.Error(err)
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("Unexpected error occured while updating Pods. Status code: " + strconv.Itoa(resp.StatusCode) + ". Check InterLink's logs for further informations")
+	}
+	return io.ReadAll(resp.Body)
+}
+
 func deleteRequest(pod *v1.Pod, token string, config commonIL.InterLinkConfig) ([]byte, error) {
 	bodyBytes, err := json.Marshal(pod)
 	if err != nil {
@@ -210,7 +239,7 @@ func RemoteExecution(ctx context.Context, mode int8, pod *v1.Pod, config commonI
 	token := string(b)
 
 	switch mode {
-	case CREATE:
+	case CREATE, UPDATE:
 
 		var req commonIL.PodCreateRequests
 		req.Pod = *pod
@@ -253,10 +282,55 @@ func RemoteExecution(ctx context.Context, mode int8, pod *v1.Pod, config commonI
 					} else {
 						req.Secrets = append(req.Secrets, *scrt)
 					}
+				} else if volume.Projected != nil {
+					for _, source := range volume.Projected.Sources {
+						if source.ConfigMap != nil && !hasConfigMap(req.ConfigMaps, source.ConfigMap.Name) {
+							cfgmap, err := ClientSet.CoreV1().ConfigMaps(pod.Namespace).Get(ctx, source.ConfigMap.Name, metav1.GetOptions{})
+							if err != nil {
+								if source.ConfigMap.Optional != nil && *source.ConfigMap.Optional {
+									continue
+								}
+								failed = true
+								log.G(ctx).Warning("Unable to find ConfigMap " + source.ConfigMap.Name + " for pod " + pod.Name + ". Waiting for it to be initialized")
+								break
+							}
+							req.ConfigMaps = append(req.ConfigMaps, *cfgmap)
+						} else if source.Secret != nil && !hasSecret(req.Secrets, source.Secret.Name) {
+							scrt, err := ClientSet.CoreV1().Secrets(pod.Namespace).Get(ctx, source.Secret.Name, metav1.GetOptions{})
+							if err != nil {
+								if source.Secret.Optional != nil && *source.Secret.Optional {
+									continue
+								}
+								failed = true
+								log.G(ctx).Warning("Unable to find Secret " + source.Secret.Name + " for pod " + pod.Name + ". Waiting for it to be initialized")
+								break
+							}
+							req.Secrets = append(req.Secrets, *scrt)
+						}
+					}
+					if failed {
+						break
+					}
+				}
+			}
+
+			for _, pullSecret := range pod.Spec.ImagePullSecrets {
+				if failed || hasSecret(req.Secrets, pullSecret.Name) {
+					continue
+				}
+				// as for the kubelet, a missing pull Secret doesn't prevent the Pod from starting
+				scrt, err := ClientSet.CoreV1().Secrets(pod.Namespace).Get(ctx, pullSecret.Name, metav1.GetOptions{})
+				if err != nil {
+					log.G(ctx).Warning("Unable to find image pull Secret " + pullSecret.Name + " for pod " + pod.Name + ": " + err.Error())
+					continue
 				}
+				req.Secrets = append(req.Secrets, *scrt)
 			}
 
-			if failed {
+			if failed && mode == UPDATE {
+				// the values already mounted are kept until the next refresh
+				return errors.New("unable to retrieve the ConfigMaps and Secrets of pod " + pod.Name)
+			} else if failed {
 				time.Sleep(time.Second)
 				continue
 			} else {
@@ -264,6 +338,16 @@ func RemoteExecution(ctx context.Context, mode int8, pod *v1.Pod, config commonI
 			}
 		}
 
+		if mode == UPDATE {
+			returnVal, err := updateRequest(req, token, config)
+			if err != nil {
+				log.G(ctx).Error(err)
+				return err
+			}
+			log.G(ctx).Debug(string(returnVal))
+			return nil
+		}
+
 		returnVal, err := createRequest(req, token, config)
 		if err != nil {
 			log.G(ctx).Error(err)
@@ -282,17 +366,34 @@ func RemoteExecution(ctx context.Context, mode int8, pod *v1.Pod, config commonI
 	return nil
 }
 
+// hasConfigMap reports whether a ConfigMap with the given name has already been retrieved.
+func hasConfigMap(configMaps []v1.ConfigMap, name string) bool {
+	for _, cfgmap := range configMaps {
+		if cfgmap.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// hasSecret reports whether a Secret with the given name has already been retrieved.
+func hasSecret(secrets []v1.Secret, name string) bool {
+	for _, scrt := range secrets {
+		if scrt.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
 func checkPodsStatus(p *VirtualKubeletProvider, ctx context.Context, token string, config commonIL.InterLinkConfig) error {
-	if len(p.pods) == 0 {
+	PodsList := p.podsSnapshot()
+	if len(PodsList) == 0 {
 		return nil
 	}
 	var returnVal []byte
 	var ret []commonIL.PodStatus
-	var PodsList []*v1.Pod
 
-	for _, pod := range p.pods {
-		PodsList = append(PodsList, pod)
-	}
 	//log.G(ctx).Debug(p.pods) //commented out because it's too verbose. uncomment to see all registered pods
 
 	returnVal, err := statusRequest(PodsList, token, config)
@@ -315,6 +416,30 @@ func checkPodsStatus(p *VirtualKubeletProvider, ctx context.Context, token strin
 			}
 
 			if podStatus.PodUID == string(pod.UID) {
+				for key, value := range podStatus.Annotations {
+					if pod.Annotations[key] != value {
+						if pod.Annotations == nil {
+							pod.Annotations = make(map[string]string)
+						}
+						pod.Annotations[key] = value
+						updatePod = true
+					}
+				}
+
+				if podStatus.HostIP != "" && pod.Status.HostIP != podStatus.HostIP {
+					pod.Status.HostIP = podStatus.HostIP
+					updatePod = true
+				}
+				if podStatus.PodIP != "" && pod.Status.PodIP != podStatus.PodIP {
+					pod.Status.PodIP = podStatus.PodIP
+					pod.Status.PodIPs = []v1.PodIP{{IP: podStatus.PodIP}}
+					updatePod = true
+				}
+
+				// the Pod phase reflects the worst state among its containers
+				anyFailed := false
+				anyRunning := false
+				allTerminated := len(podStatus.Containers) > 0
 				for _, containerStatus := range podStatus.Containers {
 					index := 0
 
@@ -324,29 +449,47 @@ func checkPodsStatus(p *VirtualKubeletProvider, ctx context.Context, token strin
 						}
 					}
 
+					if pod.Status.ContainerStatuses != nil && pod.Status.ContainerStatuses[index].Name == containerStatus.Name &&
+						pod.Status.ContainerStatuses[index].RestartCount != containerStatus.RestartCount {
+						// the job was resubmitted after a failure
+						pod.Status.ContainerStatuses[index].RestartCount = containerStatus.RestartCount
+						updatePod = true
+					}
+
 					if containerStatus.State.Terminated != nil {
 						log.G(ctx).Debug("Pod " + podStatus.PodName + ": Service " + containerStatus.Name + " is not running on Sidecar")
-						updatePod = false
-						if containerStatus.State.Terminated.ExitCode == 0 {
-							pod.Status.Phase = v1.PodSucceeded
-							updatePod = true
-						} else {
-							pod.Status.Phase = v1.PodFailed
-							updatePod = true
-							log.G(ctx).Error("Container " + containerStatus.Name + " exited with error: " + string(containerStatus.State.Terminated.ExitCode))
+						if containerStatus.State.Terminated.ExitCode != 0 {
+							anyFailed = true
+							log.G(ctx).Error("Container " + containerStatus.Name + " exited with error: " + fmt.Sprint(containerStatus.State.Terminated.ExitCode))
 						}
 					} else if containerStatus.State.Waiting != nil {
 						log.G(ctx).Info("Pod " + podStatus.PodName + ": Service " + containerStatus.Name + " is setting up on Sidecar")
-						updatePod = false
+						allTerminated = false
 					} else if containerStatus.State.Running != nil {
-						pod.Status.Phase = v1.PodRunning
-						updatePod = true
+						anyRunning = true
+						allTerminated = false
 						if pod.Status.ContainerStatuses != nil {
 							pod.Status.ContainerStatuses[index].State = containerStatus.State
 							pod.Status.ContainerStatuses[index].Ready = containerStatus.Ready
 						}
 					}
 				}
+
+				switch {
+				case podStatus.Phase != "" && podStatus.Phase != v1.PodPending:
+					// the sidecar already aggregated the state of the containers
+					pod.Status.Phase = podStatus.Phase
+					updatePod = true
+				case anyFailed:
+					pod.Status.Phase = v1.PodFailed
+					updatePod = true
+				case allTerminated:
+					pod.Status.Phase = v1.PodSucceeded
+					updatePod = true
+				case anyRunning:
+					pod.Status.Phase = v1.PodRunning
+					updatePod = true
+				}
 			}
 
 			if updatePod {
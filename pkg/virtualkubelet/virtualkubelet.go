@@ -8,6 +8,7 @@ import (
 	"math/rand"
 	"os"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/containerd/containerd/log"
@@ -31,6 +32,7 @@ const (
 	NameKey               = "name"
 	CREATE                = 0
 	DELETE                = 1
+	UPDATE                = 2
 )
 
 func BuildKeyFromNames(namespace string, name string) (string, error) {
@@ -56,6 +58,7 @@ type VirtualKubeletProvider struct {
 	internalIP           string
 	daemonEndpointPort   int32
 	pods                 map[string]*v1.Pod
+	podsMutex            sync.RWMutex
 	config               VirtualKubeletConfig
 	startTime            time.Time
 	notifier             func(*v1.Pod)
@@ -317,7 +320,9 @@ func (p *VirtualKubeletProvider) CreatePod(ctx context.Context, pod *v1.Pod) err
 
 	}
 
+	p.podsMutex.Lock()
 	p.pods[key] = pod
+	p.podsMutex.Unlock()
 	p.notifier(pod)
 
 	return nil
@@ -338,7 +343,9 @@ func (p *VirtualKubeletProvider) UpdatePod(ctx context.Context, pod *v1.Pod) err
 		return err
 	}
 
+	p.podsMutex.Lock()
 	p.pods[key] = pod
+	p.podsMutex.Unlock()
 	p.notifier(pod)
 
 	return nil
@@ -359,7 +366,10 @@ func (p *VirtualKubeletProvider) DeletePod(ctx context.Context, pod *v1.Pod) (er
 		return err
 	}
 
-	if _, exists := p.pods[key]; !exists {
+	p.podsMutex.RLock()
+	_, exists := p.pods[key]
+	p.podsMutex.RUnlock()
+	if !exists {
 		return errdefs.NotFound("pod not found")
 	}
 
@@ -397,7 +407,9 @@ func (p *VirtualKubeletProvider) DeletePod(ctx context.Context, pod *v1.Pod) (er
 	}
 
 	p.notifier(pod)
+	p.podsMutex.Lock()
 	delete(p.pods, key)
+	p.podsMutex.Unlock()
 
 	return nil
 }
@@ -420,6 +432,8 @@ func (p *VirtualKubeletProvider) GetPod(ctx context.Context, namespace, name str
 		return nil, err
 	}
 
+	p.podsMutex.RLock()
+	defer p.podsMutex.RUnlock()
 	if pod, ok := p.pods[key]; ok {
 		return pod, nil
 	}
@@ -452,13 +466,20 @@ func (p *VirtualKubeletProvider) GetPods(ctx context.Context) ([]*v1.Pod, error)
 
 	log.G(ctx).Info("receive GetPods")
 
-	var pods []*v1.Pod
+	return p.podsSnapshot(), nil
+}
+
+// podsSnapshot returns the Pods known to the provider, so that they can be iterated over
+// without holding podsMutex, e.g. while InterLink is being called.
+func (p *VirtualKubeletProvider) podsSnapshot() []*v1.Pod {
+	p.podsMutex.RLock()
+	defer p.podsMutex.RUnlock()
 
+	var pods []*v1.Pod
 	for _, pod := range p.pods {
 		pods = append(pods, pod)
 	}
-
-	return pods, nil
+	return pods
 }
 
 // NodeConditions returns a list of conditions (Ready, OutOfDisk, etc), for updates to the node status
@@ -530,6 +551,7 @@ func (p *VirtualKubeletProvider) statusLoop(ctx context.Context) {
 		log.G(context.Background()).Fatal(err)
 	}
 
+	var lastMountRefresh time.Time
 	for {
 		t.Reset(5 * time.Second)
 		select {
@@ -546,10 +568,38 @@ func (p *VirtualKubeletProvider) statusLoop(ctx context.Context) {
 		if err != nil {
 			log.G(ctx).Error(err)
 		}
+
+		interval := time.Duration(p.interLinkConfig.MountRefreshInterval) * time.Second
+		if interval > 0 && time.Since(lastMountRefresh) >= interval {
+			p.refreshMounts(ctx)
+			lastMountRefresh = time.Now()
+		}
 		log.G(ctx).Info("statusLoop=end")
 	}
 }
 
+// refreshMounts sends the current ConfigMaps and Secrets of the running Pods which opted in to
+// InterLink, for the files mounted in their containers to be updated. Pods opt in through the
+// job.vk.io/refresh-mounts annotation, defaulting to the RefreshMounts field of the config.
+func (p *VirtualKubeletProvider) refreshMounts(ctx context.Context) {
+	for _, pod := range p.podsSnapshot() {
+		if pod.Status.Phase != v1.PodRunning {
+			continue
+		}
+		refresh := p.interLinkConfig.RefreshMounts
+		if annotation, ok := pod.Annotations["job.vk.io/refresh-mounts"]; ok {
+			refresh = annotation == "true"
+		}
+		if !refresh {
+			continue
+		}
+		err := RemoteExecution(ctx, UPDATE, pod, p.interLinkConfig)
+		if err != nil {
+			log.G(ctx).Warning("Unable to refresh the ConfigMaps and Secrets of pod " + pod.Name + ": " + err.Error())
+		}
+	}
+}
+
 // addAttributes adds the specified attributes to the provided span.
 // attrs must be an even-sized list of string arguments.
 // Otherwise, the span won't be modified.
@@ -579,9 +629,16 @@ func (p *VirtualKubeletProvider) GetLogs(ctx context.Context, namespace, podName
 		log.G(ctx).Error(err)
 	}
 
+	p.podsMutex.RLock()
+	pod, ok := p.pods[key]
+	p.podsMutex.RUnlock()
+	if !ok {
+		return nil, errdefs.NotFoundf("pod \"%s/%s\" is not known to the provider", namespace, podName)
+	}
+
 	logsRequest := commonIL.LogStruct{
 		Namespace:     namespace,
-		PodUID:        string(p.pods[key].UID),
+		PodUID:        string(pod.UID),
 		PodName:       podName,
 		ContainerName: containerName,
 		Opts:          commonIL.ContainerLogOpts(opts),
@@ -609,7 +666,7 @@ func (p *VirtualKubeletProvider) GetStatsSummary(ctx context.Context) (*stats.Su
 	}
 
 	// Populate the Summary object with dummy stats for each pod known by this provider.
-	for _, pod := range p.pods {
+	for _, pod := range p.podsSnapshot() {
 		var (
 			// totalUsageNanoCores will be populated with the sum of the values of UsageNanoCores computes across all containers in the pod.
 			totalUsageNanoCores uint64